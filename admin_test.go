@@ -0,0 +1,42 @@
+package smsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	ks := NewMemKeyStore()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/keys", NewKeyHandler(ks).HandleKeys)
+
+	cases := []struct {
+		token     string
+		adminAuth string
+		code      int
+	}{
+		{token: "s3cret", adminAuth: "", code: http.StatusUnauthorized},
+		{token: "s3cret", adminAuth: "Bearer nope", code: http.StatusUnauthorized},
+		{token: "", adminAuth: "Bearer ", code: http.StatusUnauthorized},
+		{token: "s3cret", adminAuth: "Bearer s3cret", code: http.StatusCreated},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/admin/keys", strings.NewReader(`{"name": "any", "originators": ["*"]}`))
+		if c.adminAuth != "" {
+			req.Header.Set("Authorization", c.adminAuth)
+		}
+
+		rec := httptest.NewRecorder()
+		AdminAuth(c.token, mux).ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %q", rec.Code, c.code, c.adminAuth)
+		}
+	}
+
+	if keys, _ := ks.List(); len(keys) != 1 {
+		t.Errorf("Got keys: %+v, expected only one created with admin token", keys)
+	}
+}
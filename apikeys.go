@@ -0,0 +1,383 @@
+package smsd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnyOriginator in allowed originators of API key lets it send from any originator.
+const AnyOriginator = "*"
+
+var (
+	// ErrUnauthorized is returned for request without valid API key.
+	ErrUnauthorized = errors.New("API key is not valid")
+	// ErrOriginatorNotAllowed is returned for request with originator that API key can not use.
+	ErrOriginatorNotAllowed = errors.New("originator is not allowed for API key")
+	// ErrSkipNotAllowed is returned for request that skips suppression list with API key that can not do it.
+	ErrSkipNotAllowed = errors.New("skip_suppression is not allowed for API key")
+)
+
+// APIKey identifies service that sends messages. Only hash of key token is kept, token is shown once on creation.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is hex encoded SHA-256 of token.
+	Hash string `json:"hash,omitempty"`
+	// Originators key is allowed to send from, AnyOriginator allows all of them.
+	Originators []string `json:"originators"`
+	// CallbackURL is used for requests of key that have no callback URL of their own.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// SkipSuppression allows key to send messages with skip_suppression to numbers that opted out.
+	SkipSuppression bool   `json:"skip_suppression,omitempty"`
+	Limits          Limits `json:"limits"`
+	// Weight is number of SMS key sends in its turn when several keys have queued messages, default is 1.
+	Weight    int       `json:"weight,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewAPIKey generates key with random ID and token. Token is ID and secret separated by dot,
+// it is returned to be handed over to key owner and can not be recovered from key.
+func NewAPIKey(name string, originators []string, callbackURL string) (APIKey, string) {
+	k := APIKey{
+		ID:          newID()[:16],
+		Name:        name,
+		Originators: originators,
+		CallbackURL: callbackURL,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	token := k.ID + "." + newID()
+	k.Hash = hashToken(token)
+
+	return k, token
+}
+
+// AllowsOriginator returns true if key can send messages from originator, case is ignored.
+func (k APIKey) AllowsOriginator(originator string) bool {
+	for _, o := range k.Originators {
+		if o == AnyOriginator || strings.EqualFold(o, originator) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns static error if key can not be used.
+func (k APIKey) validate() error {
+	if len(k.Originators) == 0 {
+		return errors.New("originators can not be blank")
+	}
+	for _, o := range k.Originators {
+		if o != AnyOriginator && !MSISDNRegex.MatchString(o) && !OriginatorRegex.MatchString(o) {
+			return errors.New("originator is not an MSISDN or it is to long")
+		}
+	}
+
+	if k.CallbackURL != "" {
+		if err := checkCallbackURL(k.CallbackURL); err != nil {
+			return err
+		}
+	}
+
+	if k.Weight < 0 {
+		return errors.New("weight can not be negative")
+	}
+
+	return k.Limits.validate()
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyWeights returns weight of tenant that is ID of API key, to be used with WithTenantWeights.
+// Messages without API key and of keys that were removed have weight 1.
+func KeyWeights(ks KeyStore) func(tenant string) int {
+	return func(tenant string) int {
+		k, err := ks.Get(tenant)
+		if err != nil || k.Weight < 1 {
+			return 1
+		}
+		return k.Weight
+	}
+}
+
+// KeyStore keeps API keys.
+type KeyStore interface {
+	// Add saves key, key with the same ID is replaced.
+	Add(k APIKey) error
+	// Remove returns ErrNotFound if there is no key with ID.
+	Remove(id string) error
+	// Get returns ErrNotFound if there is no key with ID.
+	Get(id string) (APIKey, error)
+	// List returns keys sorted by name.
+	List() ([]APIKey, error)
+}
+
+// Authenticate finds key of token, ErrUnauthorized is returned if there is none.
+func Authenticate(ks KeyStore, token string) (APIKey, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 1 {
+		return APIKey{}, ErrUnauthorized
+	}
+
+	k, err := ks.Get(token[:i])
+	if err == ErrNotFound {
+		return APIKey{}, ErrUnauthorized
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(k.Hash)) != 1 {
+		return APIKey{}, ErrUnauthorized
+	}
+
+	return k, nil
+}
+
+// memKeys keeps API keys in memory, so they are lost on restart.
+type memKeys struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+// NewMemKeyStore creates KeyStore that is kept in memory.
+func NewMemKeyStore() KeyStore {
+	return &memKeys{
+		keys: make(map[string]APIKey),
+	}
+}
+
+func (s *memKeys) Add(k APIKey) error {
+	s.mu.Lock()
+	s.keys[k.ID] = k
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memKeys) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.keys, id)
+
+	return nil
+}
+
+func (s *memKeys) Get(id string) (APIKey, error) {
+	s.mu.RLock()
+	k, ok := s.keys[id]
+	s.mu.RUnlock()
+
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+
+	return k, nil
+}
+
+func (s *memKeys) List() ([]APIKey, error) {
+	s.mu.RLock()
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+// FileKeyStore keeps API keys in JSON file. File is rewritten on every change,
+// so change is either saved completely or not at all.
+type FileKeyStore struct {
+	path string
+
+	mu  sync.Mutex
+	mem memKeys
+}
+
+// OpenKeyStore loads API keys from file on provided path, file is created on first change.
+func OpenKeyStore(path string) (*FileKeyStore, error) {
+	s := &FileKeyStore{
+		path: path,
+		mem:  memKeys{keys: make(map[string]APIKey)},
+	}
+
+	var keys []APIKey
+	if err := readJSONFile(path, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		s.mem.keys[k.ID] = k
+	}
+
+	return s, nil
+}
+
+// Add saves key to the file.
+func (s *FileKeyStore) Add(k APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.mem.keys[k.ID]
+	s.mem.Add(k)
+
+	if err := s.save(); err != nil {
+		// Keeping memory in line with the file.
+		if existed {
+			s.mem.Add(prev)
+		} else {
+			s.mem.Remove(k.ID)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Remove deletes key from the file.
+func (s *FileKeyStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.mem.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	s.mem.Remove(id)
+
+	if err := s.save(); err != nil {
+		s.mem.Add(prev)
+		return err
+	}
+
+	return nil
+}
+
+// Get returns key with ID.
+func (s *FileKeyStore) Get(id string) (APIKey, error) {
+	return s.mem.Get(id)
+}
+
+// List returns keys sorted by name.
+func (s *FileKeyStore) List() ([]APIKey, error) {
+	return s.mem.List()
+}
+
+func (s *FileKeyStore) save() error {
+	keys, err := s.mem.List()
+	if err != nil {
+		return err
+	}
+
+	return writeJSONFile(s.path, keys)
+}
+
+// KeyHandler manages API keys over HTTP.
+type KeyHandler struct {
+	keys KeyStore
+}
+
+// NewKeyHandler constructs KeyHandler for provided store.
+func NewKeyHandler(ks KeyStore) *KeyHandler {
+	return &KeyHandler{
+		keys: ks,
+	}
+}
+
+// keyRequest is a body of request that creates API key.
+type keyRequest struct {
+	Name            string   `json:"name"`
+	Originators     []string `json:"originators"`
+	CallbackURL     string   `json:"callback_url"`
+	SkipSuppression bool     `json:"skip_suppression"`
+	Limits          Limits   `json:"limits"`
+	Weight          int      `json:"weight"`
+}
+
+// keyResponse is created API key with its token.
+type keyResponse struct {
+	APIKey
+	Token string `json:"token"`
+}
+
+// HandleKeys lists API keys on GET, creates one on POST and deletes key with ID that is last element of URL path
+// on DELETE. Token of created key is only returned in response to POST.
+func (h *KeyHandler) HandleKeys(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		keys, err := h.keys.List()
+		if err != nil {
+			log.Println("Failed to list API keys, error:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		for i := range keys {
+			keys[i].Hash = ""
+		}
+		writeJSON(w, http.StatusOK, keys)
+	case "POST":
+		var kr keyRequest
+		if err := json.NewDecoder(req.Body).Decode(&kr); err != nil {
+			http.Error(w, "request body is not valid", http.StatusBadRequest)
+			return
+		}
+
+		k, token := NewAPIKey(kr.Name, kr.Originators, kr.CallbackURL)
+		k.SkipSuppression = kr.SkipSuppression
+		k.Limits = kr.Limits
+		k.Weight = kr.Weight
+		if err := k.validate(); err != nil {
+			// Error is static, it is safe to return it.
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := h.keys.Add(k); err != nil {
+			log.Println("Failed to add API key, error:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("API key %s created for %q.\n", k.ID, k.Name)
+
+		k.Hash = ""
+		writeJSON(w, http.StatusCreated, keyResponse{APIKey: k, Token: token})
+	case "DELETE":
+		err := h.keys.Remove(path.Base(req.URL.Path))
+		if err == ErrNotFound {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Failed to remove API key, error:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
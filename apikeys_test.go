@@ -0,0 +1,165 @@
+package smsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	ks := NewMemKeyStore()
+
+	k, token := NewAPIKey("billing", []string{"Bank"}, "")
+	ks.Add(k)
+
+	if k.Hash == "" || strings.Contains(k.Hash, token) {
+		t.Errorf("Got hash: %q", k.Hash)
+	}
+
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{token: token},
+		{token: k.ID + ".0123456789abcdef0123456789abcdef", err: ErrUnauthorized},
+		{token: "0123456789abcdef." + token[len(k.ID)+1:], err: ErrUnauthorized},
+		{token: token[len(k.ID)+1:], err: ErrUnauthorized},
+		{token: "", err: ErrUnauthorized},
+	}
+
+	for _, c := range cases {
+		got, err := Authenticate(ks, c.token)
+		if err != c.err {
+			t.Errorf("Got error: %v, expected: %v for %q", err, c.err, c.token)
+			continue
+		}
+		if err == nil && got.ID != k.ID {
+			t.Errorf("Got key: %+v, expected: %+v", got, k)
+		}
+	}
+}
+
+func TestAPIKeyAllowsOriginator(t *testing.T) {
+	k := APIKey{Originators: []string{"Bank", "380660000000"}}
+
+	for originator, allowed := range map[string]bool{
+		"Bank":         true,
+		"BANK":         true,
+		"380660000000": true,
+		"Shop":         false,
+		"380670000000": false,
+	} {
+		if k.AllowsOriginator(originator) != allowed {
+			t.Errorf("Got allowed: %t, expected: %t for %s", !allowed, allowed, originator)
+		}
+	}
+
+	if !(APIKey{Originators: []string{AnyOriginator}}).AllowsOriginator("Shop") {
+		t.Error("Key with any originator is not allowed to use one")
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+
+	ks, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal("Failed to open store:", err)
+	}
+
+	billing, token := NewAPIKey("billing", []string{"Bank"}, "https://billing.example.com/sms")
+	shop, _ := NewAPIKey("shop", []string{"Shop"}, "")
+	ks.Add(billing)
+	ks.Add(shop)
+	if err := ks.Remove(shop.ID); err != nil {
+		t.Fatal("Failed to remove key:", err)
+	}
+	if err := ks.Remove(shop.ID); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+
+	// Reopening, as if process restarted.
+	ks, err = OpenKeyStore(path)
+	if err != nil {
+		t.Fatal("Failed to reopen store:", err)
+	}
+
+	k, err := Authenticate(ks, token)
+	if err != nil {
+		t.Fatal("Key is not authenticated after restart:", err)
+	}
+	if k.Name != "billing" || k.CallbackURL != billing.CallbackURL || len(k.Originators) != 1 {
+		t.Errorf("Got key: %+v", k)
+	}
+
+	if keys, _ := ks.List(); len(keys) != 1 {
+		t.Errorf("Got keys: %+v", keys)
+	}
+}
+
+func TestHandleKeys(t *testing.T) {
+	ks := NewMemKeyStore()
+	h := NewKeyHandler(ks)
+
+	for _, invalid := range []string{
+		`{"name": "shop"}`,
+		`{"name": "shop", "originators": ["Shop of Wonders"]}`,
+		`{"name": "shop", "originators": ["Shop"], "callback_url": "ftp://shop"}`,
+		`{"name": "shop", "originators": ["Shop"], "limits": {"rate": -1}}`,
+		`{"name": "shop", "originators": ["Shop"], "weight": -1}`,
+		`{`,
+	} {
+		rec := httptest.NewRecorder()
+		h.HandleKeys(rec, httptest.NewRequest("POST", "/admin/keys", strings.NewReader(invalid)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Got status: %d, expected: %d for %s", rec.Code, http.StatusBadRequest, invalid)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.HandleKeys(rec, httptest.NewRequest("POST", "/admin/keys", strings.NewReader(`{"name": "shop", "originators": ["Shop"]}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Got status: %d, expected: %d", rec.Code, http.StatusCreated)
+	}
+
+	var created keyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if created.Hash != "" {
+		t.Errorf("Hash is returned: %q", created.Hash)
+	}
+	if _, err := Authenticate(ks, created.Token); err != nil {
+		t.Errorf("Returned token is not valid: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleKeys(rec, httptest.NewRequest("GET", "/admin/keys", nil))
+
+	var keys []APIKey
+	if err := json.NewDecoder(rec.Body).Decode(&keys); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if len(keys) != 1 || keys[0].ID != created.ID || keys[0].Hash != "" {
+		t.Errorf("Got keys: %+v", keys)
+	}
+
+	for _, code := range []int{http.StatusNoContent, http.StatusNotFound} {
+		rec = httptest.NewRecorder()
+		h.HandleKeys(rec, httptest.NewRequest("DELETE", "/admin/keys/"+created.ID, nil))
+		if rec.Code != code {
+			t.Errorf("Got status: %d, expected: %d", rec.Code, code)
+		}
+	}
+}
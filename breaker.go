@@ -0,0 +1,225 @@
+package smsd
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState tells if requests are let through to provider.
+type BreakerState int
+
+const (
+	// BreakerClosed provider is healthy, all requests go through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen provider is failing, requests go to next provider.
+	BreakerOpen
+	// BreakerHalfOpen open timeout passed, single probe request is let through.
+	BreakerHalfOpen
+)
+
+// String returns human readable name of breaker state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// MarshalText encodes state as its name.
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// BreakerConfig configures when circuit breaker opens and when it probes provider again.
+type BreakerConfig struct {
+	// ConsecutiveFailures opens breaker after this many failures in a row.
+	ConsecutiveFailures int
+	// FailureRate opens breaker when share of failures among last Window results reaches it.
+	FailureRate float64
+	// Window number of last results failure rate is calculated for. It is not checked until window is full.
+	Window int
+	// OpenTimeout time before breaker lets probe request through.
+	OpenTimeout time.Duration
+}
+
+// DefaultBreakerConfig opens after 5 failures in a row or half of 20 last requests failed, probes in 30 seconds.
+var DefaultBreakerConfig = BreakerConfig{
+	ConsecutiveFailures: 5,
+	FailureRate:         0.5,
+	Window:              20,
+	OpenTimeout:         30 * time.Second,
+}
+
+// BreakerStatus is a snapshot of breaker state.
+type BreakerStatus struct {
+	Provider            string       `json:"provider"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	FailureRate         float64      `json:"failure_rate"`
+	OpenedAt            time.Time    `json:"opened_at,omitempty"`
+}
+
+// Breaker is a circuit breaker that stops sending to provider when it fails.
+type Breaker struct {
+	mu  sync.Mutex
+	cfg BreakerConfig
+	now func() time.Time
+
+	state       BreakerState
+	consecutive int
+	// results ring of last Window outcomes, true is failure.
+	results  []bool
+	next     int
+	filled   bool
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker creates closed Breaker.
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+
+	return &Breaker{
+		cfg:     cfg,
+		now:     time.Now,
+		results: make([]bool, cfg.Window),
+	}
+}
+
+// Allow tells if request can be sent. When open timeout passes breaker becomes half-open
+// and lets through single probe, its result decides if breaker closes or opens again.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records successful request.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.reset()
+		return
+	}
+
+	b.consecutive = 0
+	b.record(false)
+}
+
+// Failure records failed request and opens breaker if failure limits are reached.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.open()
+		return
+	}
+
+	b.consecutive++
+	b.record(true)
+
+	if b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures {
+		b.open()
+		return
+	}
+	if b.cfg.FailureRate > 0 && b.filled && b.failureRate() >= b.cfg.FailureRate {
+		b.open()
+	}
+}
+
+// Release returns probe slot if request was let through but its result says nothing about provider health.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// Status returns snapshot of breaker state.
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutive,
+		FailureRate:         b.failureRate(),
+	}
+	if b.state != BreakerClosed {
+		st.OpenedAt = b.openedAt
+	}
+
+	return st
+}
+
+func (b *Breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+	b.probing = false
+}
+
+// reset closes breaker and forgets previous results.
+func (b *Breaker) reset() {
+	b.state = BreakerClosed
+	b.consecutive = 0
+	b.probing = false
+	b.next = 0
+	b.filled = false
+	for i := range b.results {
+		b.results[i] = false
+	}
+}
+
+func (b *Breaker) record(failed bool) {
+	b.results[b.next] = failed
+	b.next++
+	if b.next == len(b.results) {
+		b.next = 0
+		b.filled = true
+	}
+}
+
+func (b *Breaker) failureRate() float64 {
+	n := b.next
+	if b.filled {
+		n = len(b.results)
+	}
+	if n == 0 {
+		return 0
+	}
+
+	var failed int
+	for _, f := range b.results[:n] {
+		if f {
+			failed++
+		}
+	}
+
+	return float64(failed) / float64(n)
+}
@@ -0,0 +1,76 @@
+package smsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b := NewBreaker(BreakerConfig{ConsecutiveFailures: 3, Window: 100, OpenTimeout: time.Minute})
+
+	b.Failure()
+	b.Failure()
+	b.Success() // Resets consecutive failures.
+	b.Failure()
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("Breaker opened before limit was reached")
+	}
+
+	b.Failure()
+	if b.Allow() {
+		t.Error("Breaker is closed after 3 failures in a row")
+	}
+	if st := b.Status(); st.State != BreakerOpen {
+		t.Errorf("Got state: %s, expected: %s", st.State, BreakerOpen)
+	}
+}
+
+func TestBreakerOpensOnFailureRate(t *testing.T) {
+	b := NewBreaker(BreakerConfig{FailureRate: 0.5, Window: 4, OpenTimeout: time.Minute})
+
+	b.Failure()
+	b.Failure()
+	b.Success()
+	if !b.Allow() {
+		t.Fatal("Breaker opened before window was full")
+	}
+
+	b.Failure()
+	if b.Allow() {
+		t.Error("Breaker is closed with 3 of 4 requests failed")
+	}
+}
+
+func TestBreakerProbesWhenHalfOpen(t *testing.T) {
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	b := NewBreaker(BreakerConfig{ConsecutiveFailures: 1, Window: 10, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Breaker is not open")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("Breaker did not let probe through after timeout")
+	}
+	if b.Allow() {
+		t.Error("Breaker let second request through while probing")
+	}
+
+	// Failed probe opens breaker again.
+	b.Failure()
+	if st := b.Status(); st.State != BreakerOpen {
+		t.Errorf("Got state: %s, expected: %s", st.State, BreakerOpen)
+	}
+
+	now = now.Add(time.Minute)
+	b.Allow()
+	b.Success()
+	if st := b.Status(); st.State != BreakerClosed || st.FailureRate != 0 {
+		t.Errorf("Got status: %+v, expected closed breaker with clean history", st)
+	}
+}
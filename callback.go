@@ -0,0 +1,344 @@
+package smsd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// CallbackTimestampHeader holds unix time callback was signed at.
+	CallbackTimestampHeader = "X-SMSd-Timestamp"
+	// CallbackSignatureHeader holds "sha256=" and hex encoded HMAC-SHA256 of timestamp, dot and body.
+	CallbackSignatureHeader = "X-SMSd-Signature"
+
+	// callbackTTL is how long status changes of message are posted to its callback URL.
+	callbackTTL = 72 * time.Hour
+	// callbackLogSize number of latest callback attempts that are kept.
+	callbackLogSize = 1000
+)
+
+// errNonPublicAddress is returned when callback is not posted because its host is not on the internet.
+var errNonPublicAddress = errors.New("callback address is not public")
+
+// nonPublicNets are special purpose networks that net.IP methods do not cover.
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8",     // "This" network.
+	"100.64.0.0/10", // Carrier-grade NAT.
+	"192.0.0.0/24",  // IETF protocol assignments.
+	"198.18.0.0/15", // Benchmarking.
+	"240.0.0.0/4",   // Reserved.
+	"64:ff9b::/96",  // NAT64, it can reach private IPv4 networks.
+)
+
+// DefaultCallbackRetryPolicy makes 8 attempts within about 10 minutes.
+var DefaultCallbackRetryPolicy = RetryPolicy{
+	MaxAttempts: 8,
+	BaseDelay:   5 * time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+// CallbackDelivery is an attempt to post message status to its callback URL.
+type CallbackDelivery struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	State   State     `json:"state"`
+	Attempt int       `json:"attempt"`
+	Code    int       `json:"code,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Callbacks posts status of messages to URLs their senders asked for, every time message state changes.
+// Body is the same JSON that status endpoint returns, it is signed with shared secret.
+// Failed posts are retried with backoff, callbacks that are still pending on shutdown are lost.
+type Callbacks struct {
+	messenger Messenger
+	secret    []byte
+	retry     RetryPolicy
+	// HTTPClient posts callbacks, it can be changed to limit time or add proxy.
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	subs   map[string]*callbackSub
+	pruned time.Time
+	log    []CallbackDelivery
+}
+
+// callbackSub is callback URL of message and last state that was posted to it.
+type callbackSub struct {
+	url     string
+	sent    State
+	created time.Time
+}
+
+// NewCallbacks creates Callbacks for messages of Messenger, posts are signed with secret.
+func NewCallbacks(m Messenger, secret string, retry RetryPolicy) *Callbacks {
+	return &Callbacks{
+		messenger:  m,
+		secret:     []byte(secret),
+		retry:      retry,
+		HTTPClient: newPublicHTTPClient(),
+		subs:       make(map[string]*callbackSub),
+	}
+}
+
+// Subscribe sets URL that status changes of message are posted to.
+func (c *Callbacks) Subscribe(id, url string) {
+	c.mu.Lock()
+	c.subs[id] = &callbackSub{url: url, sent: StateQueued, created: time.Now()}
+
+	// Forgetting messages that never got final status.
+	if time.Since(c.pruned) > time.Minute {
+		for id, sub := range c.subs {
+			if time.Since(sub.created) > callbackTTL {
+				delete(c.subs, id)
+			}
+		}
+		c.pruned = time.Now()
+	}
+	c.mu.Unlock()
+
+	// Status may have changed before subscription.
+	if s, err := c.messenger.Status(id); err == nil {
+		c.StatusChanged(s)
+	}
+}
+
+// StatusChanged posts status if message has callback URL and its state is not posted yet.
+// It does not block, so it can be registered with Client.OnStatusChange.
+func (c *Callbacks) StatusChanged(s Status) {
+	c.mu.Lock()
+	sub, ok := c.subs[s.ID]
+	if !ok || sub.sent == s.State {
+		c.mu.Unlock()
+		return
+	}
+	sub.sent = s.State
+	if isFinal(s.State) {
+		delete(c.subs, s.ID)
+	}
+	c.mu.Unlock()
+
+	go c.post(sub.url, s, 1)
+}
+
+// Deliveries returns latest callback attempts, oldest first. All of them are returned if id is empty.
+func (c *Callbacks) Deliveries(id string) []CallbackDelivery {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deliveries := make([]CallbackDelivery, 0, len(c.log))
+	for _, d := range c.log {
+		if id == "" || d.ID == id {
+			deliveries = append(deliveries, d)
+		}
+	}
+
+	return deliveries
+}
+
+// post sends status to URL and schedules next attempt if it failed and can succeed later.
+func (c *Callbacks) post(url string, s Status, attempt int) {
+	d := CallbackDelivery{
+		ID:      s.ID,
+		URL:     url,
+		State:   s.State,
+		Attempt: attempt,
+		At:      time.Now().UTC(),
+	}
+
+	retry, err := c.send(url, s, &d)
+	if err != nil {
+		d.Error = err.Error()
+	}
+	c.record(d)
+
+	if err == nil {
+		return
+	}
+	if !retry || attempt >= c.retry.MaxAttempts {
+		log.Printf("Failed to post status of message %s to callback after %d attempts: %s\n", s.ID, attempt, err)
+		return
+	}
+
+	time.AfterFunc(c.retry.backoff(attempt), func() {
+		c.post(url, s, attempt+1)
+	})
+}
+
+// send makes single attempt, it returns false if there is no point to try again.
+func (c *Callbacks) send(url string, s Status, d *CallbackDelivery) (bool, error) {
+	code, retry, err := postSigned(c.HTTPClient, url, c.secret, s)
+	d.Code = code
+
+	return retry, err
+}
+
+// postSigned posts v as JSON with timestamp and signature headers. It returns response code
+// and false if there is no point to try again.
+func postSigned(client *http.Client, url string, secret []byte, v interface{}) (int, bool, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, false, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	req.Header.Set(CallbackSignatureHeader, "sha256="+signCallback(secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, !errors.Is(err, errNonPublicAddress), err
+	}
+	defer resp.Body.Close()
+
+	// Subscriber errors are classified the same way as gateway ones.
+	if err := checkResponse(resp); err != nil {
+		return resp.StatusCode, errorKind(err) != Permanent, err
+	}
+
+	return resp.StatusCode, false, nil
+}
+
+// signCallback returns hex encoded HMAC-SHA256 of timestamp and body separated by dot.
+func signCallback(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Callbacks) record(d CallbackDelivery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.log = append(c.log, d)
+	if len(c.log) > callbackLogSize {
+		c.log = append(c.log[:0], c.log[len(c.log)-callbackLogSize:]...)
+	}
+}
+
+// CallbackLog declares method to inspect callback attempts.
+type CallbackLog interface {
+	Deliveries(id string) []CallbackDelivery
+}
+
+// CallbackLogHandler exposes callback delivery log over HTTP.
+type CallbackLogHandler struct {
+	log CallbackLog
+}
+
+// NewCallbackLogHandler constructs CallbackLogHandler for provided log.
+func NewCallbackLogHandler(l CallbackLog) *CallbackLogHandler {
+	return &CallbackLogHandler{
+		log: l,
+	}
+}
+
+// HandleDeliveries lists latest callback attempts on GET, optional id query parameter filters them by message.
+func (h *CallbackLogHandler) HandleDeliveries(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.log.Deliveries(req.URL.Query().Get("id")))
+}
+
+// checkCallbackURL returns static error if URL is not HTTP or its host is an address that is not public.
+// Host names are checked when callback is posted, they can resolve to other addresses by then.
+func checkCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback_url is not an HTTP URL")
+	}
+
+	host := strings.TrimSuffix(u.Hostname(), ".")
+	if ip := net.ParseIP(host); (ip != nil && !isPublicIP(ip)) || strings.EqualFold(host, "localhost") {
+		return errors.New("callback_url is not a public address")
+	}
+
+	return nil
+}
+
+// newPublicHTTPClient creates client that connects to public addresses only. Address is checked after host name
+// is resolved, so names and redirects that lead to internal network are rejected too. Proxy is not used,
+// it would connect instead of the client.
+func newPublicHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: defaultHTTPTimeout,
+		Control: denyNonPublic,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   defaultHTTPTimeout,
+		Transport: transport,
+	}
+}
+
+// denyNonPublic is net.Dialer.Control that rejects connection to address that is not public.
+func denyNonPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return errNonPublicAddress
+	}
+
+	return nil
+}
+
+// isPublicIP returns false for loopback, private, link-local, multicast and other special purpose addresses.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
@@ -0,0 +1,212 @@
+package smsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallbacksPostSignedStatusChanges(t *testing.T) {
+	posted := make(chan Status, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get(CallbackTimestampHeader) + "."))
+		mac.Write(body)
+		if sig := r.Header.Get(CallbackSignatureHeader); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Got signature: %q", sig)
+		}
+
+		var s Status
+		if err := json.Unmarshal(body, &s); err != nil {
+			t.Error("Failed to decode callback:", err)
+		}
+		posted <- s
+	}))
+	defer srv.Close()
+
+	messenger := &MockedMessenger{statuses: map[string]Status{"42": {ID: "42", State: StateQueued}}}
+	c := NewCallbacks(messenger, "secret", DefaultCallbackRetryPolicy)
+	// Test server is on loopback that default client does not connect to.
+	c.HTTPClient = srv.Client()
+	c.Subscribe("42", srv.URL)
+
+	for _, state := range []State{StateSubmitted, StateSubmitted, StateDelivered, StateFailed} {
+		c.StatusChanged(Status{ID: "42", State: state})
+		c.StatusChanged(Status{ID: "43", State: state})
+	}
+
+	for _, expected := range []State{StateSubmitted, StateDelivered} {
+		select {
+		case s := <-posted:
+			// Posts are concurrent, so order is not checked.
+			if s.ID != "42" {
+				t.Errorf("Got status: %+v", s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Status %q is not posted", expected)
+		}
+	}
+
+	select {
+	case s := <-posted:
+		t.Errorf("Got unexpected status: %+v", s)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestCallbacksRetryFailedPosts(t *testing.T) {
+	cases := []struct {
+		codes       []int
+		maxAttempts int
+		attempts    int
+	}{
+		{codes: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, maxAttempts: 3, attempts: 3},
+		{codes: []int{http.StatusInternalServerError, http.StatusInternalServerError}, maxAttempts: 2, attempts: 2},
+		{codes: []int{http.StatusGone}, maxAttempts: 3, attempts: 1},
+	}
+
+	for _, c := range cases {
+		var served int32
+		requests := make(chan int, len(c.codes))
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			code := c.codes[atomic.AddInt32(&served, 1)-1]
+			requests <- code
+			w.WriteHeader(code)
+		}))
+
+		policy := RetryPolicy{MaxAttempts: c.maxAttempts, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+		callbacks := NewCallbacks(&MockedMessenger{}, "secret", policy)
+		callbacks.HTTPClient = srv.Client()
+		callbacks.Subscribe("42", srv.URL)
+		callbacks.StatusChanged(Status{ID: "42", State: StateFailed})
+
+		for i := 0; i < c.attempts; i++ {
+			select {
+			case <-requests:
+			case <-time.After(time.Second):
+				t.Fatalf("Got %d attempts, expected: %d", i, c.attempts)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		deliveries := callbacks.Deliveries("42")
+		if len(deliveries) != c.attempts {
+			t.Errorf("Got %d deliveries logged, expected: %d", len(deliveries), c.attempts)
+		}
+		if last := deliveries[len(deliveries)-1]; last.Code != c.codes[c.attempts-1] || last.Attempt != c.attempts {
+			t.Errorf("Got last delivery: %+v", last)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestCallbacksDoNotConnectToNonPublicAddress(t *testing.T) {
+	var served int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+	}))
+	defer srv.Close()
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	callbacks := NewCallbacks(&MockedMessenger{}, "secret", policy)
+
+	// Host name is resolved to loopback address only when connection is made.
+	callbacks.Subscribe("42", strings.Replace(srv.URL, "127.0.0.1", "localhost", 1))
+	callbacks.StatusChanged(Status{ID: "42", State: StateFailed})
+	time.Sleep(50 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&served); n != 0 {
+		t.Errorf("Got %d callbacks posted to loopback address, expected none", n)
+	}
+
+	// There is no point to try again.
+	deliveries := callbacks.Deliveries("42")
+	if len(deliveries) != 1 || deliveries[0].Error == "" {
+		t.Errorf("Got deliveries: %+v, expected single failed one", deliveries)
+	}
+}
+
+func TestCheckCallbackURL(t *testing.T) {
+	cases := []struct {
+		url   string
+		valid bool
+	}{
+		{url: "https://example.com/sms", valid: true},
+		{url: "http://93.184.216.34:8080/sms", valid: true},
+		{url: "ftp://example.com/sms", valid: false},
+		{url: "http://localhost/sms", valid: false},
+		{url: "http://LOCALHOST./sms", valid: false},
+		{url: "http://127.0.0.1/sms", valid: false},
+		{url: "http://10.0.0.1/sms", valid: false},
+		{url: "http://169.254.169.254/latest/meta-data", valid: false},
+		{url: "http://100.64.0.1/sms", valid: false},
+		{url: "http://0.0.0.0/sms", valid: false},
+		{url: "http://[::1]/sms", valid: false},
+		{url: "http://[fd00::1]/sms", valid: false},
+		{url: "http://[::ffff:192.168.0.1]/sms", valid: false},
+	}
+
+	for _, c := range cases {
+		if err := checkCallbackURL(c.url); (err == nil) != c.valid {
+			t.Errorf("Got error: %v for %s, expected valid: %t", err, c.url, c.valid)
+		}
+	}
+}
+
+func TestDenyNonPublic(t *testing.T) {
+	cases := []struct {
+		address string
+		allowed bool
+	}{
+		{address: "93.184.216.34:443", allowed: true},
+		{address: "[2606:2800:220:1::]:443", allowed: true},
+		{address: "127.0.0.1:80", allowed: false},
+		{address: "192.168.1.1:80", allowed: false},
+		{address: "[::1]:80", allowed: false},
+		{address: "[fe80::1]:80", allowed: false},
+		{address: "[64:ff9b::a00:1]:80", allowed: false},
+	}
+
+	for _, c := range cases {
+		if err := denyNonPublic("tcp", c.address, nil); (err == nil) != c.allowed {
+			t.Errorf("Got error: %v for %s, expected allowed: %t", err, c.address, c.allowed)
+		}
+	}
+}
+
+func TestHandleDeliveries(t *testing.T) {
+	callbacks := NewCallbacks(&MockedMessenger{}, "secret", DefaultCallbackRetryPolicy)
+	callbacks.record(CallbackDelivery{ID: "42", State: StateDelivered})
+	callbacks.record(CallbackDelivery{ID: "43", State: StateFailed})
+
+	h := NewCallbackLogHandler(callbacks)
+
+	rec := httptest.NewRecorder()
+	h.HandleDeliveries(rec, httptest.NewRequest("GET", "/admin/callbacks?id=43", nil))
+
+	var deliveries []CallbackDelivery
+	if err := json.NewDecoder(rec.Body).Decode(&deliveries); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].ID != "43" {
+		t.Errorf("Got deliveries: %+v", deliveries)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleDeliveries(rec, httptest.NewRequest("POST", "/admin/callbacks", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
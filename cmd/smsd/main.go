@@ -4,48 +4,367 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	smsd "github.com/cooldarkdryplace/sms-service"
+	"github.com/cooldarkdryplace/sms-service/smpp"
 
 	mb "github.com/messagebird/go-rest-api"
 )
 
 const (
-	smsEndpoint = "/messages"
-	sendRate    = 1000 * time.Millisecond // SMS send rate.
+	smsEndpoint         = "/messages"
+	deadLettersEndpoint = "/admin/dead-letters"
+	providersEndpoint   = "/admin/providers"
+	routesEndpoint      = "/admin/routes"
+	reportsEndpoint     = "/reports/"
+	callbacksEndpoint   = "/admin/callbacks"
+	inboundEndpoint     = "/inbound/"
+	inboxEndpoint       = "/admin/inbound"
+	suppressionEndpoint = "/admin/suppressions"
+	keysEndpoint        = "/admin/keys"
+	rateEndpoint        = "/admin/rate"
+	queueEndpoint       = "/admin/queue"
+	sendRate            = 1000 * time.Millisecond // Default SMS send rate.
 )
 
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 
 	var (
-		port     string
-		token    string
-		queueLen int
+		port           string
+		adminAddr      string
+		adminToken     string
+		provider       string
+		token          string
+		mbSigningKey   string
+		twilioSID      string
+		twilioToken    string
+		twilioCallback string
+		twilioInbound  string
+		vonageKey      string
+		vonageSecret   string
+		vonageSigKey   string
+		httpURL        string
+		httpAuth       string
+		httpReportKey  string
+		routesPath     string
+		smppAddr       string
+		smppSystemID   string
+		smppPassword   string
+		smppListen     string
+		smppAccounts   string
+		queueLen       int
+		rate           float64
+		burst          int
+		workers        int
+		wideRefs       bool
+		storePath      string
+		deadPath       string
+		deadLimit      int
+		maxAttempts    int
+		drainTimeout   time.Duration
+		statusTTL      time.Duration
+		callbackKey    string
+		inboundRules   string
+		inboundKey     string
+		suppressPath   string
+		keysPath       string
 	)
 
 	// Not doing this in init to avoid possibility to use flag vars directly.
 	// Want them to be passed to consumers.
 	flag.StringVar(&port, "port", "8080", "Specifies port that server will use to accept connections")
-	flag.StringVar(&token, "token", "", "SMS Gateway API token")
-	flag.IntVar(&queueLen, "queue_length", 1000, "SMS Queue size. Rate limiting is enabled: 1 SMS/s.")
+	flag.StringVar(&adminAddr, "admin_addr", "127.0.0.1:8081", "Address of /admin endpoints, host:port. Has to be loopback unless -admin_token is set")
+	flag.StringVar(&adminToken, "admin_token", "", "Bearer token that /admin endpoints require. Not required on loopback if empty")
+	flag.StringVar(&provider, "provider", "messagebird", "Comma separated SMS gateways in failover order: messagebird, twilio, vonage, smpp or http")
+	flag.StringVar(&token, "token", "", "MessageBird.com API token")
+	flag.StringVar(&mbSigningKey, "mb_signing_key", "", "MessageBird.com signing key that delivery reports are verified with")
+	flag.StringVar(&twilioSID, "twilio_sid", "", "Twilio account SID")
+	flag.StringVar(&twilioToken, "twilio_token", "", "Twilio auth token")
+	flag.StringVar(&twilioCallback, "twilio_callback", "", "Public URL of /reports/twilio, delivery reports are not requested if empty")
+	flag.StringVar(&twilioInbound, "twilio_inbound", "", "Public URL of /inbound/twilio, incoming messages of Twilio are rejected if empty")
+	flag.StringVar(&vonageKey, "vonage_key", "", "Vonage API key")
+	flag.StringVar(&vonageSecret, "vonage_secret", "", "Vonage API secret")
+	flag.StringVar(&vonageSigKey, "vonage_signature_secret", "", "Vonage signature secret that delivery receipts are verified with")
+	flag.StringVar(&httpURL, "http_url", "", "URL of generic gateway that accepts SMS as JSON")
+	flag.StringVar(&httpAuth, "http_auth", "", "Authorization header value for generic gateway")
+	flag.StringVar(&httpReportKey, "http_report_secret", "", "Secret that delivery reports of generic gateway are signed with")
+	flag.StringVar(&smppAddr, "smpp_addr", "", "SMSC address, host:port")
+	flag.StringVar(&smppSystemID, "smpp_system_id", "", "SMPP system ID")
+	flag.StringVar(&smppPassword, "smpp_password", "", "SMPP password")
+	flag.StringVar(&smppListen, "smpp_listen", "", "Address to accept SMS from SMPP clients on, host:port. Disabled if empty")
+	flag.StringVar(&smppAccounts, "smpp_accounts", "", "Path to CSV file with system_id,password of SMPP clients")
+	flag.StringVar(&routesPath, "routes", "", "Path to CSV file with prefix,provider,cost routes. Reloaded on SIGHUP")
+	flag.IntVar(&queueLen, "queue_length", 1000, "Queue size in messages, concatenated SMS count as one. Rate is limited by -rate and -burst.")
+	flag.Float64Var(&rate, "rate", float64(time.Second/sendRate), "SMS per second, can be changed on /admin/rate")
+	flag.IntVar(&burst, "burst", 1, "SMS that can be sent at once after queue was idle")
+	flag.IntVar(&workers, "workers", 4, "SMS sent in parallel, messages to the same recipient are sent one by one")
+	flag.BoolVar(&wideRefs, "wide_refs", false, "Use 16-bit reference numbers in concatenated SMS headers, parts are one char shorter")
+	flag.StringVar(&storePath, "store", "", "Path to file that keeps SMS queue between restarts. Queue is not persisted if empty")
+	flag.StringVar(&deadPath, "dead_letters", "", "Path to file that keeps SMS that could not be sent. Kept in memory if empty")
+	flag.IntVar(&deadLimit, "dead_letter_limit", smsd.DefaultDeadLetterLimit, "Dead letters that are kept, oldest ones are dropped first")
+	flag.IntVar(&maxAttempts, "max_attempts", smsd.DefaultRetryPolicy.MaxAttempts, "Attempts to send SMS before it goes to dead letters")
+	flag.StringVar(&callbackKey, "callback_secret", "", "Secret that status callbacks are signed with. Callbacks are disabled if empty")
+	flag.StringVar(&inboundRules, "inbound_rules", "", "Path to CSV file with originator,keyword,url rules incoming messages are forwarded by")
+	flag.StringVar(&inboundKey, "inbound_secret", "", "Secret that forwarded incoming messages are signed with, required with -inbound_rules")
+	flag.StringVar(&suppressPath, "suppressions", "", "Path to file that keeps numbers that opted out. Kept in memory if empty")
+	flag.StringVar(&keysPath, "api_keys", "", "Path to file that keeps API keys. Requests are not authenticated if empty")
+	flag.DurationVar(&statusTTL, "status_ttl", smsd.DefaultStatusTTL, "Time status of message is kept after its last change, statuses are not persisted")
+	flag.DurationVar(&drainTimeout, "drain_timeout", 20*time.Second, "Time to send queued SMS on shutdown, unsent ones are kept in store")
 
 	flag.Parse()
 
-	client := smsd.NewMsgBirdClient(
-		mb.New(token),
+	if adminToken == "" && !isLoopback(adminAddr) {
+		log.Fatalln("Admin token is required for admin endpoints that are not on loopback address.")
+	}
+
+	if rate <= 0 || burst < 1 {
+		log.Fatalln("Rate and burst have to be positive.")
+	}
+	limiter := smsd.NewRateLimiter(rate, burst)
+
+	retry := smsd.DefaultRetryPolicy
+	retry.MaxAttempts = maxAttempts
+
+	opts := []smsd.Option{
+		smsd.WithRefAllocator(smsd.NewRecipientRefs()),
+		smsd.WithTracker(smsd.NewMemTrackerTTL(statusTTL)),
+		smsd.WithRetryPolicy(retry),
+		smsd.WithRateLimiter(limiter),
+		smsd.WithWorkers(workers),
+	}
+	if wideRefs {
+		opts = append(opts, smsd.WithWideRefs())
+	}
+
+	if storePath != "" {
+		store, err := smsd.OpenFileStore(storePath)
+		if err != nil {
+			log.Fatalf("Failed to open store: %s\n", err)
+		}
+		defer store.Close()
+
+		opts = append(opts, smsd.WithStore(store))
+	}
+
+	deadLetters := smsd.NewMemDeadLetters(deadLimit)
+	if deadPath != "" {
+		fileDeadLetters, err := smsd.OpenDeadLetters(deadPath, deadLimit)
+		if err != nil {
+			log.Fatalf("Failed to open dead letters: %s\n", err)
+		}
+		defer fileDeadLetters.Close()
+
+		deadLetters = fileDeadLetters
+	}
+	opts = append(opts, smsd.WithDeadLetters(deadLetters))
+
+	var rules []smsd.ForwardRule
+	if inboundRules != "" {
+		if inboundKey == "" {
+			log.Fatalln("Secret is required to forward incoming messages.")
+		}
+
+		var err error
+		if rules, err = smsd.LoadForwardRules(inboundRules); err != nil {
+			log.Fatalf("Failed to load forward rules: %s\n", err)
+		}
+	}
+	inbox := smsd.NewInbox(rules, inboundKey, smsd.DefaultCallbackRetryPolicy)
+
+	suppressions := smsd.NewMemSuppressionList()
+	if suppressPath != "" {
+		var err error
+		if suppressions, err = smsd.OpenSuppressionList(suppressPath); err != nil {
+			log.Fatalf("Failed to open suppression list: %s\n", err)
+		}
+	}
+
+	// STOP and START replies update suppression list before they are forwarded.
+	inbox.OnMessage(func(m smsd.InboundMessage) {
+		if err := smsd.ApplyOptOut(suppressions, m); err != nil {
+			log.Printf("Failed to apply opt-out of %s: %s\n", m.Originator, err)
+		}
+	})
+
+	// Client is created after gateways, SMSC receipts only come after it sends something.
+	var client *smsd.Client
+
+	var gateways []smsd.NamedProvider
+	parsers := make(map[string]smsd.ReportParser)
+	inboundParsers := make(map[string]smsd.InboundParser)
+	for _, name := range strings.Split(provider, ",") {
+		var gateway smsd.Provider
+
+		switch name {
+		case "messagebird":
+			mbProvider := smsd.NewMessageBirdProvider(mb.New(token))
+			mbProvider.SigningKey = mbSigningKey
+			gateway = mbProvider
+		case "twilio":
+			twilioProvider := smsd.NewTwilioProvider(twilioSID, twilioToken)
+			twilioProvider.StatusCallback = twilioCallback
+			twilioProvider.InboundURL = twilioInbound
+			gateway = twilioProvider
+		case "vonage":
+			vonageProvider := smsd.NewVonageProvider(vonageKey, vonageSecret)
+			vonageProvider.SignatureSecret = vonageSigKey
+			gateway = vonageProvider
+		case "smpp":
+			smppProvider := smsd.NewSMPPProvider(smpp.Config{
+				Addr:     smppAddr,
+				SystemID: smppSystemID,
+				Password: smppPassword,
+			}, func(r smsd.Report) {
+				r.Provider = "smpp"
+				if err := client.Report(r); err != nil {
+					log.Printf("Failed to apply SMSC receipt for %s: %s\n", r.ProviderID, err)
+				}
+			})
+			smppProvider.OnInbound = func(p smsd.InboundPart) {
+				if err := inbox.Receive(p); err != nil {
+					log.Printf("Failed to receive message from %s: %s\n", p.Originator, err)
+				}
+			}
+			defer smppProvider.Close()
+
+			gateway = smppProvider
+		case "http":
+			cfg := smsd.HTTPProviderConfig{URL: httpURL, ReportSecret: httpReportKey}
+			if httpAuth != "" {
+				cfg.Headers = map[string]string{"Authorization": httpAuth}
+			}
+			gateway = smsd.NewHTTPProvider(cfg)
+		default:
+			log.Fatalf("Unknown provider: %s\n", name)
+		}
+
+		if parser, ok := gateway.(smsd.ReportParser); ok {
+			parsers[name] = parser
+		}
+		if parser, ok := gateway.(smsd.InboundParser); ok {
+			inboundParsers[name] = parser
+		}
+
+		gateways = append(gateways, smsd.NamedProvider{Name: name, Provider: gateway})
+	}
+
+	failover := smsd.NewFailoverProvider(smsd.DefaultBreakerConfig, gateways...)
+
+	var gateway smsd.Provider = failover
+
+	var router *smsd.RoutingProvider
+	if routesPath != "" {
+		table, err := smsd.LoadRoutingTable(routesPath)
+		if err != nil {
+			log.Fatalf("Failed to load routes: %s\n", err)
+		}
+		router = smsd.NewRoutingProvider(table, failover)
+		gateway = router
+
+		go reloadOnHangup(router)
+	}
+
+	// Quotas are shared by HTTP and SMPP messages of the same key.
+	quotas := smsd.NewQuotas()
+
+	var keys smsd.KeyStore
+	if keysPath != "" {
+		var err error
+		if keys, err = smsd.OpenKeyStore(keysPath); err != nil {
+			log.Fatalf("Failed to open API keys: %s\n", err)
+		}
+		opts = append(opts, smsd.WithTenantWeights(smsd.KeyWeights(keys)))
+	}
+
+	client = smsd.NewClient(
+		gateway,
 		queueLen,
 		sendRate,
+		opts...,
 	)
 
+	var frontend *smsd.SMPPFrontend
+	if smppListen != "" {
+		accounts, err := smsd.LoadSMPPAccounts(smppAccounts)
+		if err != nil {
+			log.Fatalf("Failed to load SMPP accounts: %s\n", err)
+		}
+
+		ln, err := net.Listen("tcp", smppListen)
+		if err != nil {
+			log.Fatalf("Failed to listen for SMPP: %s\n", err)
+		}
+
+		frontend = smsd.NewSMPPFrontend(client, accounts)
+		frontend.Suppressions = suppressions
+		if keys != nil {
+			frontend.Keys = keys
+			frontend.Quotas = quotas
+		}
+		client.OnStatusChange(frontend.StatusChanged)
+
+		go func() {
+			if err := frontend.Serve(ln); err != smpp.ErrServerClosed {
+				log.Fatalf("SMPP server failed: %s\n", err)
+			}
+		}()
+	}
+
+	// Admin endpoints are served on their own address, public port has to be reachable for gateway webhooks.
 	mux := http.NewServeMux()
+	admin := http.NewServeMux()
+
+	handlerOpts := []smsd.HandlerOption{smsd.WithSuppressions(suppressions)}
+	if callbackKey != "" {
+		callbacks := smsd.NewCallbacks(client, callbackKey, smsd.DefaultCallbackRetryPolicy)
+		client.OnStatusChange(callbacks.StatusChanged)
+		handlerOpts = append(handlerOpts, smsd.WithCallbacks(callbacks))
 
-	handler := smsd.NewHandler(client)
+		admin.HandleFunc(callbacksEndpoint, smsd.NewCallbackLogHandler(callbacks).HandleDeliveries)
+	}
+
+	if keys != nil {
+		handlerOpts = append(handlerOpts, smsd.WithAPIKeys(keys), smsd.WithQuotas(quotas))
+
+		keyHandler := smsd.NewKeyHandler(keys)
+		admin.HandleFunc(keysEndpoint, keyHandler.HandleKeys)
+		admin.HandleFunc(keysEndpoint+"/", keyHandler.HandleKeys)
+	}
+
+	handler := smsd.NewHandler(client, handlerOpts...)
 	mux.HandleFunc(smsEndpoint, handler.HandleMsg)
+	mux.HandleFunc(smsEndpoint+"/", handler.HandleStatus)
+
+	dlHandler := smsd.NewDeadLetterHandler(client)
+	admin.HandleFunc(deadLettersEndpoint, dlHandler.HandleDeadLetters)
+	admin.HandleFunc(deadLettersEndpoint+"/", dlHandler.HandleDeadLetters)
+
+	mux.HandleFunc(reportsEndpoint, smsd.NewReportHandler(client, parsers).HandleReport)
+
+	mux.HandleFunc(inboundEndpoint, smsd.NewInboundHandler(inbox, inboundParsers).HandleInbound)
+	admin.HandleFunc(inboxEndpoint, smsd.NewInboxHandler(inbox).HandleMessages)
+
+	suppressionHandler := smsd.NewSuppressionHandler(suppressions)
+	admin.HandleFunc(suppressionEndpoint, suppressionHandler.HandleSuppressions)
+	admin.HandleFunc(suppressionEndpoint+"/", suppressionHandler.HandleSuppressions)
+
+	admin.HandleFunc(rateEndpoint, smsd.NewRateHandler(limiter).HandleRate)
+	admin.HandleFunc(queueEndpoint, smsd.NewQueueHandler(client).HandleQueue)
+	admin.HandleFunc(providersEndpoint, smsd.NewBreakerHandler(failover).HandleBreakers)
+
+	if router != nil {
+		routeHandler := smsd.NewRouteHandler(router)
+		admin.HandleFunc(routesEndpoint, routeHandler.HandleRoutes)
+		admin.HandleFunc(routesEndpoint+"/", routeHandler.HandleRoutes)
+	}
 
 	// Enabling timeouts as requests will be blocked if SMS queue is full.
 	// https://blog.cloudflare.com/exposing-go-on-the-internet/
@@ -57,27 +376,85 @@ func main() {
 		Handler:      mux,
 	}
 
+	var adminHandler http.Handler = admin
+	if adminToken != "" {
+		adminHandler = smsd.AdminAuth(adminToken, admin)
+	}
+	adminSrv := &http.Server{
+		Addr:         adminAddr,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		Handler:      adminHandler,
+	}
+
 	errChan := make(chan error)
 	signalChan := make(chan os.Signal, 1)
 
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		errChan <- srv.ListenAndServe()
 	}()
+	go func() {
+		errChan <- adminSrv.ListenAndServe()
+	}()
 
 	log.Printf("SMSd started %s\n", time.Now().UTC())
 
 	select {
 	case err := <-errChan:
 		log.Fatal(err)
-	case <-signalChan:
-		log.Println("Interrupt recieved. Graceful shutdown.")
+	case sig := <-signalChan:
+		log.Printf("%s recieved. Graceful shutdown.\n", sig)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
 		if err := srv.Shutdown(ctx); err != nil {
-			log.Fatalf("Server shutdown failed with error: %s\n", err)
+			log.Printf("Server shutdown failed with error: %s\n", err)
+		}
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			log.Printf("Admin server shutdown failed with error: %s\n", err)
+		}
+		if frontend != nil {
+			frontend.Close()
+		}
+
+		// No new messages after server is down, sending what is left in queue.
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer drainCancel()
+
+		left, err := client.Close(drainCtx)
+		if err != nil {
+			log.Printf("Queue is not drained: %s\n", err)
 		}
+		log.Printf("Stopped with %d SMS left unsent.\n", left)
 	}
 }
+
+// reloadOnHangup reloads routing table every time SIGHUP is received.
+func reloadOnHangup(r smsd.Router) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	for range hupChan {
+		if err := r.Reload(); err != nil {
+			log.Printf("Failed to reload routes, keeping old ones: %s\n", err)
+			continue
+		}
+		log.Println("Routes reloaded.")
+	}
+}
+
+// isLoopback returns true if addr only accepts connections from the same host.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,336 @@
+package smsd
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// DeadLetter is SMS that was rejected by gateway or ran out of attempts.
+type DeadLetter struct {
+	Msg      Msg       `json:"-"`
+	ID       string    `json:"id"`
+	Segment  int       `json:"segment"`
+	Segments int       `json:"segments"`
+	Attempts int       `json:"attempts"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DefaultDeadLetterLimit is number of dead letters that are kept by default.
+const DefaultDeadLetterLimit = 10000
+
+// DeadLetterStore keeps dead letters until they are replayed. Store has a limit,
+// oldest letters are dropped to make room for new ones.
+type DeadLetterStore interface {
+	Add(l DeadLetter) error
+	// List returns dead letters, oldest first.
+	List() []DeadLetter
+	// Take removes all dead segments of message with provided ID and returns them.
+	Take(id string) ([]DeadLetter, error)
+}
+
+// newDeadLetter makes dead letter of message with reason it failed.
+func newDeadLetter(m Msg, reason string, failedAt time.Time) DeadLetter {
+	return DeadLetter{
+		Msg:      m,
+		ID:       m.ID,
+		Segment:  m.Segment,
+		Segments: m.Segments,
+		Attempts: m.Attempts,
+		Reason:   reason,
+		FailedAt: failedAt,
+	}
+}
+
+// memDeadLetters keeps dead letters in memory, so they are lost on restart.
+type memDeadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+	limit   int
+}
+
+// NewMemDeadLetters creates DeadLetterStore that keeps up to limit letters in memory.
+// DefaultDeadLetterLimit is used if limit is not positive.
+func NewMemDeadLetters(limit int) DeadLetterStore {
+	return newMemDeadLetters(limit)
+}
+
+func newMemDeadLetters(limit int) *memDeadLetters {
+	if limit < 1 {
+		limit = DefaultDeadLetterLimit
+	}
+
+	return &memDeadLetters{
+		limit: limit,
+	}
+}
+
+// Add keeps dead letter, oldest one is dropped if store is full.
+func (s *memDeadLetters) Add(l DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters = append(s.letters, l)
+	if over := len(s.letters) - s.limit; over > 0 {
+		log.Printf("Dead letters are full, dropping %d oldest of them.\n", over)
+
+		n := copy(s.letters, s.letters[over:])
+		s.letters = s.letters[:n]
+	}
+
+	return nil
+}
+
+// List returns copy of all dead letters.
+func (s *memDeadLetters) List() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := make([]DeadLetter, len(s.letters))
+	copy(letters, s.letters)
+
+	return letters
+}
+
+// Take removes all dead segments of message with provided ID and returns them.
+func (s *memDeadLetters) Take(id string) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		taken []DeadLetter
+		left  = s.letters[:0]
+	)
+	for _, l := range s.letters {
+		if l.ID == id {
+			taken = append(taken, l)
+			continue
+		}
+		left = append(left, l)
+	}
+	s.letters = left
+
+	return taken, nil
+}
+
+// set replaces all dead letters, it is used to roll back change that was not saved.
+func (s *memDeadLetters) set(letters []DeadLetter) {
+	s.mu.Lock()
+	s.letters = letters
+	s.mu.Unlock()
+}
+
+// storedDeadLetter is a serializable form of DeadLetter.
+type storedDeadLetter struct {
+	Msg      storedMsg `json:"msg"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// deadLetterRecord is a line of FileDeadLetters log.
+// Put record holds a dead letter, done record holds ID of message which dead letters were taken.
+type deadLetterRecord struct {
+	Op     string            `json:"op"`
+	Letter *storedDeadLetter `json:"letter,omitempty"`
+	ID     string            `json:"id,omitempty"`
+}
+
+// FileDeadLetters is an append-only log of added and taken dead letters.
+// Log is replayed when store is opened, and compacted so it does not grow forever.
+type FileDeadLetters struct {
+	path string
+
+	mu       sync.Mutex
+	f        *os.File
+	appended int
+	mem      *memDeadLetters
+}
+
+// OpenDeadLetters opens or creates log file on provided path and loads up to limit dead letters from it.
+// DefaultDeadLetterLimit is used if limit is not positive.
+func OpenDeadLetters(path string, limit int) (*FileDeadLetters, error) {
+	s := &FileDeadLetters{
+		path: path,
+		mem:  newMemDeadLetters(limit),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Add appends dead letter to the log and keeps it.
+func (s *FileDeadLetters) Add(l DeadLetter) error {
+	sl := storedDeadLetter{Msg: toStoredMsg(l.Msg), Reason: l.Reason, FailedAt: l.FailedAt}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(deadLetterRecord{Op: opPut, Letter: &sl}); err != nil {
+		return err
+	}
+	s.mem.Add(l)
+
+	return s.compactIfDue()
+}
+
+// List returns dead letters, oldest first.
+func (s *FileDeadLetters) List() []DeadLetter {
+	return s.mem.List()
+}
+
+// Take removes all dead segments of message with provided ID, appends record of it to the log and returns them.
+func (s *FileDeadLetters) Take(id string) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.mem.List()
+	taken, _ := s.mem.Take(id)
+	if len(taken) == 0 {
+		return nil, nil
+	}
+
+	if err := s.append(deadLetterRecord{Op: opDone, ID: id}); err != nil {
+		// Keeping memory in line with the file.
+		s.mem.set(prev)
+		return nil, err
+	}
+
+	return taken, s.compactIfDue()
+}
+
+// Close closes log file.
+func (s *FileDeadLetters) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// load replays log file, dead letters over the limit are dropped just like they were when added.
+func (s *FileDeadLetters) load() error {
+	return replayLog(s.path, func(line []byte) error {
+		var rec deadLetterRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+
+		switch {
+		case rec.Op == opPut && rec.Letter != nil:
+			m, err := fromStoredMsg(rec.Letter.Msg)
+			if err != nil {
+				return err
+			}
+			s.mem.Add(newDeadLetter(m, rec.Letter.Reason, rec.Letter.FailedAt))
+		case rec.Op == opDone:
+			s.mem.Take(rec.ID)
+		}
+
+		return nil
+	})
+}
+
+// append writes record to the log and waits for it to reach the disk.
+func (s *FileDeadLetters) append(rec deadLetterRecord) error {
+	if err := appendLog(s.f, rec); err != nil {
+		return err
+	}
+	s.appended++
+
+	return nil
+}
+
+// compactIfDue compacts log once enough records were appended to it.
+func (s *FileDeadLetters) compactIfDue() error {
+	if s.appended < compactEvery {
+		return nil
+	}
+
+	return s.compact()
+}
+
+// compact rewrites log with kept dead letters only and replaces old log with it.
+func (s *FileDeadLetters) compact() error {
+	f, err := rewriteLog(s.path, s.f, func(enc *json.Encoder) error {
+		for _, l := range s.mem.List() {
+			sl := storedDeadLetter{Msg: toStoredMsg(l.Msg), Reason: l.Reason, FailedAt: l.FailedAt}
+			if err := enc.Encode(deadLetterRecord{Op: opPut, Letter: &sl}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.f = f
+	s.appended = 0
+
+	return nil
+}
+
+// DeadLetters declares methods to inspect and resend messages that could not be sent.
+type DeadLetters interface {
+	DeadLetters() []DeadLetter
+	ReplayDeadLetter(ctx context.Context, id string) error
+}
+
+// DeadLetterHandler exposes dead letter queue over HTTP.
+type DeadLetterHandler struct {
+	dl DeadLetters
+}
+
+// NewDeadLetterHandler constructs DeadLetterHandler for provided dead letter queue.
+func NewDeadLetterHandler(dl DeadLetters) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		dl: dl,
+	}
+}
+
+// HandleDeadLetters lists dead letters on GET to collection URL,
+// and replays all dead segments of message on POST to URL that ends with message ID.
+func (h *DeadLetterHandler) HandleDeadLetters(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, h.dl.DeadLetters())
+	case "POST":
+		// Admin is not kept waiting for room in full queue longer than API clients are.
+		ctx, cancel := context.WithTimeout(req.Context(), DefaultEnqueueTimeout)
+		defer cancel()
+
+		err := h.dl.ReplayDeadLetter(ctx, path.Base(req.URL.Path))
+		switch err {
+		case ErrNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case ErrQueueFull:
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case ErrClosed:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println("Failed to replay dead letter, error:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,212 @@
+package smsd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemDeadLettersTake(t *testing.T) {
+	s := NewMemDeadLetters(10)
+
+	s.Add(newDeadLetter(Msg{ID: "1", Segment: 1}, "rejected", time.Now()))
+	s.Add(newDeadLetter(Msg{ID: "2", Segment: 1}, "rejected", time.Now()))
+	s.Add(newDeadLetter(Msg{ID: "1", Segment: 2}, "rejected", time.Now()))
+
+	letters, _ := s.Take("1")
+	if len(letters) != 2 {
+		t.Errorf("Got %d letters, expected: 2", len(letters))
+	}
+
+	left := s.List()
+	if len(left) != 1 || left[0].ID != "2" {
+		t.Errorf("Got dead letters: %+v, expected only message 2", left)
+	}
+
+	if letters, _ := s.Take("1"); len(letters) != 0 {
+		t.Errorf("Got %d letters after they were taken, expected none", len(letters))
+	}
+}
+
+func TestMemDeadLettersDropsOldest(t *testing.T) {
+	s := NewMemDeadLetters(2)
+
+	for _, id := range []string{"1", "2", "3"} {
+		s.Add(newDeadLetter(Msg{ID: id, Segment: 1}, "rejected", time.Now()))
+	}
+
+	letters := s.List()
+	if len(letters) != 2 || letters[0].ID != "2" || letters[1].ID != "3" {
+		t.Errorf("Got dead letters: %+v, expected messages 2 and 3", letters)
+	}
+}
+
+func TestFileDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letters.json")
+
+	s, err := OpenDeadLetters(path, 2)
+	if err != nil {
+		t.Fatal("Failed to open dead letters:", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		m := Msg{ID: id, Segment: 1, Segments: 1, Recipient: "380660000000", Body: "Hola", Attempts: 5}
+		if err := s.Add(newDeadLetter(m, "rejected", time.Now().UTC())); err != nil {
+			t.Fatal("Failed to add:", err)
+		}
+	}
+	if _, err := s.Take("2"); err != nil {
+		t.Fatal("Failed to take:", err)
+	}
+
+	// Reopening, as if process restarted.
+	s, err = OpenDeadLetters(path, 2)
+	if err != nil {
+		t.Fatal("Failed to reopen dead letters:", err)
+	}
+
+	letters := s.List()
+	if len(letters) != 1 || letters[0].ID != "3" || letters[0].Reason != "rejected" || letters[0].Attempts != 5 {
+		t.Fatalf("Got dead letters: %+v, expected message 3", letters)
+	}
+	if m := letters[0].Msg; m.Body != "Hola" || m.Recipient != "380660000000" {
+		t.Errorf("Got message: %+v, expected it to be kept with body and recipient", m)
+	}
+}
+
+func TestFileDeadLettersAppendsToLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letters.json")
+
+	s, err := OpenDeadLetters(path, 2)
+	if err != nil {
+		t.Fatal("Failed to open dead letters:", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		m := Msg{ID: id, Segment: 1, Segments: 1, Recipient: "380660000000", Body: "Hola"}
+		if err := s.Add(newDeadLetter(m, "rejected", time.Now().UTC())); err != nil {
+			t.Fatal("Failed to add:", err)
+		}
+	}
+	if _, err := s.Take("3"); err != nil {
+		t.Fatal("Failed to take:", err)
+	}
+	s.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed to read log:", err)
+	}
+	if lines := bytes.Count(b, []byte("\n")); lines != 4 {
+		t.Errorf("Got %d lines in log, expected 4: one per change", lines)
+	}
+
+	s, err = OpenDeadLetters(path, 2)
+	if err != nil {
+		t.Fatal("Failed to reopen dead letters:", err)
+	}
+	defer s.Close()
+
+	if letters := s.List(); len(letters) != 1 || letters[0].ID != "2" {
+		t.Fatalf("Got dead letters: %+v, expected message 2", letters)
+	}
+	if b, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal("Failed to read log:", err)
+	}
+	if lines := bytes.Count(b, []byte("\n")); lines != 1 {
+		t.Errorf("Got %d lines in log after reopening, expected it compacted to 1", lines)
+	}
+}
+
+func TestHandleDeadLetters(t *testing.T) {
+	dl := &MockedDeadLetters{
+		letters: []DeadLetter{{ID: "1", Segment: 1, Segments: 1, Attempts: 5, Reason: "rejected"}},
+	}
+	h := NewDeadLetterHandler(dl)
+
+	rec := httptest.NewRecorder()
+	h.HandleDeadLetters(rec, httptest.NewRequest("GET", "/admin/dead-letters", nil))
+
+	var letters []DeadLetter
+	if err := json.NewDecoder(rec.Body).Decode(&letters); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if len(letters) != 1 || letters[0].Reason != "rejected" {
+		t.Errorf("Got dead letters: %+v, expected: %+v", letters, dl.letters)
+	}
+
+	cases := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{method: "POST", url: "/admin/dead-letters/1", code: http.StatusAccepted},
+		{method: "POST", url: "/admin/dead-letters/2", code: http.StatusNotFound},
+		{method: "PUT", url: "/admin/dead-letters/1", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.HandleDeadLetters(rec, httptest.NewRequest(c.method, c.url, nil))
+
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %s %s", rec.Code, c.code, c.method, c.url)
+		}
+	}
+
+	if len(dl.replayed) != 1 || dl.replayed[0] != "1" {
+		t.Errorf("Got replayed: %q, expected: %q", dl.replayed, []string{"1"})
+	}
+}
+
+func TestHandleDeadLettersQueueFull(t *testing.T) {
+	dl := &MockedDeadLetters{err: ErrQueueFull}
+	h := NewDeadLetterHandler(dl)
+
+	rec := httptest.NewRecorder()
+	h.HandleDeadLetters(rec, httptest.NewRequest("POST", "/admin/dead-letters/1", nil))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+type MockedDeadLetters struct {
+	letters  []DeadLetter
+	replayed []string
+	err      error
+}
+
+func (m *MockedDeadLetters) DeadLetters() []DeadLetter {
+	return m.letters
+}
+
+func (m *MockedDeadLetters) ReplayDeadLetter(ctx context.Context, id string) error {
+	if m.err != nil {
+		return m.err
+	}
+	for _, l := range m.letters {
+		if l.ID == id {
+			m.replayed = append(m.replayed, id)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,110 @@
+package smsd
+
+import (
+	"encoding/binary"
+	"unicode/utf16"
+)
+
+// Encoding is a data coding scheme of SMS body.
+type Encoding int
+
+const (
+	// GSM7 is GSM_03.38 default 7-bit alphabet.
+	GSM7 Encoding = iota
+	// UCS2 is 16-bit Unicode encoding. Used when body has symbols that GSM_03.38 can not represent.
+	UCS2
+)
+
+const (
+	// UnicodeSMSLen number of chars in UCS-2 encoding for single SMS without concat.
+	UnicodeSMSLen = 70
+	// UnicodeConcatSMSLen number of chars in UCS-2 encoding for single SMS with concat.
+	UnicodeConcatSMSLen = 67
+	// UnicodeWideConcatSMSLen number of chars in UCS-2 encoding for single SMS with 16-bit reference concat,
+	// its header takes one octet more.
+	UnicodeWideConcatSMSLen = 66
+)
+
+// DetectEncoding returns GSM7 if every symbol of body can be represented in GSM_03.38, UCS2 otherwise.
+func DetectEncoding(body string) Encoding {
+	for _, r := range body {
+		if !isGSMBasic(r) && !isGSMExtension(r) {
+			return UCS2
+		}
+	}
+	return GSM7
+}
+
+// String returns human readable name of encoding.
+func (e Encoding) String() string {
+	if e == UCS2 {
+		return "ucs2"
+	}
+	return "gsm7"
+}
+
+// DataCoding returns MessageBird.com datacoding value for encoding.
+func (e Encoding) DataCoding() string {
+	if e == UCS2 {
+		return "unicode"
+	}
+	return "plain"
+}
+
+// singleLen number of chars that fit in single SMS without concat.
+func (e Encoding) singleLen() int {
+	if e == UCS2 {
+		return UnicodeSMSLen
+	}
+	return PlainSMSLen
+}
+
+// concatLen number of chars that fit in single SMS with concat, wide is true for 16-bit reference header.
+func (e Encoding) concatLen(wide bool) int {
+	switch {
+	case e == UCS2 && wide:
+		return UnicodeWideConcatSMSLen
+	case e == UCS2:
+		return UnicodeConcatSMSLen
+	case wide:
+		return PlainWideConcatSMSLen
+	}
+	return PlainConcatSMSLen
+}
+
+// symbolSize returns number of chars needed to represent given symbol.
+// For UCS-2 chars are UTF-16 code units, so symbols outside of BMP take a surrogate pair.
+func (e Encoding) symbolSize(r rune) int {
+	if e == UCS2 {
+		if r >= 0x10000 {
+			return 2
+		}
+		return 1
+	}
+	return getSymbolSize(r)
+}
+
+// encode converts body to bytes that are sent over the air: unpacked GSM_03.38 septets or big-endian UTF-16.
+func (e Encoding) encode(body string) []byte {
+	if e != UCS2 {
+		return encodeGSM7(body)
+	}
+
+	units := utf16.Encode([]rune(body))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+
+	return b
+}
+
+// decodeUCS2 converts big-endian UTF-16 to text, odd trailing byte is ignored.
+func decodeUCS2(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,83 @@
+package smsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	cases := []struct {
+		body string
+		want Encoding
+	}{
+		{body: "", want: GSM7},
+		{body: "Plain text with [escaped] chars €", want: GSM7},
+		{body: "Ärger über Öl, ¿qué?", want: GSM7},
+		{body: "Привіт, світ!", want: UCS2},
+		{body: "مرحبا", want: UCS2},
+		{body: "你好", want: UCS2},
+		{body: "Almost plain 😀", want: UCS2},
+	}
+
+	for _, c := range cases {
+		actual := DetectEncoding(c.body)
+		if actual != c.want {
+			t.Errorf("Encoding of %q is: %v, expected: %v", c.body, actual, c.want)
+		}
+	}
+}
+
+func TestGetBodyCountUnicode(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected int
+	}{
+		{body: "Привіт", expected: 6},
+		{body: "[Привіт]", expected: 8}, // escaped chars are not escaped in UCS-2
+		{body: "😀😀", expected: 4},       // each symbol is a surrogate pair
+	}
+
+	for _, c := range cases {
+		actual := getBodyCount(c.body)
+		if actual != c.expected {
+			t.Errorf("Count of %q is %d, expected: %d", c.body, actual, c.expected)
+		}
+	}
+}
+
+func TestChunkBodyKeepsSurrogatePairs(t *testing.T) {
+	actual := chunkBody("ab😀c😀", 3, UCS2)
+	expected := []string{"ab", "😀c", "😀"}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got chunks: %q, expected: %q", actual, expected)
+	}
+}
+
+func TestSplitToMessagesUnicode(t *testing.T) {
+	body := strings.Repeat("ї", UnicodeConcatSMSLen*2+1)
+
+	msgs, err := splitToMsgs("notUsed", "notUsed", body, concatRef{}, MaxSeqSMSCount)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if len(msgs) != 3 {
+		t.Fatalf("Got %d messages, expected: 3", len(msgs))
+	}
+
+	for _, m := range msgs {
+		if m.Encoding != UCS2 {
+			t.Errorf("Message encoding is: %v, expected: %v", m.Encoding, UCS2)
+		}
+	}
+}
+
+func TestDecodeUCS2(t *testing.T) {
+	body := "Привіт 👋"
+
+	if decoded := decodeUCS2(UCS2.encode(body)); decoded != body {
+		t.Errorf("Got: %q, expected: %q", decoded, body)
+	}
+}
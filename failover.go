@@ -0,0 +1,193 @@
+package smsd
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNoProvider is returned when breakers of all providers are open.
+var ErrNoProvider = errors.New("no provider available")
+
+// NamedProvider is a provider with name it is reported under.
+type NamedProvider struct {
+	Name     string
+	Provider Provider
+}
+
+// failoverEntry is a provider with its circuit breaker.
+type failoverEntry struct {
+	name     string
+	provider Provider
+	breaker  *Breaker
+}
+
+// FailoverProvider sends SMS through first provider in chain that is available.
+// Every provider sits behind circuit breaker, failing provider is skipped until breaker probes it again.
+type FailoverProvider struct {
+	entries []failoverEntry
+}
+
+// NewFailoverProvider creates Provider that tries providers in provided order.
+func NewFailoverProvider(cfg BreakerConfig, providers ...NamedProvider) *FailoverProvider {
+	f := &FailoverProvider{}
+	for _, p := range providers {
+		f.entries = append(f.entries, failoverEntry{
+			name:     p.Name,
+			provider: p.Provider,
+			breaker:  NewBreaker(cfg),
+		})
+	}
+
+	return f
+}
+
+// Send submits SMS to first available provider. Temporary errors count against provider
+// and SMS goes to next one, permanent errors are caused by message and returned right away.
+// Parts with UDH are not sent to providers that split messages themselves, as they would drop the header.
+func (f *FailoverProvider) Send(m Msg) (string, error) {
+	_, id, err := f.sendOrdered(m, f.entries)
+	return id, err
+}
+
+// sendNamed submits SMS same as Send and returns name of provider that accepted it.
+func (f *FailoverProvider) sendNamed(m Msg) (string, string, error) {
+	return f.sendOrdered(m, f.entries)
+}
+
+// SendVia submits SMS same as Send, but tries named providers first, in provided order.
+// Rest of providers are tried after them in failover order, so SMS is not lost when preferred ones fail.
+func (f *FailoverProvider) SendVia(m Msg, names []string) (string, error) {
+	_, id, err := f.sendOrdered(m, f.order(names))
+	return id, err
+}
+
+// order returns entries of named providers followed by the rest. Unknown names are ignored.
+func (f *FailoverProvider) order(names []string) []failoverEntry {
+	entries := make([]failoverEntry, 0, len(f.entries))
+	picked := make(map[string]bool, len(names))
+
+	for _, name := range names {
+		for _, e := range f.entries {
+			if e.name == name && !picked[name] {
+				entries = append(entries, e)
+				picked[name] = true
+			}
+		}
+	}
+	for _, e := range f.entries {
+		if !picked[e.name] {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// Providers returns names of providers in failover order.
+func (f *FailoverProvider) Providers() []string {
+	names := make([]string, 0, len(f.entries))
+	for _, e := range f.entries {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+// sendOrdered tries entries in order, it returns name of provider that accepted SMS and ID it got.
+func (f *FailoverProvider) sendOrdered(m Msg, entries []failoverEntry) (string, string, error) {
+	hasUDH := m.Header != nil && m.Header.IsSet()
+
+	var lastErr error
+	for _, e := range entries {
+		if hasUDH && nativeConcat(e.provider) {
+			continue
+		}
+		if !e.breaker.Allow() {
+			continue
+		}
+
+		id, err := e.provider.Send(m)
+		if err == nil {
+			e.breaker.Success()
+			return e.name, id, nil
+		}
+
+		switch errorKind(err) {
+		case Permanent:
+			// Provider answered, so it is alive.
+			e.breaker.Success()
+			return "", "", err
+		case Throttled:
+			// Provider is alive but busy, trying next one.
+			e.breaker.Release()
+		default:
+			e.breaker.Failure()
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return "", "", &SendError{Kind: Temporary, Err: ErrNoProvider}
+	}
+
+	return "", "", lastErr
+}
+
+// NativeConcat is true only if all providers split long messages themselves,
+// otherwise messages are split with UDH and parts go to providers that accept it.
+func (f *FailoverProvider) NativeConcat() bool {
+	for _, e := range f.entries {
+		if !nativeConcat(e.provider) {
+			return false
+		}
+	}
+	return len(f.entries) != 0
+}
+
+// MaxSegments returns smallest number of concatenated SMS providers allow, so any of them can take message.
+func (f *FailoverProvider) MaxSegments() int {
+	max := MaxUDHSegments
+	for _, e := range f.entries {
+		if c := segmentCap(e.provider); c < max {
+			max = c
+		}
+	}
+	return max
+}
+
+// Breakers returns state of every provider breaker in failover order.
+func (f *FailoverProvider) Breakers() []BreakerStatus {
+	statuses := make([]BreakerStatus, 0, len(f.entries))
+	for _, e := range f.entries {
+		st := e.breaker.Status()
+		st.Provider = e.name
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// BreakerReporter declares method to inspect provider circuit breakers.
+type BreakerReporter interface {
+	Breakers() []BreakerStatus
+}
+
+// BreakerHandler exposes circuit breaker states over HTTP.
+type BreakerHandler struct {
+	r BreakerReporter
+}
+
+// NewBreakerHandler constructs BreakerHandler for provided reporter.
+func NewBreakerHandler(r BreakerReporter) *BreakerHandler {
+	return &BreakerHandler{
+		r: r,
+	}
+}
+
+// HandleBreakers lists provider breakers on GET.
+func (h *BreakerHandler) HandleBreakers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.r.Breakers())
+}
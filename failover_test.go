@@ -0,0 +1,150 @@
+package smsd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailoverProviderMovesToNextProvider(t *testing.T) {
+	primary := &MockedFailingProvider{err: &SendError{Kind: Temporary, Err: errors.New("outage")}}
+	secondary := &MockedFailingProvider{id: "second"}
+
+	f := NewFailoverProvider(
+		BreakerConfig{ConsecutiveFailures: 2, Window: 10, OpenTimeout: time.Hour},
+		NamedProvider{Name: "primary", Provider: primary},
+		NamedProvider{Name: "secondary", Provider: secondary},
+	)
+
+	for i := 0; i < 3; i++ {
+		id, err := f.Send(Msg{Body: "Hola"})
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if id != "second" {
+			t.Errorf("Got ID: %q, expected: %q", id, "second")
+		}
+	}
+
+	// Breaker opened after second failure, third message did not touch primary.
+	if primary.calls != 2 {
+		t.Errorf("Primary got %d calls, expected: 2", primary.calls)
+	}
+
+	statuses := f.Breakers()
+	if statuses[0].Provider != "primary" || statuses[0].State != BreakerOpen {
+		t.Errorf("Got primary breaker: %+v, expected it open", statuses[0])
+	}
+	if statuses[1].State != BreakerClosed {
+		t.Errorf("Got secondary breaker: %+v, expected it closed", statuses[1])
+	}
+
+	// Delivery reports are matched within gateway that accepted SMS.
+	if name, _, _ := f.sendNamed(Msg{Body: "Hola"}); name != "secondary" {
+		t.Errorf("Got provider: %q, expected: %q", name, "secondary")
+	}
+}
+
+func TestFailoverProviderReturnsPermanentErrors(t *testing.T) {
+	permanent := &SendError{Kind: Permanent, Err: errors.New("invalid recipient")}
+	primary := &MockedFailingProvider{err: permanent}
+	secondary := &MockedFailingProvider{id: "second"}
+
+	f := NewFailoverProvider(DefaultBreakerConfig,
+		NamedProvider{Name: "primary", Provider: primary},
+		NamedProvider{Name: "secondary", Provider: secondary},
+	)
+
+	if _, err := f.Send(Msg{}); err != permanent {
+		t.Errorf("Got error: %v, expected: %v", err, permanent)
+	}
+	if secondary.calls != 0 {
+		t.Error("Message with permanent error was sent to next provider")
+	}
+}
+
+func TestFailoverProviderSkipsNativeConcatForUDH(t *testing.T) {
+	native := &MockedFailingProvider{id: "native", native: true}
+	udh := &MockedFailingProvider{id: "udh"}
+
+	f := NewFailoverProvider(DefaultBreakerConfig,
+		NamedProvider{Name: "native", Provider: native},
+		NamedProvider{Name: "udh", Provider: udh},
+	)
+
+	if f.NativeConcat() {
+		t.Error("Chain with provider that needs UDH reports native concatenation")
+	}
+
+	if id, _ := f.Send(Msg{Header: mustHeader(NewRefUDH(7, 2, 1))}); id != "udh" {
+		t.Errorf("Got ID: %q, expected part to go to provider that accepts UDH", id)
+	}
+	if id, _ := f.Send(Msg{}); id != "native" {
+		t.Errorf("Got ID: %q, expected single SMS to go to first provider", id)
+	}
+}
+
+func TestFailoverProviderFailsIfAllBreakersAreOpen(t *testing.T) {
+	f := NewFailoverProvider(
+		BreakerConfig{ConsecutiveFailures: 1, Window: 10, OpenTimeout: time.Hour},
+		NamedProvider{Name: "only", Provider: &MockedFailingProvider{err: errors.New("outage")}},
+	)
+
+	f.Send(Msg{})
+
+	_, err := f.Send(Msg{})
+	if se, ok := err.(*SendError); !ok || se.Err != ErrNoProvider || se.Kind != Temporary {
+		t.Errorf("Got error: %v, expected temporary: %v", err, ErrNoProvider)
+	}
+}
+
+func TestHandleBreakers(t *testing.T) {
+	f := NewFailoverProvider(DefaultBreakerConfig, NamedProvider{Name: "messagebird", Provider: &MockedFailingProvider{}})
+	h := NewBreakerHandler(f)
+
+	rec := httptest.NewRecorder()
+	h.HandleBreakers(rec, httptest.NewRequest("GET", "/admin/providers", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+
+	var statuses []struct {
+		Provider string `json:"provider"`
+		State    string `json:"state"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatal("Failed to decode response:", err)
+	}
+	if len(statuses) != 1 || statuses[0].Provider != "messagebird" || statuses[0].State != "closed" {
+		t.Errorf("Got breakers: %+v", statuses)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleBreakers(rec, httptest.NewRequest("POST", "/admin/providers", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+type MockedFailingProvider struct {
+	id     string
+	err    error
+	native bool
+	calls  int
+}
+
+func (p *MockedFailingProvider) Send(m Msg) (string, error) {
+	p.calls++
+	if p.err != nil {
+		return "", p.err
+	}
+	return p.id, nil
+}
+
+func (p *MockedFailingProvider) NativeConcat() bool {
+	return p.native
+}
@@ -0,0 +1,186 @@
+package smsd
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Charset modes that MsgRequest can ask for.
+const (
+	// CharsetAuto sends body in GSM_03.38 when possible and falls back to UCS-2 otherwise.
+	CharsetAuto = "auto"
+	// CharsetGSM7 rejects bodies that can not be represented in GSM_03.38.
+	CharsetGSM7 = "gsm7"
+	// CharsetTransliterate replaces non GSM_03.38 symbols with lookalikes to keep 7-bit pricing.
+	CharsetTransliterate = "transliterate"
+
+	gsmEscape = 0x1B
+)
+
+// gsmBasicTable is GSM_03.38 basic character set indexed by 7-bit code.
+// Code 0x1B is an escape to extension table and does not represent any symbol.
+var gsmBasicTable = [128]rune{
+	'@', '£', '$', '¥', 'è', 'é', 'ù', 'ì', 'ò', 'Ç', '\n', 'Ø', 'ø', '\r', 'Å', 'å',
+	'Δ', '_', 'Φ', 'Γ', 'Λ', 'Ω', 'Π', 'Ψ', 'Σ', 'Θ', 'Ξ', unicode.ReplacementChar, 'Æ', 'æ', 'ß', 'É',
+	' ', '!', '"', '#', '¤', '%', '&', '\'', '(', ')', '*', '+', ',', '-', '.', '/',
+	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', ':', ';', '<', '=', '>', '?',
+	'¡', 'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O',
+	'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'Ä', 'Ö', 'Ñ', 'Ü', '§',
+	'¿', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o',
+	'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', 'ä', 'ö', 'ñ', 'ü', 'à',
+}
+
+// gsmExtensionTable is GSM_03.38 extension table. Each symbol is sent as escape followed by its code.
+var gsmExtensionTable = map[byte]rune{
+	0x0A: '\f',
+	0x14: '^',
+	0x28: '{',
+	0x29: '}',
+	0x2F: '\\',
+	0x3C: '[',
+	0x3D: '~',
+	0x3E: ']',
+	0x40: '|',
+	0x65: '€',
+}
+
+// gsmTransliterations maps popular symbols that GSM_03.38 lacks to their closest lookalikes.
+var gsmTransliterations = map[rune]string{
+	// Punctuation.
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '′': "'", '`': "'", '´': "'",
+	'“': `"`, '”': `"`, '„': `"`, '‟': `"`, '″': `"`, '«': `"`, '»': `"`,
+	'‐': "-", '‑': "-", '‒': "-", '–': "-", '—': "-", '―': "-",
+	'…': "...", '•': "*", ' ': " ", '\t': " ",
+	// Latin letters with diacritics that are not in basic set.
+	'á': "a", 'â': "a", 'ã': "a", 'ą': "a", 'ă': "a", 'ā': "a",
+	'Á': "A", 'Â': "A", 'Ã': "A", 'À': "A", 'Ą': "A", 'Ă': "A", 'Ā': "A",
+	'ç': "Ç", 'ć': "c", 'č': "c", 'Ć': "C", 'Č': "C",
+	'ď': "d", 'đ': "d", 'Ď': "D", 'Đ': "D",
+	'ê': "e", 'ë': "e", 'ě': "e", 'ę': "e", 'ē': "e",
+	'Ê': "E", 'Ë': "E", 'È': "E", 'Ě': "E", 'Ę': "E", 'Ē': "E",
+	'ğ': "g", 'Ğ': "G",
+	'í': "i", 'î': "i", 'ï': "i", 'ı': "i", 'ī': "i",
+	'Í': "I", 'Î': "I", 'Ï': "I", 'Ì': "I", 'İ': "I", 'Ī': "I",
+	'ł': "l", 'ľ': "l", 'ĺ': "l", 'Ł': "L", 'Ľ': "L", 'Ĺ': "L",
+	'ń': "n", 'ň': "n", 'Ń': "N", 'Ň': "N",
+	'ó': "o", 'ô': "o", 'õ': "o", 'ő': "o", 'ō': "o",
+	'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ò': "O", 'Ő': "O", 'Ō': "O",
+	'œ': "oe", 'Œ': "OE",
+	'ŕ': "r", 'ř': "r", 'Ŕ': "R", 'Ř': "R",
+	'ś': "s", 'š': "s", 'ş': "s", 'ș': "s", 'Ś': "S", 'Š': "S", 'Ş': "S", 'Ș': "S",
+	'ť': "t", 'ţ': "t", 'ț': "t", 'Ť': "T", 'Ţ': "T", 'Ț': "T",
+	'ú': "u", 'û': "u", 'ů': "u", 'ű': "u", 'ū': "u",
+	'Ú': "U", 'Û': "U", 'Ù': "U", 'Ů': "U", 'Ű': "U", 'Ū': "U",
+	'ý': "y", 'ÿ': "y", 'Ý': "Y", 'Ÿ': "Y",
+	'ź': "z", 'ż': "z", 'ž': "z", 'Ź': "Z", 'Ż': "Z", 'Ž': "Z",
+}
+
+var (
+	gsmBasicSet     = make(map[rune]byte, len(gsmBasicTable))
+	gsmExtensionSet = make(map[rune]byte, len(gsmExtensionTable))
+)
+
+func init() {
+	for code, r := range gsmBasicTable {
+		if code != gsmEscape {
+			gsmBasicSet[r] = byte(code)
+		}
+	}
+	for code, r := range gsmExtensionTable {
+		gsmExtensionSet[r] = code
+	}
+}
+
+// isGSMBasic returns true if symbol belongs to GSM_03.38 basic character set.
+func isGSMBasic(r rune) bool {
+	_, ok := gsmBasicSet[r]
+	return ok
+}
+
+// isGSMExtension returns true if symbol belongs to GSM_03.38 extension table and requires escape.
+func isGSMExtension(r rune) bool {
+	_, ok := gsmExtensionSet[r]
+	return ok
+}
+
+// UnencodableRunes returns unique symbols of body that can not be represented in GSM_03.38, in order of appearance.
+func UnencodableRunes(body string) []rune {
+	var (
+		runes []rune
+		seen  = make(map[rune]bool)
+	)
+
+	for _, r := range body {
+		if isGSMBasic(r) || isGSMExtension(r) || seen[r] {
+			continue
+		}
+		seen[r] = true
+		runes = append(runes, r)
+	}
+
+	return runes
+}
+
+// Transliterate replaces symbols that GSM_03.38 can not represent with their GSM_03.38 lookalikes.
+// Symbols that have no lookalike are left as is, so result still may require UCS-2.
+func Transliterate(body string) string {
+	var b strings.Builder
+	b.Grow(len(body))
+
+	for _, r := range body {
+		if t, ok := gsmTransliterations[r]; ok && !isGSMBasic(r) && !isGSMExtension(r) {
+			b.WriteString(t)
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// encodeGSM7 converts body to unpacked GSM_03.38 septets, one byte per symbol and escape before extension symbols.
+// Symbols that GSM_03.38 can not represent are replaced with question mark.
+func encodeGSM7(body string) []byte {
+	b := make([]byte, 0, len(body))
+
+	for _, r := range body {
+		if code, ok := gsmBasicSet[r]; ok {
+			b = append(b, code)
+			continue
+		}
+		if code, ok := gsmExtensionSet[r]; ok {
+			b = append(b, gsmEscape, code)
+			continue
+		}
+		b = append(b, gsmBasicSet['?'])
+	}
+
+	return b
+}
+
+// decodeGSM7 converts unpacked GSM_03.38 septets to text. Unknown extension codes are decoded as space,
+// as GSM_03.38 recommends.
+func decodeGSM7(b []byte) string {
+	var s strings.Builder
+	s.Grow(len(b))
+
+	for i := 0; i < len(b); i++ {
+		code := b[i] & 0x7F
+		if code != gsmEscape {
+			s.WriteRune(gsmBasicTable[code])
+			continue
+		}
+
+		i++
+		if i == len(b) {
+			break
+		}
+		if r, ok := gsmExtensionTable[b[i]&0x7F]; ok {
+			s.WriteRune(r)
+			continue
+		}
+		s.WriteRune(' ')
+	}
+
+	return s.String()
+}
@@ -0,0 +1,81 @@
+package smsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGSMTablesHaveNoDuplicates(t *testing.T) {
+	// Escape code is not a symbol, so basic set is one symbol shorter than the table.
+	if len(gsmBasicSet) != len(gsmBasicTable)-1 {
+		t.Errorf("Basic set has %d symbols, expected: %d", len(gsmBasicSet), len(gsmBasicTable)-1)
+	}
+
+	for r := range gsmExtensionSet {
+		if isGSMBasic(r) {
+			t.Errorf("Symbol %q is both in basic set and extension table", r)
+		}
+	}
+}
+
+func TestUnencodableRunes(t *testing.T) {
+	cases := []struct {
+		body string
+		want []rune
+	}{
+		{
+			body: "Plain text {with} extension €",
+			want: nil,
+		},
+		{
+			body: "Łódź’s ćma ć",
+			want: []rune{'Ł', 'ó', 'ź', '’', 'ć'},
+		},
+	}
+
+	for _, c := range cases {
+		actual := UnencodableRunes(c.body)
+		if !reflect.DeepEqual(actual, c.want) {
+			t.Errorf("Unencodable runes of %q are: %q, expected: %q", c.body, actual, c.want)
+		}
+	}
+}
+
+func TestTransliterate(t *testing.T) {
+	cases := []struct {
+		body string
+		want string
+	}{
+		{body: "It’s “quoted” – fine…", want: `It's "quoted" - fine...`},
+		{body: "Łódź, Kraków", want: "Lodz, Krakow"},
+		{body: "Ärger über Öl", want: "Ärger über Öl"}, // already GSM_03.38
+		{body: "ç", want: "Ç"},
+		{body: "Привіт", want: "Привіт"}, // no lookalikes
+	}
+
+	for _, c := range cases {
+		actual := Transliterate(c.body)
+		if actual != c.want {
+			t.Errorf("Transliterated %q to: %q, expected: %q", c.body, actual, c.want)
+		}
+	}
+}
+
+func TestTransliterationsProduceGSM(t *testing.T) {
+	for r, lookalike := range gsmTransliterations {
+		if DetectEncoding(lookalike) != GSM7 {
+			t.Errorf("Transliteration of %q is %q and it is not GSM 03.38", r, lookalike)
+		}
+		if isGSMBasic(r) || isGSMExtension(r) {
+			t.Errorf("Symbol %q is transliterated, but it is GSM 03.38 already", r)
+		}
+	}
+}
+
+func TestDecodeGSM7(t *testing.T) {
+	body := "Hola {amigo} €5 @ ÄÖ"
+
+	if decoded := decodeGSM7(encodeGSM7(body)); decoded != body {
+		t.Errorf("Got: %q, expected: %q", decoded, body)
+	}
+}
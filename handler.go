@@ -1,17 +1,26 @@
 package smsd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// MaxMsgLen maximum body that can be sent in 9 concatenated messages.
-const MaxMsgLen = PlainConcatSMSLen * 9
+const (
+	// MaxMsgLen maximum body that can be sent in MaxSeqSMSCount concatenated messages.
+	MaxMsgLen = PlainConcatSMSLen * MaxSeqSMSCount
+	// MaxUnicodeMsgLen maximum UCS-2 body that can be sent in MaxSeqSMSCount concatenated messages.
+	MaxUnicodeMsgLen = UnicodeConcatSMSLen * MaxSeqSMSCount
+)
 
 var (
 	// MSISDNRegex validates string representation of MSISDN.
@@ -20,21 +29,89 @@ var (
 	OriginatorRegex = regexp.MustCompile(`^[a-zA-Z0-9]{1,11}$`)
 )
 
+// DefaultEnqueueTimeout is how long Handler waits for room in full queue.
+// It has to be shorter than server write timeout to respond with 429 Too Many Requests.
+const DefaultEnqueueTimeout = 1 * time.Second
+
 // Handler is responsible for processing incommint HTTP message requests.
 type Handler struct {
-	messenger Messenger
+	messenger      Messenger
+	maxSegments    int
+	wideRefs       bool
+	enqueueTimeout time.Duration
+	callbacks      CallbackSubscriber
+	suppressions   SuppressionList
+	keys           KeyStore
+	quotas         QuotaLimiter
 }
 
-// Messenger declares single method that we utilize to request SMS message submission.
+// Messenger declares methods that we utilize to request SMS message submission and check its status.
 type Messenger interface {
-	SendText(originator, recipient, body string)
+	SendTextContext(ctx context.Context, originator, recipient, body string) (string, error)
+	Status(id string) (Status, error)
+}
+
+// CallbackSubscriber declares method that sets URL status changes of message are posted to.
+type CallbackSubscriber interface {
+	Subscribe(id, url string)
+}
+
+// HandlerOption configures optional Handler behaviour.
+type HandlerOption func(*Handler)
+
+// WithEnqueueTimeout sets how long Handler waits for room in full queue. Default is DefaultEnqueueTimeout.
+func WithEnqueueTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.enqueueTimeout = d
+	}
+}
+
+// WithCallbacks lets requests ask for status changes to be posted to their callback URL.
+// Requests with callback URL are rejected without it.
+func WithCallbacks(s CallbackSubscriber) HandlerOption {
+	return func(h *Handler) {
+		h.callbacks = s
+	}
+}
+
+// WithSuppressions rejects requests to numbers that are in suppression list, unless request skips the check.
+func WithSuppressions(l SuppressionList) HandlerOption {
+	return func(h *Handler) {
+		h.suppressions = l
+	}
+}
+
+// WithAPIKeys requires requests to have valid API key in Authorization header as bearer token.
+// Keys can only send messages from their own originators.
+func WithAPIKeys(ks KeyStore) HandlerOption {
+	return func(h *Handler) {
+		h.keys = ks
+	}
+}
+
+// WithQuotas limits rate and number of SMS of API keys, requests over limits are rejected.
+// It has no effect without WithAPIKeys.
+func WithQuotas(q QuotaLimiter) HandlerOption {
+	return func(h *Handler) {
+		h.quotas = q
+	}
 }
 
 // NewHandler constructs Handler instance with provided Messenger implementation.
-func NewHandler(m Messenger) *Handler {
-	return &Handler{
-		messenger: m,
+// Messages are limited to number of concatenated SMS Messenger allows if it implements SegmentLimiter.
+func NewHandler(m Messenger, opts ...HandlerOption) *Handler {
+	h := &Handler{
+		messenger:      m,
+		maxSegments:    segmentCap(m),
+		wideRefs:       wideRefs(m),
+		enqueueTimeout: DefaultEnqueueTimeout,
 	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
 }
 
 // MsgRequest HTTP request body that we accept on endpoint.
@@ -42,11 +119,39 @@ type MsgRequest struct {
 	Originator string
 	Message    string
 	Recipient  int
+	// Charset is one of CharsetAuto (default), CharsetGSM7 or CharsetTransliterate.
+	Charset string
+	// CallbackURL optional HTTP URL that status changes of message are posted to.
+	CallbackURL string `json:"callback_url"`
+	// SkipSuppression sends message to number that opted out, API key has to allow it.
+	// It is meant for transactional messages recipient asked for, such as one-time passwords, bulk ones can not skip.
+	SkipSuppression bool `json:"skip_suppression"`
+	// Priority is one of PriorityOTP, PriorityTransactional (default) or PriorityBulk.
+	Priority Priority
+}
+
+// Body returns message text that will be sent, transliterated if request asks for that.
+func (r MsgRequest) Body() string {
+	if r.Charset == CharsetTransliterate {
+		return Transliterate(r.Message)
+	}
+	return r.Message
 }
 
 // Validate checks if request values are in conflict with our specification.
-// Return only static errors here, as error text will be returned to client and we do not want XSS.
+// Message is limited to MaxSeqSMSCount concatenated SMS.
 func (r MsgRequest) Validate() error {
+	return r.ValidateFor(MaxSeqSMSCount)
+}
+
+// ValidateFor checks request values, message is limited to maxSegments concatenated SMS.
+// Return only static errors here, as error text will be returned to client and we do not want XSS.
+func (r MsgRequest) ValidateFor(maxSegments int) error {
+	return r.validate(maxSegments, false)
+}
+
+// validate checks request values, wide is true if concatenated SMS have 16-bit reference numbers.
+func (r MsgRequest) validate(maxSegments int, wide bool) error {
 	var err error
 
 	if r.Originator == "" {
@@ -61,8 +166,21 @@ func (r MsgRequest) Validate() error {
 		err = errors.New("message can not be blank")
 	}
 
-	if getBodyCount(r.Message) > MaxMsgLen {
-		err = fmt.Errorf("message is longer than %d", MaxMsgLen)
+	body := r.Body()
+
+	switch r.Charset {
+	case "", CharsetAuto:
+	case CharsetGSM7, CharsetTransliterate:
+		if DetectEncoding(body) != GSM7 {
+			err = errors.New("message has symbols that can not be represented in GSM 03.38")
+		}
+	default:
+		err = errors.New("charset is not supported")
+	}
+
+	maxLen := maxBodyLen(DetectEncoding(body), maxSegments, wide)
+	if getBodyCount(body) > maxLen {
+		err = fmt.Errorf("message is longer than %d", maxLen)
 	}
 
 	msisdn := strconv.Itoa(r.Recipient)
@@ -70,9 +188,50 @@ func (r MsgRequest) Validate() error {
 		err = errors.New("recipient MSISDN is wrong")
 	}
 
+	switch r.Priority {
+	case "", PriorityOTP, PriorityTransactional, PriorityBulk:
+	default:
+		err = errors.New("priority is not supported")
+	}
+
+	if r.SkipSuppression && r.Priority == PriorityBulk {
+		err = errors.New("bulk message can not skip suppression list")
+	}
+
+	if r.CallbackURL != "" {
+		if urlErr := checkCallbackURL(r.CallbackURL); urlErr != nil {
+			err = urlErr
+		}
+	}
+
 	return err
 }
 
+// ValidateKey checks that API key can send request, ErrOriginatorNotAllowed is returned if it can not use originator
+// and ErrSkipNotAllowed if it can not skip suppression list.
+func (r MsgRequest) ValidateKey(k APIKey) error {
+	if !k.AllowsOriginator(r.Originator) {
+		return ErrOriginatorNotAllowed
+	}
+	if r.SkipSuppression && !k.SkipSuppression {
+		return ErrSkipNotAllowed
+	}
+	return nil
+}
+
+// MsgResponse HTTP response body for accepted message.
+type MsgResponse struct {
+	ID string `json:"id"`
+}
+
+// maxBodyLen returns number of chars that fit in maxSegments SMS, wide is true for 16-bit reference numbers.
+func maxBodyLen(enc Encoding, maxSegments int, wide bool) int {
+	if maxSegments <= 1 {
+		return enc.singleLen()
+	}
+	return enc.concatLen(wide) * maxSegments
+}
+
 // HandleMsg accepts POST requests with serialized message details.
 func (h *Handler) HandleMsg(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
@@ -80,6 +239,11 @@ func (h *Handler) HandleMsg(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	key, ok := h.authenticate(w, req)
+	if !ok {
+		return
+	}
+
 	var msg MsgRequest
 	err := json.NewDecoder(req.Body).Decode(&msg)
 	if err != nil {
@@ -88,7 +252,7 @@ func (h *Handler) HandleMsg(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := msg.Validate(); err != nil {
+	if err := msg.validate(h.maxSegments, h.wideRefs); err != nil {
 		log.Println("Request values are not valid, error:", err)
 
 		// Returning error text to client.
@@ -97,11 +261,196 @@ func (h *Handler) HandleMsg(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Would be great to return ID for status check. But we will need some kind of persistence to achieve this.
-	// Omitting this for now.
-	//
+	if h.keys != nil {
+		if err := msg.ValidateKey(key); err != nil {
+			log.Printf("Request of API key %s is not allowed, error: %s\n", key.ID, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if msg.CallbackURL == "" && h.callbacks != nil {
+			msg.CallbackURL = key.CallbackURL
+		}
+	}
+
+	if msg.CallbackURL != "" && h.callbacks == nil {
+		http.Error(w, "callbacks are not enabled", http.StatusBadRequest)
+		return
+	}
+
+	if h.suppressions != nil && !msg.SkipSuppression {
+		suppressed, err := h.suppressions.Contains(strconv.Itoa(msg.Recipient))
+		if err != nil {
+			log.Println("Failed to check suppression list, error:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if suppressed {
+			http.Error(w, ErrSuppressed.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	body := msg.Body()
+	if runes := UnencodableRunes(body); len(runes) != 0 {
+		log.Printf("Message has symbols outside of GSM 03.38: %q, sending in UCS-2.\n", string(runes))
+	}
+
+	ctx := ContextWithPriority(req.Context(), msg.Priority)
+
+	if h.keys != nil {
+		// Queue is shared fairly between API keys.
+		ctx = ContextWithTenant(ctx, key.ID)
+	}
+
+	if !h.allow(w, key, body) {
+		return
+	}
+
 	// We are keeping client connections open for some time if queue is full.
-	// Will be good to pass context with timeout in order to return correct HTTP code: 429 Too Many Requests.
-	// But need to make sure that we send all or nothing in case of concatenated messages.
-	h.messenger.SendText(msg.Originator, strconv.Itoa(msg.Recipient), msg.Message)
+	// Concatenated messages are queued all or nothing, so rejected request does not leave parts behind.
+	ctx, cancel := context.WithTimeout(ctx, h.enqueueTimeout)
+	defer cancel()
+
+	id, err := h.messenger.SendTextContext(ctx, msg.Originator, strconv.Itoa(msg.Recipient), body)
+	if err != nil {
+		log.Println("Failed to submit message, error:", err)
+		h.refund(key, body)
+
+		switch err {
+		case ErrTooManySegments:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case ErrQueueFull:
+			w.Header().Set("Retry-After", strconv.Itoa(h.retryAfter()))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case ErrClosed:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if msg.CallbackURL != "" {
+		h.callbacks.Subscribe(id, msg.CallbackURL)
+	}
+
+	writeJSON(w, http.StatusAccepted, MsgResponse{ID: id})
+}
+
+// retryAfter estimates in seconds when there will be room in queue.
+func (h *Handler) retryAfter() int {
+	e, ok := h.messenger.(QueueEstimator)
+	if !ok {
+		return 1
+	}
+
+	return ceilSeconds(e.QueueDelay())
+}
+
+// ceilSeconds rounds d up to whole seconds, it is at least one second.
+func ceilSeconds(d time.Duration) int {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		return 1
+	}
+
+	return secs
+}
+
+// allow counts SMS of body in quota of API key, it responds with 429 Too Many Requests and returns false
+// if key is over its limits. Any request is allowed if Handler has no quotas.
+func (h *Handler) allow(w http.ResponseWriter, k APIKey, body string) bool {
+	if h.keys == nil || h.quotas == nil {
+		return true
+	}
+
+	wait, err := h.quotas.Allow(k, segmentCount(body, h.wideRefs))
+	if err == ErrRateLimited || err == ErrQuotaExceeded {
+		log.Printf("Request of API key %s is over limit, error: %s\n", k.ID, err)
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return false
+	}
+	if err != nil {
+		log.Println("Failed to check quota, error:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// refund returns SMS of body that was not queued to quota of API key.
+func (h *Handler) refund(k APIKey, body string) {
+	if h.keys != nil && h.quotas != nil {
+		h.quotas.Refund(k, segmentCount(body, h.wideRefs))
+	}
+}
+
+// HandleStatus accepts GET requests for message status, last element of URL path is message ID.
+func (h *Handler) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, ok := h.authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	status, err := h.messenger.Status(path.Base(req.URL.Path))
+	if err == nil && h.keys != nil && status.Tenant != key.ID {
+		// Messages of other keys are not revealed, not even that they exist.
+		err = ErrNotFound
+	}
+	if err == ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to get message status, error:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// authenticate finds API key of request, it responds with 401 Unauthorized and returns false if there is none.
+// Any request is authenticated if Handler has no key store.
+func (h *Handler) authenticate(w http.ResponseWriter, req *http.Request) (APIKey, bool) {
+	if h.keys == nil {
+		return APIKey{}, true
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	k, err := Authenticate(h.keys, token)
+	if err == ErrUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="smsd"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return APIKey{}, false
+	}
+	if err != nil {
+		log.Println("Failed to authenticate request, error:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return APIKey{}, false
+	}
+
+	return k, true
+}
+
+// writeJSON serializes v to response body with provided status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to write response, error:", err)
+	}
 }
@@ -1,8 +1,15 @@
 package smsd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMsgRequestValidate(t *testing.T) {
@@ -84,6 +91,24 @@ func TestMsgRequestValidate(t *testing.T) {
 			},
 			valid: false,
 		},
+		{
+			req: MsgRequest{
+				Originator:  "Valid",
+				Recipient:   380660000000,
+				Message:     "Valid message.",
+				CallbackURL: "https://example.com/sms?team=billing",
+			},
+			valid: true,
+		},
+		{
+			req: MsgRequest{
+				Originator:  "Valid",
+				Recipient:   380660000000,
+				Message:     "Valid message.",
+				CallbackURL: "ftp://example.com/sms",
+			},
+			valid: false,
+		},
 	}
 
 	for i, c := range cases {
@@ -126,3 +151,488 @@ func TestMSISDNRegex(t *testing.T) {
 		}
 	}
 }
+
+func TestMsgRequestValidateUnicodeLength(t *testing.T) {
+	req := MsgRequest{
+		Originator: "Valid",
+		Recipient:  380660000000,
+		Message:    strings.Repeat("ш", MaxUnicodeMsgLen),
+	}
+	if err := req.Validate(); err != nil {
+		t.Errorf("Validation failed, expected it to pass. Error: %q", err)
+	}
+
+	req.Message += "ш"
+	if err := req.Validate(); err == nil {
+		t.Error("Validation passed for UCS-2 body over 9 SMS, expected it to fail.")
+	}
+}
+
+func TestMsgRequestValidateCharset(t *testing.T) {
+	cases := []struct {
+		req   MsgRequest
+		valid bool
+	}{
+		{
+			req:   MsgRequest{Originator: "Valid", Recipient: 380660000000, Message: "Zażółć", Charset: CharsetAuto},
+			valid: true, // falls back to UCS-2
+		},
+		{
+			req:   MsgRequest{Originator: "Valid", Recipient: 380660000000, Message: "Zażółć", Charset: CharsetGSM7},
+			valid: false,
+		},
+		{
+			req:   MsgRequest{Originator: "Valid", Recipient: 380660000000, Message: "Zażółć", Charset: CharsetTransliterate},
+			valid: true,
+		},
+		{
+			req:   MsgRequest{Originator: "Valid", Recipient: 380660000000, Message: "Привіт", Charset: CharsetTransliterate},
+			valid: false, // nothing to transliterate Cyrillic to
+		},
+		{
+			req:   MsgRequest{Originator: "Valid", Recipient: 380660000000, Message: "Hello", Charset: "ebcdic"},
+			valid: false,
+		},
+	}
+
+	for i, c := range cases {
+		err := c.req.Validate()
+
+		if c.valid && err != nil {
+			t.Errorf("Validation failed, expected it to pass. Case: %d, error: %q", i, err)
+		}
+
+		if !c.valid && err == nil {
+			t.Error("Validation passed, expected it to fail. Case: ", i)
+		}
+	}
+}
+
+func TestMsgRequestValidatePriority(t *testing.T) {
+	for p, valid := range map[Priority]bool{
+		"":                    true,
+		PriorityOTP:           true,
+		PriorityTransactional: true,
+		PriorityBulk:          true,
+		"urgent":              false,
+	} {
+		req := MsgRequest{Originator: "Valid", Recipient: 380660000000, Message: "Hello", Priority: p}
+		if err := req.Validate(); (err == nil) != valid {
+			t.Errorf("Got error: %v for priority: %q", err, p)
+		}
+	}
+}
+
+func TestMsgRequestValidateFor(t *testing.T) {
+	req := MsgRequest{
+		Originator: "Valid",
+		Recipient:  380660000000,
+		Message:    strings.Repeat("m", PlainConcatSMSLen*16), // 16 SMS
+	}
+
+	if err := req.ValidateFor(16); err != nil {
+		t.Errorf("Validation failed, expected it to pass. Error: %q", err)
+	}
+
+	if err := req.ValidateFor(MaxSeqSMSCount); err == nil {
+		t.Error("Validation passed, expected it to fail.")
+	}
+
+	req.Message = strings.Repeat("m", PlainSMSLen)
+	if err := req.ValidateFor(1); err != nil {
+		t.Errorf("Validation of single SMS failed, expected it to pass. Error: %q", err)
+	}
+}
+
+func TestNewHandlerUsesMessengerSegmentCap(t *testing.T) {
+	h := NewHandler(&MockedLimitedMessenger{maxSegments: 16})
+	if h.maxSegments != 16 {
+		t.Errorf("Handler max segments is: %d, expected: %d", h.maxSegments, 16)
+	}
+}
+
+type MockedLimitedMessenger struct {
+	MockedMessenger
+	maxSegments int
+}
+
+func (m *MockedLimitedMessenger) MaxSegments() int {
+	return m.maxSegments
+}
+
+func TestHandleMsgMapsMessengerErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{err: nil, code: http.StatusAccepted},
+		{err: ErrTooManySegments, code: http.StatusBadRequest},
+		{err: ErrClosed, code: http.StatusServiceUnavailable},
+		{err: errors.New("queue is broken"), code: http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		h := NewHandler(&MockedMessenger{err: c.err})
+
+		body := `{"originator": "Valid", "recipient": 380660000000, "message": "Valid message."}`
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+
+		h.HandleMsg(rec, req)
+
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for error: %v", rec.Code, c.code, c.err)
+		}
+	}
+}
+
+func TestHandleMsgReturnsID(t *testing.T) {
+	h := NewHandler(&MockedMessenger{id: "42"})
+
+	body := `{"originator": "Valid", "recipient": 380660000000, "message": "Valid message."}`
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	h.HandleMsg(rec, req)
+
+	var resp MsgResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+
+	if resp.ID != "42" {
+		t.Errorf("Got ID: %q, expected: %q", resp.ID, "42")
+	}
+}
+
+func TestHandleMsgSubscribesToCallbacks(t *testing.T) {
+	body := `{"originator": "Valid", "recipient": 380660000000, "message": "Valid message.", "callback_url": "https://example.com/sms"}`
+
+	rec := httptest.NewRecorder()
+	NewHandler(&MockedMessenger{id: "42"}).HandleMsg(rec, httptest.NewRequest("POST", "/messages", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status: %d, expected: %d without callbacks", rec.Code, http.StatusBadRequest)
+	}
+
+	subscriber := &MockedSubscriber{}
+	rec = httptest.NewRecorder()
+	NewHandler(&MockedMessenger{id: "42"}, WithCallbacks(subscriber)).HandleMsg(rec, httptest.NewRequest("POST", "/messages", strings.NewReader(body)))
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusAccepted)
+	}
+	if subscriber.urls["42"] != "https://example.com/sms" {
+		t.Errorf("Got subscriptions: %v", subscriber.urls)
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	m := &MockedMessenger{
+		statuses: map[string]Status{
+			"42": {ID: "42", State: StateSubmitted, Segments: []SegmentStatus{{Segment: 1, State: StateSubmitted, ProviderID: "mb1"}}},
+		},
+	}
+	h := NewHandler(m)
+
+	cases := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{method: "GET", url: "/messages/42", code: http.StatusOK},
+		{method: "GET", url: "/messages/43", code: http.StatusNotFound},
+		{method: "DELETE", url: "/messages/42", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.HandleStatus(rec, httptest.NewRequest(c.method, c.url, nil))
+
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %s %s", rec.Code, c.code, c.method, c.url)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.HandleStatus(rec, httptest.NewRequest("GET", "/messages/42", nil))
+
+	var status Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+
+	if !reflect.DeepEqual(status, m.statuses["42"]) {
+		t.Errorf("Got status: %+v, expected: %+v", status, m.statuses["42"])
+	}
+}
+
+func TestHandleMsgReturnsTooManyRequestsIfQueueIsFull(t *testing.T) {
+	m := &MockedQueuedMessenger{
+		MockedMessenger: MockedMessenger{err: ErrQueueFull},
+		delay:           2500 * time.Millisecond,
+	}
+	h := NewHandler(m)
+
+	body := `{"originator": "Valid", "recipient": 380660000000, "message": "Valid message."}`
+	rec := httptest.NewRecorder()
+	h.HandleMsg(rec, httptest.NewRequest("POST", "/messages", strings.NewReader(body)))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	if ra := rec.Header().Get("Retry-After"); ra != "3" {
+		t.Errorf("Got Retry-After: %q, expected: %q", ra, "3")
+	}
+}
+
+func TestHandleMsgWaitsForQueueWithTimeout(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 0, time.Hour) // queue is always full
+	h := NewHandler(client, WithEnqueueTimeout(10*time.Millisecond))
+
+	body := `{"originator": "Valid", "recipient": 380660000000, "message": "Valid message."}`
+	rec := httptest.NewRecorder()
+	h.HandleMsg(rec, httptest.NewRequest("POST", "/messages", strings.NewReader(body)))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+type MockedQueuedMessenger struct {
+	MockedMessenger
+	delay time.Duration
+}
+
+func (m *MockedQueuedMessenger) QueueDelay() time.Duration {
+	return m.delay
+}
+
+type MockedMessenger struct {
+	id       string
+	err      error
+	statuses map[string]Status
+}
+
+func (m *MockedMessenger) SendTextContext(ctx context.Context, originator, recipient, body string) (string, error) {
+	return m.id, m.err
+}
+
+func (m *MockedMessenger) Status(id string) (Status, error) {
+	s, ok := m.statuses[id]
+	if !ok {
+		return Status{}, ErrNotFound
+	}
+	return s, nil
+}
+
+type MockedSubscriber struct {
+	urls map[string]string
+}
+
+func (s *MockedSubscriber) Subscribe(id, url string) {
+	if s.urls == nil {
+		s.urls = make(map[string]string)
+	}
+	s.urls[id] = url
+}
+
+func TestHandleMsgRejectsSuppressedRecipients(t *testing.T) {
+	list := NewMemSuppressionList()
+	list.Add(Suppression{MSISDN: "380660000000", Reason: "replied STOP"})
+
+	h := NewHandler(&MockedMessenger{id: "42"}, WithSuppressions(list))
+
+	cases := []struct {
+		body string
+		code int
+	}{
+		{body: `{"originator": "Valid", "recipient": 380660000000, "message": "Sale!"}`, code: http.StatusUnprocessableEntity},
+		{body: `{"originator": "Valid", "recipient": 380660000000, "message": "Code 1234", "skip_suppression": true}`, code: http.StatusAccepted},
+		{body: `{"originator": "Valid", "recipient": 380661111111, "message": "Sale!"}`, code: http.StatusAccepted},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.HandleMsg(rec, httptest.NewRequest("POST", "/messages", strings.NewReader(c.body)))
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %s", rec.Code, c.code, c.body)
+		}
+	}
+}
+
+func TestHandleMsgLetsOnlyAllowedKeysSkipSuppression(t *testing.T) {
+	list := NewMemSuppressionList()
+	list.Add(Suppression{MSISDN: "380660000000", Reason: "replied STOP"})
+
+	ks := NewMemKeyStore()
+	plain, plainToken := NewAPIKey("marketing", []string{"Bank"}, "")
+	ks.Add(plain)
+	otp, otpToken := NewAPIKey("otp", []string{"Bank"}, "")
+	otp.SkipSuppression = true
+	ks.Add(otp)
+
+	h := NewHandler(&MockedMessenger{id: "42"}, WithAPIKeys(ks), WithSuppressions(list))
+
+	skip := `{"originator": "Bank", "recipient": 380660000000, "message": "Code 1234", "skip_suppression": true}`
+	cases := []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{token: plainToken, body: skip, code: http.StatusForbidden},
+		{token: plainToken, body: `{"originator": "Bank", "recipient": 380660000000, "message": "Sale!"}`, code: http.StatusUnprocessableEntity},
+		{token: otpToken, body: skip, code: http.StatusAccepted},
+		{token: otpToken, body: `{"originator": "Bank", "recipient": 380660000000, "message": "Sale!", "skip_suppression": true, "priority": "bulk"}`, code: http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(c.body))
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		rec := httptest.NewRecorder()
+		h.HandleMsg(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %s", rec.Code, c.code, c.body)
+		}
+	}
+}
+
+func TestHandleMsgAuthenticatesAPIKeys(t *testing.T) {
+	ks := NewMemKeyStore()
+	billing, billingToken := NewAPIKey("billing", []string{"Bank"}, "https://billing.example.com/sms")
+	ks.Add(billing)
+
+	subscriber := &MockedSubscriber{}
+	h := NewHandler(&MockedMessenger{id: "42"}, WithAPIKeys(ks), WithCallbacks(subscriber))
+
+	cases := []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{token: "", body: `{"originator": "Bank", "recipient": 380660000000, "message": "Hi"}`, code: http.StatusUnauthorized},
+		{token: billing.ID + ".nope", body: `{"originator": "Bank", "recipient": 380660000000, "message": "Hi"}`, code: http.StatusUnauthorized},
+		{token: billingToken, body: `{"originator": "Shop", "recipient": 380660000000, "message": "Hi"}`, code: http.StatusForbidden},
+		{token: billingToken, body: `{"originator": "bank", "recipient": 380660000000, "message": "Hi"}`, code: http.StatusAccepted},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(c.body))
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		rec := httptest.NewRecorder()
+		h.HandleMsg(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %q %s", rec.Code, c.code, c.token, c.body)
+		}
+	}
+
+	// Key callback URL is used when request has none.
+	if subscriber.urls["42"] != billing.CallbackURL {
+		t.Errorf("Got subscriptions: %v", subscriber.urls)
+	}
+
+	rec := httptest.NewRecorder()
+	h.HandleStatus(rec, httptest.NewRequest("GET", "/messages/42", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHandleStatusHidesMessagesOfOtherKeys(t *testing.T) {
+	ks := NewMemKeyStore()
+	billing, billingToken := NewAPIKey("billing", []string{"Bank"}, "")
+	shop, shopToken := NewAPIKey("shop", []string{"Shop"}, "")
+	ks.Add(billing)
+	ks.Add(shop)
+
+	m := &MockedMessenger{
+		statuses: map[string]Status{
+			"42": {ID: "42", Tenant: billing.ID, State: StateSubmitted},
+		},
+	}
+	h := NewHandler(m, WithAPIKeys(ks))
+
+	cases := []struct {
+		token string
+		code  int
+	}{
+		{token: billingToken, code: http.StatusOK},
+		{token: shopToken, code: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/messages/42", nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		rec := httptest.NewRecorder()
+		h.HandleStatus(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %q", rec.Code, c.code, c.token)
+		}
+	}
+}
+
+type MockedQuotas struct {
+	wait     time.Duration
+	err      error
+	allowed  int
+	refunded int
+}
+
+func (q *MockedQuotas) Allow(k APIKey, segments int) (time.Duration, error) {
+	if q.err != nil {
+		return q.wait, q.err
+	}
+	q.allowed += segments
+	return 0, nil
+}
+
+func (q *MockedQuotas) Refund(k APIKey, segments int) {
+	q.refunded += segments
+}
+
+func TestHandleMsgLimitsAPIKeys(t *testing.T) {
+	ks := NewMemKeyStore()
+	k, token := NewAPIKey("billing", []string{"Bank"}, "")
+	ks.Add(k)
+
+	body := `{"originator": "Bank", "recipient": 380660000000, "message": "` + strings.Repeat("m", PlainSMSLen+1) + `"}`
+
+	cases := []struct {
+		quotas     *MockedQuotas
+		messenger  *MockedMessenger
+		code       int
+		retryAfter string
+		allowed    int
+		refunded   int
+	}{
+		{quotas: &MockedQuotas{}, messenger: &MockedMessenger{id: "42"}, code: http.StatusAccepted, allowed: 2},
+		{quotas: &MockedQuotas{}, messenger: &MockedMessenger{err: ErrQueueFull}, code: http.StatusTooManyRequests, retryAfter: "1", allowed: 2, refunded: 2},
+		{quotas: &MockedQuotas{err: ErrRateLimited, wait: 1500 * time.Millisecond}, messenger: &MockedMessenger{id: "42"}, code: http.StatusTooManyRequests, retryAfter: "2"},
+		{quotas: &MockedQuotas{err: ErrQuotaExceeded, wait: time.Hour}, messenger: &MockedMessenger{id: "42"}, code: http.StatusTooManyRequests, retryAfter: "3600"},
+	}
+
+	for _, c := range cases {
+		h := NewHandler(c.messenger, WithAPIKeys(ks), WithQuotas(c.quotas))
+
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		h.HandleMsg(rec, req)
+
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d", rec.Code, c.code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != c.retryAfter {
+			t.Errorf("Got Retry-After: %q, expected: %q", got, c.retryAfter)
+		}
+		if c.quotas.allowed != c.allowed || c.quotas.refunded != c.refunded {
+			t.Errorf("Got %d SMS allowed and %d refunded, expected: %d and %d",
+				c.quotas.allowed, c.quotas.refunded, c.allowed, c.refunded)
+		}
+	}
+}
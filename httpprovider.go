@@ -0,0 +1,254 @@
+package smsd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// HTTPProviderConfig describes gateway with JSON API that is not supported natively.
+type HTTPProviderConfig struct {
+	// URL that accepts SMS with POST request.
+	URL string
+	// Headers added to every request, usually for authorization.
+	Headers map[string]string
+	// IDField name of response JSON field that holds message ID. Default is "id".
+	IDField string
+	// MaxSegments number of concatenated SMS gateway allows. Default is MaxSeqSMSCount.
+	MaxSegments int
+	// NativeConcat tells that gateway splits long messages itself and does not accept UDH.
+	NativeConcat bool
+	// ReportSecret verifies X-Signature of delivery reports and incoming messages, all of them are rejected if it is empty.
+	ReportSecret string
+}
+
+// HTTPProvider sends SMS as JSON to configured URL.
+// Response with 429 code is considered throttling, other 4xx codes are permanent errors and 5xx are temporary.
+type HTTPProvider struct {
+	cfg        HTTPProviderConfig
+	HTTPClient *http.Client
+}
+
+// NewHTTPProvider creates Provider for gateway with JSON API.
+func NewHTTPProvider(cfg HTTPProviderConfig) *HTTPProvider {
+	if cfg.IDField == "" {
+		cfg.IDField = "id"
+	}
+	if cfg.MaxSegments == 0 {
+		cfg.MaxSegments = MaxSeqSMSCount
+	}
+
+	return &HTTPProvider{
+		cfg:        cfg,
+		HTTPClient: &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+// httpProviderRequest is a body of request to generic gateway.
+type httpProviderRequest struct {
+	Originator string `json:"originator"`
+	Recipient  string `json:"recipient"`
+	Body       string `json:"body"`
+	Encoding   string `json:"encoding"`
+	UDH        string `json:"udh,omitempty"`
+	Reference  string `json:"reference"`
+	Segment    int    `json:"segment"`
+	Segments   int    `json:"segments"`
+}
+
+// Send posts SMS to gateway, UDH is sent as hex string.
+func (p *HTTPProvider) Send(m Msg) (string, error) {
+	hr := httpProviderRequest{
+		Originator: m.Originator,
+		Recipient:  m.Recipient,
+		Body:       m.Body,
+		Encoding:   m.Encoding.DataCoding(),
+		Reference:  m.ID,
+		Segment:    m.Segment,
+		Segments:   m.Segments,
+	}
+	if m.Header != nil && m.Header.IsSet() {
+		hr.UDH = m.Header.ToHexStr()
+	}
+
+	b, err := json.Marshal(hr)
+	if err != nil {
+		return "", &SendError{Kind: Permanent, Err: err}
+	}
+
+	req, err := http.NewRequest("POST", p.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return "", &SendError{Kind: Permanent, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", &SendError{Kind: Temporary, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	// Message is accepted at this point, it is not resent or failed if response can not be read.
+	// Delivery reports can not be matched to it without ID though.
+	var fields map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&fields); err != nil {
+		log.Printf("Failed to read gateway response for accepted SMS to %s: %s\n", m.Recipient, err)
+		return "", nil
+	}
+
+	switch id := fields[p.cfg.IDField].(type) {
+	case string:
+		return id, nil
+	case float64:
+		return fmt.Sprintf("%.0f", id), nil
+	default:
+		log.Printf("Gateway response for accepted SMS to %s has no message ID\n", m.Recipient)
+		return "", nil
+	}
+}
+
+// NativeConcat tells if gateway splits long messages itself.
+func (p *HTTPProvider) NativeConcat() bool {
+	return p.cfg.NativeConcat
+}
+
+// MaxSegments returns number of concatenated SMS gateway allows.
+func (p *HTTPProvider) MaxSegments() int {
+	return p.cfg.MaxSegments
+}
+
+// httpProviderReport is a body of delivery report of generic gateway.
+type httpProviderReport struct {
+	ID     string `json:"id"`
+	State  State  `json:"state"`
+	Reason string `json:"reason"`
+}
+
+// ParseReport verifies X-Signature of delivery report.
+// Body is JSON object or array of objects with id, state and optional reason.
+func (p *HTTPProvider) ParseReport(req *http.Request) ([]Report, error) {
+	body, err := p.verifyRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var hrs []httpProviderReport
+	if b := bytes.TrimSpace(body); len(b) != 0 && b[0] == '{' {
+		hrs = make([]httpProviderReport, 1)
+		err = json.Unmarshal(b, &hrs[0])
+	} else {
+		err = json.Unmarshal(b, &hrs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]Report, 0, len(hrs))
+	for _, hr := range hrs {
+		if hr.ID == "" {
+			return nil, errReportFormat
+		}
+
+		switch hr.State {
+		case StateSubmitted, StateDelivered, StateFailed:
+		default:
+			return nil, fmt.Errorf("unknown state %q of %s", hr.State, hr.ID)
+		}
+
+		reports = append(reports, Report{ProviderID: hr.ID, State: hr.State, Reason: hr.Reason})
+	}
+
+	return reports, nil
+}
+
+// httpProviderInbound is a body of incoming message of generic gateway.
+type httpProviderInbound struct {
+	ID         string `json:"id"`
+	Originator string `json:"originator"`
+	Recipient  string `json:"recipient"`
+	Body       string `json:"body"`
+	// UDH hex encoded User Data Header of concatenated SMS part, starting with its length.
+	UDH string `json:"udh"`
+}
+
+// ParseInbound verifies X-Signature of incoming messages.
+// Body is JSON object or array of objects with originator, recipient, body and optional id and udh.
+func (p *HTTPProvider) ParseInbound(req *http.Request) ([]InboundPart, error) {
+	body, err := p.verifyRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var his []httpProviderInbound
+	if b := bytes.TrimSpace(body); len(b) != 0 && b[0] == '{' {
+		his = make([]httpProviderInbound, 1)
+		err = json.Unmarshal(b, &his[0])
+	} else {
+		err = json.Unmarshal(b, &his)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]InboundPart, 0, len(his))
+	for _, hi := range his {
+		if hi.Originator == "" || hi.Recipient == "" {
+			return nil, errInboundFormat
+		}
+
+		part := InboundPart{
+			ProviderID: hi.ID,
+			Originator: strings.TrimPrefix(hi.Originator, "+"),
+			Recipient:  strings.TrimPrefix(hi.Recipient, "+"),
+			Body:       hi.Body,
+		}
+		if hi.UDH != "" {
+			udh, err := hex.DecodeString(hi.UDH)
+			if err != nil {
+				return nil, err
+			}
+			if part.Header, err = ParseHeader(udh); err != nil {
+				return nil, err
+			}
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts, nil
+}
+
+// verifyRequest checks X-Signature of webhook request and returns its body.
+// Signature is hex encoded HMAC-SHA256 of body.
+func (p *HTTPProvider) verifyRequest(req *http.Request) ([]byte, error) {
+	body, err := readReportBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := hex.DecodeString(req.Header.Get("X-Signature"))
+	if err != nil || p.cfg.ReportSecret == "" {
+		return nil, ErrSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(p.cfg.ReportSecret))
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrSignature
+	}
+
+	return body, nil
+}
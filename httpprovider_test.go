@@ -0,0 +1,158 @@
+package smsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPProviderSend(t *testing.T) {
+	var got httpProviderRequest
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("Got authorization: %q", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error("Failed to decode request:", err)
+		}
+
+		w.Write([]byte(`{"message": {"state": "accepted"}, "msg_id": 42}`))
+	}))
+	defer srv.Close()
+
+	p := NewHTTPProvider(HTTPProviderConfig{
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		IDField: "msg_id",
+	})
+
+	m := Msg{
+		ID:         "abc",
+		Segment:    1,
+		Segments:   2,
+		Header:     mustHeader(NewRefUDH(7, 2, 1)),
+		Body:       "Hola",
+		Originator: "Bank",
+		Recipient:  "380660000000",
+	}
+
+	id, err := p.Send(m)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if id != "42" {
+		t.Errorf("Got ID: %q, expected: %q", id, "42")
+	}
+
+	expected := httpProviderRequest{
+		Originator: "Bank",
+		Recipient:  "380660000000",
+		Body:       "Hola",
+		Encoding:   "plain",
+		UDH:        "050003070201",
+		Reference:  "abc",
+		Segment:    1,
+		Segments:   2,
+	}
+	if got != expected {
+		t.Errorf("Got request: %+v, expected: %+v", got, expected)
+	}
+}
+
+func TestHTTPProviderAcceptsResponseWithoutID(t *testing.T) {
+	for _, body := range []string{`{"status": "ok"}`, `not JSON`} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+
+		p := NewHTTPProvider(HTTPProviderConfig{URL: srv.URL})
+
+		// Gateway accepted message, sending it again would deliver it twice.
+		if id, err := p.Send(Msg{Body: "Hola"}); err != nil || id != "" {
+			t.Errorf("Got ID: %q, error: %v, expected empty ID without error for response: %s", id, err, body)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestHTTPProviderParseReport(t *testing.T) {
+	p := NewHTTPProvider(HTTPProviderConfig{URL: "http://gateway", ReportSecret: "secret"})
+
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	cases := []struct {
+		body    string
+		sig     string
+		reports int
+		err     bool
+	}{
+		{body: `{"id": "g1", "state": "delivered"}`, reports: 1},
+		{body: `[{"id": "g1", "state": "delivered"}, {"id": "g2", "state": "failed", "reason": "blocked"}]`, reports: 2},
+		{body: `{"id": "g1", "state": "lost"}`, err: true},
+		{body: `{"state": "delivered"}`, err: true},
+		{body: `{"id": "g1", "state": "delivered"}`, sig: "00", err: true},
+	}
+
+	for _, c := range cases {
+		sig := c.sig
+		if sig == "" {
+			sig = sign(c.body)
+		}
+
+		req := httptest.NewRequest("POST", "/reports/http", strings.NewReader(c.body))
+		req.Header.Set("X-Signature", sig)
+
+		reports, err := p.ParseReport(req)
+		if c.err {
+			if err == nil {
+				t.Errorf("Got no error for: %s", c.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error: %v for: %s", err, c.body)
+			continue
+		}
+		if len(reports) != c.reports {
+			t.Errorf("Got %d reports, expected: %d", len(reports), c.reports)
+		}
+	}
+}
+
+func TestHTTPProviderParseInbound(t *testing.T) {
+	p := NewHTTPProvider(HTTPProviderConfig{URL: "http://gateway", ReportSecret: "secret"})
+
+	body := `[{"originator": "+380501234567", "recipient": "+4915112345678", "body": "Hel", "udh": "050003A70201"},
+		{"originator": "380501234567", "recipient": "4915112345678", "body": "lo", "udh": "050003A70202"}]`
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+
+	req := httptest.NewRequest("POST", "/inbound/http", strings.NewReader(body))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	parts, err := p.ParseInbound(req)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Got parts: %+v", parts)
+	}
+	if parts[0].Originator != "380501234567" || parts[0].Recipient != "4915112345678" {
+		t.Errorf("Got part: %+v, expected numbers without leading plus", parts[0])
+	}
+	if h := mustHeader(NewRefUDH(0xA7, 2, 2)); parts[1].Body != "lo" || parts[1].Header != h {
+		t.Errorf("Got part: %+v, expected header: %v", parts[1], h)
+	}
+}
@@ -0,0 +1,380 @@
+package smsd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// partTTL is how long parts of concatenated inbound message wait for the rest of them.
+	partTTL = time.Hour
+	// inboxSize number of latest complete inbound messages that are kept.
+	inboxSize = 1000
+)
+
+// errInboundFormat is returned for incoming message that can not be parsed.
+var errInboundFormat = errors.New("inbound message is malformed")
+
+// InboundPart is mobile originated SMS that gateway passed to webhook.
+// Header is set for parts of concatenated message, gateways that join parts themselves pass it whole.
+type InboundPart struct {
+	ProviderID string
+	Originator string
+	Recipient  string
+	Body       string
+	Header     Header
+}
+
+// InboundMessage is complete mobile originated message.
+type InboundMessage struct {
+	ID         string    `json:"id"`
+	Originator string    `json:"originator"`
+	Recipient  string    `json:"recipient"`
+	Body       string    `json:"body"`
+	Parts      int       `json:"parts"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// ForwardRule sends inbound messages to URL. Empty Originator and Keyword match any message.
+type ForwardRule struct {
+	// Originator prefix of sender number.
+	Originator string
+	// Keyword first word of message, case is ignored.
+	Keyword string
+	URL     string
+}
+
+// Matches returns true if message should be forwarded by rule.
+func (r ForwardRule) Matches(m InboundMessage) bool {
+	if !strings.HasPrefix(m.Originator, r.Originator) {
+		return false
+	}
+	if r.Keyword == "" {
+		return true
+	}
+
+	words := strings.Fields(m.Body)
+	return len(words) != 0 && strings.EqualFold(words[0], r.Keyword)
+}
+
+// Inbox joins parts of inbound messages, keeps latest complete ones and forwards them by rules.
+// Forwards are signed the same way as status callbacks. Failed ones are retried with backoff,
+// forwards that are still pending on shutdown are lost.
+type Inbox struct {
+	rules  []ForwardRule
+	secret []byte
+	retry  RetryPolicy
+	// HTTPClient posts forwards, it can be changed to limit time or add proxy.
+	HTTPClient *http.Client
+
+	hooksMu   sync.RWMutex
+	onMessage []func(InboundMessage)
+
+	mu       sync.Mutex
+	partials map[string]*partialMessage
+	pruned   time.Time
+	messages []InboundMessage
+}
+
+// partialMessage is concatenated message that is not received whole yet.
+type partialMessage struct {
+	parts    []string
+	received int
+	first    time.Time
+}
+
+// NewInbox creates Inbox that forwards messages by rules, forwards are signed with secret.
+func NewInbox(rules []ForwardRule, secret string, retry RetryPolicy) *Inbox {
+	return &Inbox{
+		rules:      rules,
+		secret:     []byte(secret),
+		retry:      retry,
+		HTTPClient: &http.Client{Timeout: defaultHTTPTimeout},
+		partials:   make(map[string]*partialMessage),
+	}
+}
+
+// Receive takes inbound SMS. Message is stored and forwarded once all its parts are received,
+// parts that gateway passed more than once are ignored.
+func (b *Inbox) Receive(p InboundPart) error {
+	if p.Originator == "" || p.Recipient == "" {
+		return errInboundFormat
+	}
+
+	m := InboundMessage{
+		ID:         newID(),
+		Originator: p.Originator,
+		Recipient:  p.Recipient,
+		Body:       p.Body,
+		Parts:      1,
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	ref, total, current, ok := concatInfo(p.Header)
+	if ok && total > 1 {
+		body, complete := b.join(p, ref, total, current)
+		if !complete {
+			return nil
+		}
+		m.Body = body
+		m.Parts = int(total)
+	}
+
+	b.mu.Lock()
+	b.messages = append(b.messages, m)
+	if len(b.messages) > inboxSize {
+		b.messages = append(b.messages[:0], b.messages[len(b.messages)-inboxSize:]...)
+	}
+	b.mu.Unlock()
+
+	b.hooksMu.RLock()
+	hooks := b.onMessage
+	b.hooksMu.RUnlock()
+
+	for _, fn := range hooks {
+		fn(m)
+	}
+
+	for _, r := range b.rules {
+		if r.Matches(m) {
+			go b.forward(r.URL, m, 1)
+		}
+	}
+
+	return nil
+}
+
+// OnMessage registers fn that is called with every complete message before it is forwarded.
+// It is called from webhook handler, so it should not take long.
+func (b *Inbox) OnMessage(fn func(InboundMessage)) {
+	b.hooksMu.Lock()
+	b.onMessage = append(b.onMessage, fn)
+	b.hooksMu.Unlock()
+}
+
+// Messages returns latest complete messages, oldest first. All of them are returned if originator is empty.
+func (b *Inbox) Messages(originator string) []InboundMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	messages := make([]InboundMessage, 0, len(b.messages))
+	for _, m := range b.messages {
+		if originator == "" || m.Originator == originator {
+			messages = append(messages, m)
+		}
+	}
+
+	return messages
+}
+
+// join adds part to concatenated message, body is returned when all parts are there.
+// Parts are grouped the same way handset does it: by sender, recipient, reference number and total.
+func (b *Inbox) join(p InboundPart, ref uint16, total, current byte) (string, bool) {
+	key := p.Originator + "|" + p.Recipient + "|" + strconv.Itoa(int(ref)) + "|" + strconv.Itoa(int(total))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Forgetting messages that lost some of their parts.
+	if time.Since(b.pruned) > time.Minute {
+		for k, pm := range b.partials {
+			if time.Since(pm.first) > partTTL {
+				log.Printf("Dropped %d of %d parts of inbound message, the rest is not received.\n", pm.received, len(pm.parts))
+				delete(b.partials, k)
+			}
+		}
+		b.pruned = time.Now()
+	}
+
+	pm, ok := b.partials[key]
+	if !ok {
+		pm = &partialMessage{parts: make([]string, total), first: time.Now()}
+		b.partials[key] = pm
+	}
+
+	// Body of part can not be empty, so empty one is not received yet.
+	if pm.parts[current-1] != "" {
+		return "", false
+	}
+	pm.parts[current-1] = p.Body
+	pm.received++
+
+	if pm.received < len(pm.parts) {
+		return "", false
+	}
+	delete(b.partials, key)
+
+	return strings.Join(pm.parts, ""), true
+}
+
+// forward posts message to URL and schedules next attempt if it failed and can succeed later.
+func (b *Inbox) forward(url string, m InboundMessage, attempt int) {
+	_, retry, err := postSigned(b.HTTPClient, url, b.secret, m)
+	if err == nil {
+		return
+	}
+	if !retry || attempt >= b.retry.MaxAttempts {
+		log.Printf("Failed to forward inbound message %s after %d attempts: %s\n", m.ID, attempt, err)
+		return
+	}
+
+	time.AfterFunc(b.retry.backoff(attempt), func() {
+		b.forward(url, m, attempt+1)
+	})
+}
+
+// InboundParser is implemented by gateways that pass incoming messages to webhook.
+// ParseInbound verifies that request is signed by gateway and extracts messages from it.
+type InboundParser interface {
+	ParseInbound(req *http.Request) ([]InboundPart, error)
+}
+
+// InboundReceiver declares method that takes incoming SMS.
+type InboundReceiver interface {
+	Receive(p InboundPart) error
+}
+
+// InboundHandler accepts incoming message webhooks of gateways.
+type InboundHandler struct {
+	receiver InboundReceiver
+	parsers  map[string]InboundParser
+}
+
+// NewInboundHandler creates handler of incoming messages, parsers are mapped by gateway name.
+func NewInboundHandler(r InboundReceiver, parsers map[string]InboundParser) *InboundHandler {
+	return &InboundHandler{
+		receiver: r,
+		parsers:  parsers,
+	}
+}
+
+// HandleInbound accepts GET and POST requests with incoming messages, last element of URL path is gateway name.
+func (h *InboundHandler) HandleInbound(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Base(req.URL.Path)
+	parser, ok := h.parsers[name]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	parts, err := parser.ParseInbound(req)
+	if err == ErrSignature {
+		log.Printf("Rejected inbound message of %s from %s: %s\n", name, req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to parse inbound message of %s, error: %s\n", name, err)
+		http.Error(w, errInboundFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, p := range parts {
+		if err := h.receiver.Receive(p); err != nil {
+			log.Printf("Failed to receive inbound message of %s from %s, error: %s\n", name, p.Originator, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// InboundLog declares method to inspect received messages.
+type InboundLog interface {
+	Messages(originator string) []InboundMessage
+}
+
+// InboxHandler exposes received messages over HTTP.
+type InboxHandler struct {
+	log InboundLog
+}
+
+// NewInboxHandler constructs InboxHandler for provided log.
+func NewInboxHandler(l InboundLog) *InboxHandler {
+	return &InboxHandler{
+		log: l,
+	}
+}
+
+// HandleMessages lists latest received messages on GET, optional originator query parameter filters them by sender.
+func (h *InboxHandler) HandleMessages(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.log.Messages(req.URL.Query().Get("originator")))
+}
+
+// LoadForwardRules reads forwarding rules from CSV file, lines starting with # are ignored.
+// Empty originator prefix and keyword match any message:
+//
+//	# originator,keyword,url
+//	,STOP,https://crm.example.com/sms/stop
+//	380,,https://ua.example.com/sms
+func LoadForwardRules(path string) ([]ForwardRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := parseForwardRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("forward rules %s: %s", path, err)
+	}
+
+	return rules, nil
+}
+
+func parseForwardRules(r io.Reader) ([]ForwardRule, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	var rules []ForwardRule
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		originator := strings.TrimSpace(rec[0])
+		if originator != "" && !isDigits(originator) {
+			return nil, fmt.Errorf("invalid originator prefix %q", rec[0])
+		}
+
+		keyword := strings.TrimSpace(rec[1])
+		if strings.ContainsAny(keyword, " \t") {
+			return nil, fmt.Errorf("keyword %q is not a single word", rec[1])
+		}
+
+		u, err := url.Parse(strings.TrimSpace(rec[2]))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q", rec[2])
+		}
+
+		rules = append(rules, ForwardRule{Originator: originator, Keyword: keyword, URL: u.String()})
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,229 @@
+package smsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInboxJoinsParts(t *testing.T) {
+	inbox := NewInbox(nil, "secret", DefaultCallbackRetryPolicy)
+
+	parts := []InboundPart{
+		{Originator: "380501234567", Recipient: "4915112345678", Body: "lo, ", Header: mustHeader(NewRefUDH(7, 3, 2))},
+		// Other message with the same reference from another sender.
+		{Originator: "380669999999", Recipient: "4915112345678", Body: "Bye", Header: mustHeader(NewRefUDH(7, 2, 1))},
+		{Originator: "380501234567", Recipient: "4915112345678", Body: "Hel", Header: mustHeader(NewRefUDH(7, 3, 1))},
+		// Gateway passed part again.
+		{Originator: "380501234567", Recipient: "4915112345678", Body: "Hel", Header: mustHeader(NewRefUDH(7, 3, 1))},
+		{Originator: "380501234567", Recipient: "4915112345678", Body: "STOP"},
+		{Originator: "380501234567", Recipient: "4915112345678", Body: "world", Header: mustHeader(NewRefUDH(7, 3, 3))},
+	}
+
+	for _, p := range parts {
+		if err := inbox.Receive(p); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+
+	messages := inbox.Messages("380501234567")
+	if len(messages) != 2 {
+		t.Fatalf("Got messages: %+v", messages)
+	}
+	if m := messages[1]; m.Body != "Hello, world" || m.Parts != 3 {
+		t.Errorf("Got message: %+v", m)
+	}
+	if m := messages[0]; m.Body != "STOP" || m.Parts != 1 {
+		t.Errorf("Got message: %+v", m)
+	}
+
+	if messages := inbox.Messages(""); len(messages) != 2 {
+		t.Errorf("Got %d messages, expected: 2", len(messages))
+	}
+
+	if err := inbox.Receive(InboundPart{Body: "Hello"}); err != errInboundFormat {
+		t.Errorf("Got error: %v, expected: %v", err, errInboundFormat)
+	}
+}
+
+func TestInboxForwardsByRules(t *testing.T) {
+	forwarded := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get(CallbackTimestampHeader) + "."))
+		mac.Write(body)
+		if sig := r.Header.Get(CallbackSignatureHeader); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Got signature: %q", sig)
+		}
+
+		var m InboundMessage
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Error("Failed to decode forward:", err)
+		}
+		forwarded <- r.URL.Path + " " + m.Body
+	}))
+	defer srv.Close()
+
+	inbox := NewInbox([]ForwardRule{
+		{Keyword: "stop", URL: srv.URL + "/stop"},
+		{Originator: "380", URL: srv.URL + "/ua"},
+	}, "secret", DefaultCallbackRetryPolicy)
+
+	var seen []string
+	inbox.OnMessage(func(m InboundMessage) {
+		seen = append(seen, m.Body)
+	})
+
+	for _, p := range []InboundPart{
+		{Originator: "380501234567", Recipient: "4915112345678", Body: "Stop please"},
+		{Originator: "4915199999999", Recipient: "4915112345678", Body: "STOP"},
+		{Originator: "4915199999999", Recipient: "4915112345678", Body: "stopped"},
+	} {
+		inbox.Receive(p)
+	}
+	if len(seen) != 3 {
+		t.Errorf("Got messages passed to hook: %q", seen)
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case f := <-forwarded:
+			got[f] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Got forwards: %v", got)
+		}
+	}
+	for _, expected := range []string{"/stop Stop please", "/ua Stop please", "/stop STOP"} {
+		if !got[expected] {
+			t.Errorf("Forward %q is missing, got: %v", expected, got)
+		}
+	}
+
+	select {
+	case f := <-forwarded:
+		t.Errorf("Got unexpected forward: %s", f)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestParseForwardRules(t *testing.T) {
+	rules, err := parseForwardRules(strings.NewReader(`# originator,keyword,url
+,STOP,https://crm.example.com/stop
+380, ,http://ua.example.com/sms
+`))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	expected := []ForwardRule{
+		{Keyword: "STOP", URL: "https://crm.example.com/stop"},
+		{Originator: "380", URL: "http://ua.example.com/sms"},
+	}
+	if len(rules) != len(expected) || rules[0] != expected[0] || rules[1] != expected[1] {
+		t.Errorf("Got rules: %+v, expected: %+v", rules, expected)
+	}
+
+	for _, invalid := range []string{
+		"+380,,https://ua.example.com\n",
+		",two words,https://ua.example.com\n",
+		",,ftp://ua.example.com\n",
+		",,https://\n",
+		"380,https://ua.example.com\n",
+	} {
+		if _, err := parseForwardRules(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Got no error for: %q", invalid)
+		}
+	}
+}
+
+func TestHandleInbound(t *testing.T) {
+	cases := []struct {
+		method   string
+		url      string
+		parts    []InboundPart
+		err      error
+		code     int
+		received int
+	}{
+		{method: "POST", url: "/inbound/mock", parts: []InboundPart{{Originator: "1"}, {Originator: "2"}}, code: http.StatusOK, received: 2},
+		{method: "GET", url: "/inbound/mock", parts: []InboundPart{{}}, code: http.StatusOK, received: 1},
+		{method: "POST", url: "/inbound/mock", err: ErrSignature, code: http.StatusForbidden},
+		{method: "POST", url: "/inbound/mock", err: errors.New("bad json"), code: http.StatusBadRequest},
+		{method: "POST", url: "/inbound/other", code: http.StatusNotFound},
+		{method: "PUT", url: "/inbound/mock", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		receiver := &MockedInboundReceiver{}
+		h := NewInboundHandler(receiver, map[string]InboundParser{
+			"mock": &MockedInboundParser{parts: c.parts, err: c.err},
+		})
+
+		rec := httptest.NewRecorder()
+		h.HandleInbound(rec, httptest.NewRequest(c.method, c.url, nil))
+
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %s %s", rec.Code, c.code, c.method, c.url)
+		}
+		if len(receiver.parts) != c.received {
+			t.Errorf("Got %d parts received, expected: %d", len(receiver.parts), c.received)
+		}
+	}
+}
+
+func TestHandleMessages(t *testing.T) {
+	inbox := NewInbox(nil, "secret", DefaultCallbackRetryPolicy)
+	inbox.Receive(InboundPart{Originator: "380501234567", Recipient: "4915112345678", Body: "Hi"})
+	inbox.Receive(InboundPart{Originator: "380669999999", Recipient: "4915112345678", Body: "Hey"})
+
+	h := NewInboxHandler(inbox)
+
+	rec := httptest.NewRecorder()
+	h.HandleMessages(rec, httptest.NewRequest("GET", "/admin/inbound?originator=380669999999", nil))
+
+	var messages []InboundMessage
+	if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if len(messages) != 1 || messages[0].Body != "Hey" {
+		t.Errorf("Got messages: %+v", messages)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleMessages(rec, httptest.NewRequest("POST", "/admin/inbound", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+type MockedInboundParser struct {
+	parts []InboundPart
+	err   error
+}
+
+func (p *MockedInboundParser) ParseInbound(req *http.Request) ([]InboundPart, error) {
+	return p.parts, p.err
+}
+
+type MockedInboundReceiver struct {
+	parts []InboundPart
+}
+
+func (r *MockedInboundReceiver) Receive(p InboundPart) error {
+	r.parts = append(r.parts, p)
+	if p.Originator == "" {
+		return errInboundFormat
+	}
+	return nil
+}
@@ -1,28 +1,77 @@
 package smsd
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidUDH is returned when header values can not be used in concatenated message.
+var ErrInvalidUDH = errors.New("header values violation")
 
 // NewUDH constructs header that indicates that SMS is a part of sequence.
 // Messages will be concatenated in correct order according to indexes.
 //
-// total - indicates how many messages are there in sequence. Max 9 for MessageBird.com.
+// total - indicates how many messages are there in sequence. Gateways limit it, 9 for MessageBird.com.
 // current - index of current message.
 //
-// Zero values are not allowed for total and current. Current can not be more than total. Max current is 9.
-func NewUDH(total, current byte) UDH {
-	if total == 0 || current == 0 || current > 9 || total > 9 || current > total {
-		// this should never happen
-		// but better fail if we got here.
-		panic("header values violation")
+// Zero values are not allowed for total and current. Current can not be more than total.
+// Gateway limit is enforced by splitToMsgs, here only UDH format restrictions apply.
+//
+// ErrInvalidUDH is returned if values violate restrictions.
+//
+// CSMS reference number is zero, use NewRefUDH to tell apart parts of different messages.
+func NewUDH(total, current byte) (UDH, error) {
+	return NewRefUDH(0, total, current)
+}
+
+// NewRefUDH constructs header with 8-bit CSMS reference number.
+// Handset groups parts by reference number, so it must differ for messages that can arrive at the same time.
+func NewRefUDH(ref, total, current byte) (UDH, error) {
+	if err := checkHeaderValues(total, current); err != nil {
+		return UDH{}, err
 	}
+
 	return UDH{
 		0x05,    // OveralLength
 		0x00,    // Type
 		0x03,    // HeaderLength
-		0x00,    // CSMS reference number
+		ref,     // CSMS reference number
 		total,   // TotalMsg
 		current, // SequentialNum
+	}, nil
+}
+
+// NewUDH16 constructs header with 16-bit CSMS reference number.
+// Same restrictions as for NewUDH apply to total and current.
+func NewUDH16(ref uint16, total, current byte) (UDH16, error) {
+	if err := checkHeaderValues(total, current); err != nil {
+		return UDH16{}, err
+	}
+
+	return UDH16{
+		0x06,             // OveralLength
+		0x08,             // Type
+		0x04,             // HeaderLength
+		byte(ref >> 8),   // CSMS reference number, high byte
+		byte(ref & 0xFF), // CSMS reference number, low byte
+		total,            // TotalMsg
+		current,          // SequentialNum
+	}, nil
+}
+
+// checkHeaderValues returns ErrInvalidUDH if total and current can not be used in concatenated message header.
+func checkHeaderValues(total, current byte) error {
+	if total == 0 || current == 0 || current > total {
+		return ErrInvalidUDH
 	}
+	return nil
+}
+
+// Header is a User Data Header that marks SMS as a part of concatenated message.
+type Header interface {
+	ToHexStr() string
+	IsSet() bool
 }
 
 // UDH is a header that holds service information.
@@ -39,6 +88,76 @@ func (h UDH) IsSet() bool {
 	return h[3] != 0 || h[4] != 0
 }
 
+// UDH16 is a concatenated message header with 16-bit reference number.
+// It lowers the chance of reference collision for recipients with a lot of long messages.
+type UDH16 [7]byte
+
+// ToHexStr returns string with header bytes in hex.
+func (h UDH16) ToHexStr() string {
+	return fmt.Sprintf("%x", h)
+}
+
+// IsSet returns true if default values were modified.
+func (h UDH16) IsSet() bool {
+	return h[5] != 0
+}
+
+// Information element identifiers of concatenated message headers.
+const (
+	ieiConcat8  = 0x00
+	ieiConcat16 = 0x08
+)
+
+// ParseHeader finds concatenated message element in raw User Data Header of received SMS.
+// Header starts with its length, as in short message. UDH or UDH16 is returned,
+// nil if header has other elements only. ErrInvalidUDH is returned if header is malformed.
+func ParseHeader(b []byte) (Header, error) {
+	if len(b) == 0 || int(b[0]) >= len(b) {
+		return nil, ErrInvalidUDH
+	}
+
+	elements := b[1 : int(b[0])+1]
+	for len(elements) >= 2 {
+		iei, size := elements[0], int(elements[1])
+		if 2+size > len(elements) {
+			return nil, ErrInvalidUDH
+		}
+		data := elements[2 : 2+size]
+
+		switch {
+		case iei == ieiConcat8 && size == 3:
+			h, err := NewRefUDH(data[0], data[1], data[2])
+			if err != nil {
+				return nil, err
+			}
+			return h, nil
+		case iei == ieiConcat16 && size == 4:
+			h, err := NewUDH16(uint16(data[0])<<8|uint16(data[1]), data[2], data[3])
+			if err != nil {
+				return nil, err
+			}
+			return h, nil
+		}
+
+		elements = elements[2+size:]
+	}
+
+	return nil, nil
+}
+
+// concatInfo returns reference number, number of parts and index of part that header holds.
+// Returns false for header that does not mark concatenated message.
+func concatInfo(h Header) (ref uint16, total, current byte, ok bool) {
+	switch h := h.(type) {
+	case UDH:
+		return uint16(h[3]), h[4], h[5], h.IsSet()
+	case UDH16:
+		return uint16(h[3])<<8 | uint16(h[4]), h[5], h[6], h.IsSet()
+	}
+
+	return 0, 0, 0, false
+}
+
 // Msg is a data transfer structure that holds data required by Messenger Client to send SMS.
 //
 // Depending on datacode, type and presence of UDH header message body can have different number of symbols.
@@ -48,10 +167,21 @@ func (h UDH) IsSet() bool {
 // Binary (8 bit) (140)
 // GSM_03.38 (7 bit) (160)
 //
-// For now supporting only GSM_03.38
+// Supporting GSM_03.38 and UCS-2, Encoding is detected from body.
 type Msg struct {
-	Header     UDH
+	// ID is shared by all parts of concatenated message, Segment is 1-based index of part out of Segments.
+	ID         string
+	Segment    int
+	Segments   int
+	Header     Header
 	Body       string
 	Originator string
 	Recipient  string
+	Encoding   Encoding
+	// Tenant is ID of API key that submitted message, queue is shared fairly between tenants.
+	Tenant   string
+	Priority Priority
+	// Attempts number of failed attempts to send, NextAttempt is when message can be sent again.
+	Attempts    int
+	NextAttempt time.Time
 }
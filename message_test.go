@@ -10,7 +10,10 @@ func TestNewUDH(t *testing.T) {
 	total = 5
 	current = 3
 
-	header := NewUDH(total, current)
+	header, err := NewUDH(total, current)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
 
 	actual := header.ToHexStr()
 	expected := "050003000503"
@@ -22,7 +25,7 @@ func TestNewUDH(t *testing.T) {
 
 func TestNewUDHIsSet(t *testing.T) {
 	cases := []struct {
-		header UDH
+		header Header
 		want   bool
 	}{
 		{
@@ -30,11 +33,11 @@ func TestNewUDHIsSet(t *testing.T) {
 			want:   false,
 		},
 		{
-			header: NewUDH(2, 2),
+			header: mustHeader(NewUDH(2, 2)),
 			want:   true,
 		},
 		{
-			header: NewUDH(2, 1),
+			header: mustHeader(NewUDH(2, 1)),
 			want:   true,
 		},
 	}
@@ -47,46 +50,27 @@ func TestNewUDHIsSet(t *testing.T) {
 	}
 }
 
-func TestNewUDHPanicsWithZeroTotal(t *testing.T) {
-	expected := true
-	defer testUDHPanic(expected, t)
-	NewUDH(0, 1)
-}
-
-func TestNewUDHPanicsWithZeroCurrent(t *testing.T) {
-	expected := true
-	defer testUDHPanic(expected, t)
-	NewUDH(1, 0)
+func TestNewUDHFailsWithZeroTotal(t *testing.T) {
+	_, err := NewUDH(0, 1)
+	testUDHErr(true, err, t)
 }
 
-func TestNewUDHPanicsWithBothZeros(t *testing.T) {
-	expected := true
-	defer testUDHPanic(expected, t)
-	NewUDH(0, 0)
+func TestNewUDHFailsWithZeroCurrent(t *testing.T) {
+	_, err := NewUDH(1, 0)
+	testUDHErr(true, err, t)
 }
 
-func TestNewUDHPanicsWithCurrentMoreThanTotal(t *testing.T) {
-	expected := true
-	defer testUDHPanic(expected, t)
-	NewUDH(5, 6)
+func TestNewUDHFailsWithBothZeros(t *testing.T) {
+	_, err := NewUDH(0, 0)
+	testUDHErr(true, err, t)
 }
 
-func TestNewUDHPanicsWithCurrentMoreThanNine(t *testing.T) {
-	expected := true
-	defer testUDHPanic(expected, t)
-	NewUDH(10, 10)
+func TestNewUDHFailsWithCurrentMoreThanTotal(t *testing.T) {
+	_, err := NewUDH(5, 6)
+	testUDHErr(true, err, t)
 }
 
-func TestNewUDHPanicsWithTotalMoreThanNine(t *testing.T) {
-	expected := true
-	defer testUDHPanic(expected, t)
-	NewUDH(10, 1)
-}
-
-func TestNewUDHNotPanicsWithValidInput(t *testing.T) {
-	expected := false
-	defer testUDHPanic(expected, t)
-
+func TestNewUDHNotFailsWithValidInput(t *testing.T) {
 	cases := []struct {
 		total   byte
 		current byte
@@ -104,26 +88,101 @@ func TestNewUDHNotPanicsWithValidInput(t *testing.T) {
 			total:   9,
 			current: 9,
 		},
+		{
+			total:   10, // over MessageBird.com limit, but valid UDH
+			current: 10,
+		},
+		{
+			total:   255,
+			current: 1,
+		},
 	}
 
 	for _, c := range cases {
-		NewUDH(c.total, c.current)
+		_, err := NewUDH(c.total, c.current)
+		testUDHErr(false, err, t)
 	}
 }
 
-func testUDHPanic(expected bool, t *testing.T) {
-	err := recover()
-	if actual, ok := err.(error); ok {
-		if !expected {
-			t.Error("Panic happened, but we did not expect that.")
-		}
-		expectedText := "header values violation"
-		if actual.Error() != expectedText {
-			t.Errorf("Actual error: %q, expected error: %q", actual.Error(), expectedText)
-		}
+func testUDHErr(expected bool, err error, t *testing.T) {
+	if err != nil && !expected {
+		t.Error("Error happened, but we did not expect that:", err)
+	}
+
+	if err != nil && err != ErrInvalidUDH {
+		t.Errorf("Actual error: %q, expected error: %q", err, ErrInvalidUDH)
 	}
 
 	if expected && err == nil {
-		t.Error("Panic expected but never happened.")
+		t.Error("Error expected but never happened.")
+	}
+}
+
+// mustHeader is a helper for tests that build headers from valid values.
+func mustHeader(h Header, err error) Header {
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+func TestNewRefUDH(t *testing.T) {
+	actual := mustHeader(NewRefUDH(0xA7, 3, 2)).ToHexStr()
+	expected := "050003a70302"
+
+	if actual != expected {
+		t.Errorf("Header is: %q, expected: %q", actual, expected)
+	}
+}
+
+func TestNewUDH16(t *testing.T) {
+	header := mustHeader(NewUDH16(0x1F2E, 3, 2))
+
+	actual := header.ToHexStr()
+	expected := "060804" + "1f2e" + "0302"
+
+	if actual != expected {
+		t.Errorf("Header is: %q, expected: %q", actual, expected)
+	}
+
+	if !header.IsSet() {
+		t.Error("Header is not set, expected it to be set.")
+	}
+
+	if (UDH16{}).IsSet() {
+		t.Error("Empty header is set, expected it not to be.")
+	}
+}
+
+func TestNewUDH16FailsWithCurrentMoreThanTotal(t *testing.T) {
+	_, err := NewUDH16(1, 5, 6)
+	testUDHErr(true, err, t)
+}
+
+func TestParseHeader(t *testing.T) {
+	cases := []struct {
+		b        []byte
+		expected Header
+		err      error
+	}{
+		{b: []byte{0x05, 0x00, 0x03, 0xA7, 0x03, 0x02}, expected: mustHeader(NewRefUDH(0xA7, 3, 2))},
+		{b: []byte{0x06, 0x08, 0x04, 0x1F, 0x2E, 0x03, 0x02}, expected: mustHeader(NewUDH16(0x1F2E, 3, 2))},
+		// Port addressing element before concatenation one.
+		{b: []byte{0x0B, 0x05, 0x04, 0x0B, 0x84, 0x23, 0xF0, 0x00, 0x03, 0x01, 0x02, 0x01}, expected: mustHeader(NewRefUDH(1, 2, 1))},
+		{b: []byte{0x06, 0x05, 0x04, 0x0B, 0x84, 0x23, 0xF0}, expected: nil},
+		{b: []byte{0x05, 0x00, 0x03, 0xA7}, err: ErrInvalidUDH},
+		{b: []byte{0x05, 0x00, 0x03, 0xA7, 0x02, 0x03}, err: ErrInvalidUDH},
+		{b: nil, err: ErrInvalidUDH},
+	}
+
+	for _, c := range cases {
+		h, err := ParseHeader(c.b)
+		if err != c.err {
+			t.Errorf("Got error: %v, expected: %v for % X", err, c.err, c.b)
+			continue
+		}
+		if h != c.expected {
+			t.Errorf("Got header: %v, expected: %v for % X", h, c.expected, c.b)
+		}
 	}
 }
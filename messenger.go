@@ -1,23 +1,40 @@
 package smsd
 
 import (
+	"context"
+	"errors"
+	"hash/fnv"
 	"log"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mb "github.com/messagebird/go-rest-api"
 )
 
 const (
-	// MaxSeqSMSCount max supported concatenated SMS
+	// MaxSeqSMSCount max supported concatenated SMS by MessageBird.com.
+	// Used for gateways that do not implement SegmentLimiter.
 	MaxSeqSMSCount = 9
+	// MaxUDHSegments max number of concatenated SMS that UDH format allows.
+	MaxUDHSegments = 255
 	// PlainSMSLen number of chars in 7-bit encoding for single SMS without concat.
 	PlainSMSLen = 160
 	// PlainConcatSMSLen number of chars in 7-bit encoding for single SMS with concat.
 	PlainConcatSMSLen = 153
+	// PlainWideConcatSMSLen number of chars in 7-bit encoding for single SMS with 16-bit reference concat.
+	PlainWideConcatSMSLen = 152
 
-	udhField     = "udh"
-	escapedChars = "\n\\^~[]{}|~€"
+	udhField = "udh"
+)
+
+var (
+	// ErrTooManySegments is returned when message body does not fit in number of concatenated SMS gateway allows.
+	ErrTooManySegments = errors.New("message does not fit in allowed number of SMS")
+	// ErrQueueFull is returned when there was no room in queue before context was done.
+	ErrQueueFull = errors.New("queue is full")
+	// ErrClosed is returned when message is submitted to Client that is closed.
+	ErrClosed = errors.New("client is closed")
 )
 
 // MBClient declares MessageBird NewMessage method.
@@ -25,91 +42,819 @@ type MBClient interface {
 	NewMessage(originator string, recipients []string, body string, msgParams *mb.MessageParams) (*mb.Message, error)
 }
 
-// Client holds actual MessageBird.com client and channel that we use for rate limiting.
+// QueueEstimator is implemented by messengers that can tell how long it takes to send queued messages.
+type QueueEstimator interface {
+	QueueDelay() time.Duration
+}
+
+// RefWidener is implemented by messengers that can use 16-bit reference numbers in concatenated messages.
+type RefWidener interface {
+	WideRefs() bool
+}
+
+// wideRefs returns true if messenger uses 16-bit reference numbers.
+func wideRefs(m interface{}) bool {
+	w, ok := m.(RefWidener)
+	return ok && w.WideRefs()
+}
+
+// SegmentLimiter is implemented by providers that allow other number of concatenated SMS than MaxSeqSMSCount.
+type SegmentLimiter interface {
+	MaxSegments() int
+}
+
+// Client holds SMS gateway provider and queue that we use for rate limiting.
 type Client struct {
-	mbClient MBClient
-	msgChan  chan Msg
+	// queued number of SMS in queue, first fields to be 64-bit aligned for atomic operations.
+	queued int64
+	// retrying number of SMS waiting for next attempt outside of queue.
+	retrying int64
+
+	provider    Provider
+	queue       *fairQueue
+	limiter     *RateLimiter
+	workers     int
+	refs        RefAllocator
+	wideRefs    bool
+	maxSegments int
+	tracker     Tracker
+	store       Store
+	retry       RetryPolicy
+	deadLetters DeadLetterStore
+
+	hooksMu  sync.RWMutex
+	onStatus []func(Status)
+
+	// closing stops intake, draining tells worker to leave when queue is empty,
+	// abort tells worker to leave right away, stopped is closed when worker left.
+	mu        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	abortOnce sync.Once
+	closing   chan struct{}
+	draining  chan struct{}
+	abort     chan struct{}
+	stopped   chan struct{}
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// WithRefAllocator sets allocator of concatenated message reference numbers.
+// Default is NewRotatingRefs.
+func WithRefAllocator(a RefAllocator) Option {
+	return func(c *Client) {
+		c.refs = a
+	}
+}
+
+// WithWideRefs makes concatenated messages use 16-bit reference numbers (IEI 0x08) instead of 8-bit ones.
+func WithWideRefs() Option {
+	return func(c *Client) {
+		c.wideRefs = true
+	}
+}
+
+// WithTracker sets Tracker that keeps message statuses. Default is NewMemTracker.
+func WithTracker(t Tracker) Option {
+	return func(c *Client) {
+		c.tracker = t
+	}
+}
+
+// WithStore sets Store that keeps queued messages. Messages that were pending in it are sent first.
+// By default queue is not persisted.
+func WithStore(s Store) Option {
+	return func(c *Client) {
+		c.store = s
+	}
+}
+
+// WithDeadLetters sets DeadLetterStore that keeps messages that could not be sent.
+// Default is NewMemDeadLetters with DefaultDeadLetterLimit.
+func WithDeadLetters(s DeadLetterStore) Option {
+	return func(c *Client) {
+		c.deadLetters = s
+	}
+}
+
+// WithRetryPolicy sets how failed messages are resent. Default is DefaultRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// WithTenantWeights sets how many SMS tenant can send in its turn when several tenants have queued messages.
+// By default every tenant gets one SMS per turn.
+func WithTenantWeights(weight func(tenant string) int) Option {
+	return func(c *Client) {
+		c.queue.weight = weight
+	}
+}
+
+// WithRateLimiter sets limiter of sending rate, it replaces fixed sendRate of NewClient.
+// Limiter can be changed while Client is sending.
+func WithRateLimiter(l *RateLimiter) Option {
+	return func(c *Client) {
+		c.limiter = l
+	}
+}
+
+// WithWorkers sets number of workers that send SMS in parallel, they share rate limit. Default is 1.
+// Messages to the same recipient are sent by the same worker, so they are sent in order they were queued.
+func WithWorkers(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.workers = n
+		}
+	}
 }
 
 // NewMsgBirdClient creates new rate limited instance of messaging client that uses MessageBird.com API.
-func NewMsgBirdClient(mbClient MBClient, queueSize int, sendRate time.Duration) *Client {
+func NewMsgBirdClient(mbClient MBClient, queueSize int, sendRate time.Duration, opts ...Option) *Client {
+	return NewClient(NewMessageBirdProvider(mbClient), queueSize, sendRate, opts...)
+}
+
+// NewClient creates new rate limited instance of messaging client that sends SMS through provided gateway.
+// SMS are sent one per sendRate unless WithRateLimiter is set. Queue holds up to queueSize messages, parts of concatenated message are queued together and count as one.
+// Tenants set with ContextWithTenant share sending rate in weighted round-robin order.
+func NewClient(provider Provider, queueSize int, sendRate time.Duration, opts ...Option) *Client {
 	c := &Client{
-		mbClient: mbClient,
-		msgChan:  make(chan Msg, queueSize),
+		provider:    provider,
+		queue:       newFairQueue(queueSize),
+		limiter:     NewRateLimiter(float64(time.Second)/float64(sendRate), 1),
+		workers:     1,
+		refs:        NewRotatingRefs(),
+		maxSegments: segmentCap(provider),
+		tracker:     NewMemTracker(),
+		store:       nopStore{},
+		deadLetters: NewMemDeadLetters(DefaultDeadLetterLimit),
+		retry:       DefaultRetryPolicy,
+		closing:     make(chan struct{}),
+		draining:    make(chan struct{}),
+		abort:       make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
 
-	go c.startWorker(sendRate)
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	pending, err := c.store.Pending()
+	if err != nil {
+		log.Println("Failed to load pending messages from store, error:", err)
+	}
+	c.trackPending(pending)
+
+	go c.dispatch(pending)
 
 	return c
 }
 
-// process prepares data and sends generated SMS from sender to a recipient with provided text.
+// WideRefs returns true if concatenated messages have 16-bit reference numbers, so parts are shorter.
+func (c *Client) WideRefs() bool {
+	return c.wideRefs && !nativeConcat(c.provider)
+}
+
+// MaxSegments returns max number of concatenated SMS that configured gateway allows.
+func (c *Client) MaxSegments() int {
+	return c.maxSegments
+}
+
+// QueueDelay estimates how long it takes to send messages that are already queued.
+func (c *Client) QueueDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.queued)) * c.limiter.interval()
+}
+
+// QueueDepth returns number of queued SMS by priority.
+func (c *Client) QueueDepth() map[Priority]int {
+	return c.queue.depth()
+}
+
+// Status returns state of message with provided ID, ErrNotFound if there is no such message.
+func (c *Client) Status(id string) (Status, error) {
+	return c.tracker.Status(id)
+}
+
+// segmentCap returns number of concatenated SMS gateway allows, limited to what UDH can address.
+func segmentCap(gateway interface{}) int {
+	l, ok := gateway.(SegmentLimiter)
+	if !ok {
+		return MaxSeqSMSCount
+	}
+
+	max := l.MaxSegments()
+	if max < 1 {
+		return 1
+	}
+	if max > MaxUDHSegments {
+		return MaxUDHSegments
+	}
+
+	return max
+}
+
+// process sends generated SMS from sender to a recipient with provided text.
+// Returns name of gateway that accepted it, if provider has several, and gateway message ID or SendError.
 // Not exported as needs to be used through rate limiter.
-func (c *Client) process(mr Msg) {
-	msgParams := &mb.MessageParams{}
+func (c *Client) process(mr Msg) (string, string, error) {
+	if s, ok := c.provider.(namedSender); ok {
+		return s.sendNamed(mr)
+	}
 
-	if mr.Header.IsSet() {
-		details := make(map[string]interface{})
-		details[udhField] = mr.Header.ToHexStr()
-		msgParams.TypeDetails = details
+	id, err := c.provider.Send(mr)
+	return "", id, err
+}
+
+// OnStatusChange registers fn that is called with status of message every time one of its segments changes state.
+// It is called from sending loop, so it must not block.
+func (c *Client) OnStatusChange(fn func(Status)) {
+	c.hooksMu.Lock()
+	c.onStatus = append(c.onStatus, fn)
+	c.hooksMu.Unlock()
+}
+
+// updateStatus records new state of segment, failure to do so is not a reason to stop sending.
+func (c *Client) updateStatus(mr Msg, state State, provider, providerID string) {
+	if err := c.tracker.Update(mr.ID, mr.Segment, state, provider, providerID); err != nil {
+		log.Printf("Failed to update status of message %s segment %d: %s\n", mr.ID, mr.Segment, err)
+		return
 	}
 
-	m, err := c.mbClient.NewMessage(
-		mr.Originator,
-		[]string{mr.Recipient},
-		mr.Body,
-		msgParams,
-	)
+	c.notify(mr.ID)
+}
+
+// notify passes status of message to OnStatus hooks.
+func (c *Client) notify(id string) {
+	c.hooksMu.RLock()
+	hooks := c.onStatus
+	c.hooksMu.RUnlock()
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	status, err := c.tracker.Status(id)
 	if err != nil {
-		// Possibly resubmit request to the queue with some delay,
-		// keeping track of number of attempts.
-		// This will require extending Msg to have attempts counter.
-		// For now simply logging errors.
+		log.Printf("Failed to get status of message %s: %s\n", id, err)
+		return
+	}
 
-		if err != mb.ErrResponse {
-			log.Println("Failed to send SMS. Unrecoverable error:", err)
-			return
-		}
-		for _, mbError := range m.Errors {
-			log.Printf("Error: %#v\n", mbError)
-		}
+	for _, fn := range hooks {
+		fn(status)
+	}
+}
+
+// Report applies delivery report of gateway to segment it was sent with.
+// Reports that come after segment got final state are ignored, gateways can send them more than once.
+// Gateways that split long messages themselves report every part, segment is final when all of them are.
+// ErrNotFound is returned if no segment was accepted by gateway with reported ID.
+func (c *Client) Report(r Report) error {
+	id, segment, changed, err := c.tracker.Report(r)
+	if err != nil {
+		return err
+	}
+
+	if r.State == StateFailed {
+		log.Printf("Message %s segment %d is not delivered: %s\n", id, segment, r.Reason)
+	}
+
+	if changed {
+		c.notify(id)
 	}
+
+	return nil
 }
 
 // SendText submits SMS request. It will be send sometime in the future.
-// Call to this function may be long if channel is full. Consider passing context with timeout.
-func (c *Client) SendText(originator, recipient, body string) {
-	if getBodyCount(body) <= PlainSMSLen {
-		c.msgChan <- Msg{
+// Returned ID can be used to check message status.
+// Call to this function may be long if channel is full, use SendTextContext to limit it.
+// ErrTooManySegments is returned if body does not fit in allowed number of concatenated SMS.
+func (c *Client) SendText(originator, recipient, body string) (string, error) {
+	return c.SendTextContext(context.Background(), originator, recipient, body)
+}
+
+// SendTextContext submits SMS request same as SendText, but waits for room in queue only until ctx is done.
+// ErrQueueFull is returned if message was not queued in time. Message belongs to tenant of ctx
+// and has its priority.
+func (c *Client) SendTextContext(ctx context.Context, originator, recipient, body string) (string, error) {
+	var msgs []Msg
+
+	enc := DetectEncoding(body)
+
+	if getBodyCount(body) <= enc.singleLen() {
+		msgs = []Msg{{
 			Originator: originator,
 			Recipient:  recipient,
 			Body:       body,
+			Encoding:   enc,
+		}}
+	} else if nativeConcat(c.provider) {
+		// Gateway splits body itself, we only make sure that it fits.
+		if _, err := splitToMsgs(originator, recipient, body, concatRef{}, c.maxSegments); err != nil {
+			return "", err
 		}
+
+		msgs = []Msg{{
+			Originator: originator,
+			Recipient:  recipient,
+			Body:       body,
+			Encoding:   enc,
+		}}
 	} else {
-		msgs := splitToMsgs(originator, recipient, body)
+		ref := concatRef{
+			num:  c.refs.NextRef(recipient),
+			wide: c.wideRefs,
+		}
+
+		var err error
+		msgs, err = splitToMsgs(originator, recipient, body, ref, c.maxSegments)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	id := newID()
+	tenant, priority := tenantFrom(ctx), priorityFrom(ctx)
+	for i := range msgs {
+		msgs[i].ID = id
+		msgs[i].Tenant = tenant
+		msgs[i].Priority = priority
+		msgs[i].Segment = i + 1
+		msgs[i].Segments = len(msgs)
+	}
+
+	// Message is acknowledged only after it is saved.
+	if err := c.store.Put(msgs); err != nil {
+		return "", err
+	}
+
+	// Message is tracked only once it is saved, so rejected one does not leave status behind.
+	if err := c.tracker.Track(id, tenant, len(msgs)); err != nil {
+		for _, m := range msgs {
+			c.done(m)
+		}
+		return "", err
+	}
 
+	// All parts are queued as one unit, so either all of them are sent or none.
+	if err := c.enqueue(ctx, msgs); err != nil {
 		for _, m := range msgs {
-			c.msgChan <- m
+			c.updateStatus(m, StateFailed, "", "")
+			c.done(m)
 		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+// enqueue puts parts of message to queue as one unit.
+// ErrQueueFull is returned if there was no room for it before ctx was done, ErrClosed if Client is closed.
+func (c *Client) enqueue(ctx context.Context, unit []Msg) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	atomic.AddInt64(&c.queued, int64(len(unit)))
+
+	if err := c.queue.push(ctx, unit, c.closing); err != nil {
+		atomic.AddInt64(&c.queued, -int64(len(unit)))
+		return err
+	}
+
+	return nil
+}
+
+// Close stops accepting new messages and keeps sending queued ones until queue is empty or ctx is done.
+// Returns number of SMS that were left unsent. They are kept in Store, if it is persistent,
+// and will be sent after restart. ctx error is returned if queue was not drained in time.
+func (c *Client) Close(ctx context.Context) (int, error) {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+
+		// Waiting for senders that are in the middle of enqueue.
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+
+		close(c.draining)
+	})
+
+	var err error
+
+	select {
+	case <-c.stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.abortOnce.Do(func() { close(c.abort) })
+		<-c.stopped
 	}
+
+	left := atomic.LoadInt64(&c.queued) + atomic.LoadInt64(&c.retrying)
+
+	return int(left), err
 }
 
-// startWorker runs a loop that sends short messages with constant rate.
-func (c *Client) startWorker(sendRate time.Duration) {
-	t := time.Tick(sendRate)
+// dispatch runs a loop that passes short messages to workers with rate of limiter.
+// Messages left pending in store from previous run are sent before new ones.
+// Dispatch stops when Client is closed and queue is drained, or when drain is aborted, workers stop after it.
+func (c *Client) dispatch(pending []Msg) {
+	defer close(c.stopped)
 
+	p := c.startPool(c.workers)
+	defer p.stop()
+
+	var backlog [][]Msg
+	for _, unit := range groupUnits(pending) {
+		if time.Now().Before(unit[0].NextAttempt) {
+			c.retryLater(unit)
+			continue
+		}
+		backlog = append(backlog, unit)
+	}
+
+	draining := c.draining
 	for {
-		<-t // Tick
-		c.process(<-c.msgChan)
+		// Not waiting for rate limit if there is nothing left to send.
+		if draining == nil && len(backlog) == 0 && c.queue.len() == 0 {
+			return
+		}
+
+		// Abort comes only after drain, so waiting is interrupted by whichever of them is next.
+		interrupt := draining
+		if interrupt == nil {
+			interrupt = c.abort
+		}
+
+		if !c.limiter.wait(interrupt) {
+			select {
+			case <-c.abort:
+				c.leave(backlog...)
+				return
+			default:
+				draining = nil
+				continue
+			}
+		}
+
+		unit, ok := c.next(p, &backlog)
+		if !ok {
+			c.leave(backlog...)
+			return
+		}
+
+		p.hand(unit)
+	}
+}
+
+// pool is a set of workers, every worker sends messages to its shard of recipients one by one.
+// Unit is handed to worker only when it is idle, until then unit waits in queue where priority still applies,
+// so neither a slow recipient holds up others, nor units that took their turn pile up behind it.
+type pool struct {
+	shards []chan []Msg
+	// busy is true for workers that have a unit, it is only used by dispatch.
+	busy []bool
+	// idle receives index of worker that finished its unit.
+	idle chan int
+	wg   sync.WaitGroup
+}
+
+// startPool starts n workers.
+func (c *Client) startPool(n int) *pool {
+	p := &pool{
+		shards: make([]chan []Msg, n),
+		busy:   make([]bool, n),
+		idle:   make(chan int, n),
+	}
+
+	for i := range p.shards {
+		p.shards[i] = make(chan []Msg, 1)
+
+		p.wg.Add(1)
+		go func(i int) {
+			defer p.wg.Done()
+			c.work(p.shards[i], func() { p.idle <- i })
+		}(i)
+	}
+
+	return p
+}
+
+// skip returns true if worker of unit recipient is busy.
+func (p *pool) skip(unit []Msg) bool {
+	return p.busy[shardOf(unit[0].Recipient, len(p.shards))]
+}
+
+// hand passes unit to worker of its recipient, the worker must be idle.
+func (p *pool) hand(unit []Msg) {
+	i := shardOf(unit[0].Recipient, len(p.shards))
+	p.busy[i] = true
+	p.shards[i] <- unit
+}
+
+// collect marks workers that finished their units idle.
+func (p *pool) collect() {
+	for {
+		select {
+		case i := <-p.idle:
+			p.busy[i] = false
+		default:
+			return
+		}
+	}
+}
+
+// stop lets workers finish their units and waits for them.
+func (p *pool) stop() {
+	for _, s := range p.shards {
+		close(s)
+	}
+	p.wg.Wait()
+}
+
+// work sends units one after another and calls finished after each, units that are left after drain
+// was aborted are not sent.
+func (c *Client) work(units <-chan []Msg, finished func()) {
+	for unit := range units {
+		select {
+		case <-c.abort:
+			c.leave(unit)
+		default:
+			if rest := c.sendUnit(unit); len(rest) != 0 {
+				c.leave(rest)
+			}
+		}
+
+		finished()
+	}
+}
+
+// shardOf returns worker that sends messages to recipient.
+func shardOf(recipient string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(recipient))
+
+	return int(h.Sum32() % uint32(shards))
+}
+
+// next takes unit whose worker is idle, from backlog first and then from queue.
+// It returns false when Client is closed and there is nothing left to send, or when drain is aborted.
+func (c *Client) next(p *pool, backlog *[][]Msg) ([]Msg, bool) {
+	draining := c.draining
+	for {
+		p.collect()
+
+		for i, unit := range *backlog {
+			if !p.skip(unit) {
+				*backlog = append((*backlog)[:i], (*backlog)[i+1:]...)
+				return unit, true
+			}
+		}
+
+		if unit, ok := c.queue.takeUnless(p.skip); ok {
+			atomic.AddInt64(&c.queued, -int64(len(unit)))
+			return unit, true
+		}
+		if draining == nil && len(*backlog) == 0 && c.queue.len() == 0 {
+			return nil, false
+		}
+
+		select {
+		case i := <-p.idle:
+			p.busy[i] = false
+		case <-c.queue.ready:
+		case <-draining:
+			draining = nil
+		case <-c.abort:
+			return nil, false
+		}
+	}
+}
+
+// leave counts units that worker did not send as queued, so Close can report them.
+func (c *Client) leave(units ...[]Msg) {
+	for _, unit := range units {
+		atomic.AddInt64(&c.queued, int64(len(unit)))
+	}
+}
+
+// sendUnit sends parts of message back-to-back, so they are not mixed with other messages.
+// First part is sent right away as caller already waited for rate limit. Part that failed stops the unit,
+// parts from it on are tried again or moved to dead letters together.
+// Returns parts that were not sent because drain was aborted.
+func (c *Client) sendUnit(unit []Msg) []Msg {
+	for i, m := range unit {
+		if i != 0 && !c.limiter.wait(c.abort) {
+			return unit[i:]
+		}
+		if err := c.send(m); err != nil {
+			c.fail(unit[i:], err)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// groupUnits splits messages to units of consecutive parts of the same message.
+func groupUnits(msgs []Msg) [][]Msg {
+	var units [][]Msg
+
+	for i, m := range msgs {
+		if i == 0 || msgs[i-1].ID != m.ID {
+			units = append(units, nil)
+		}
+		units[len(units)-1] = append(units[len(units)-1], m)
+	}
+
+	return units
+}
+
+// send processes message and removes it from store, error of gateway is returned.
+func (c *Client) send(m Msg) error {
+	provider, providerID, err := c.process(m)
+	if err != nil {
+		if errorKind(err) == Throttled {
+			c.limiter.throttled()
+		}
+		return err
+	}
+
+	c.limiter.accepted()
+	c.updateStatus(m, StateSubmitted, provider, providerID)
+	c.done(m)
+
+	return nil
+}
+
+// fail handles parts of unit from the one that failed with err. Recipient can not put message together
+// without any of them, so they are scheduled for another attempt together, or moved to dead letter queue
+// together if error is permanent or attempts ran out.
+func (c *Client) fail(rest []Msg, err error) {
+	rest = append([]Msg(nil), rest...)
+
+	attempts := rest[0].Attempts + 1
+	for i := range rest {
+		rest[i].Attempts = attempts
+	}
+
+	if errorKind(err) != Permanent && attempts < c.retry.MaxAttempts {
+		next := time.Now().Add(c.retry.backoff(attempts))
+		for i := range rest {
+			rest[i].NextAttempt = next
+		}
+		log.Printf("Failed to send message %s segment %d, attempt %d, next at %s: %s\n",
+			rest[0].ID, rest[0].Segment, attempts, next.Format(time.RFC3339), err)
+
+		// Saving attempts counter, it does not matter much if this fails.
+		if err := c.store.Put(rest); err != nil {
+			log.Printf("Failed to save attempts of message %s: %s\n", rest[0].ID, err)
+		}
+
+		c.retryLater(rest)
+		return
+	}
+
+	log.Printf("Failed to send message %s segment %d after %d attempts, moving %d segments to dead letters: %s\n",
+		rest[0].ID, rest[0].Segment, attempts, len(rest), err)
+
+	failedAt := time.Now().UTC()
+	for _, m := range rest {
+		c.updateStatus(m, StateFailed, "", "")
+		if err := c.deadLetters.Add(newDeadLetter(m, err.Error(), failedAt)); err != nil {
+			log.Printf("Failed to save dead letter of message %s segment %d: %s\n", m.ID, m.Segment, err)
+		}
+		c.done(m)
+	}
+}
+
+// retryLater puts unit back to queue when next attempt of its first message is due.
+// Unit that is due after Client is closed stays in Store and is counted as left by Close.
+func (c *Client) retryLater(unit []Msg) {
+	atomic.AddInt64(&c.retrying, int64(len(unit)))
+
+	time.AfterFunc(time.Until(unit[0].NextAttempt), func() {
+		if err := c.enqueue(context.Background(), unit); err != nil {
+			log.Printf("Failed to queue message %s for next attempt: %s\n", unit[0].ID, err)
+			return
+		}
+		atomic.AddInt64(&c.retrying, -int64(len(unit)))
+	})
+}
+
+// done removes message from store.
+func (c *Client) done(m Msg) {
+	if err := c.store.Done(m); err != nil {
+		log.Printf("Failed to mark message %s segment %d done in store: %s\n", m.ID, m.Segment, err)
+	}
+}
+
+// DeadLetters returns messages that were rejected by gateway or ran out of attempts.
+func (c *Client) DeadLetters() []DeadLetter {
+	return c.deadLetters.List()
+}
+
+// ReplayDeadLetter puts all dead segments of message back to queue with attempts counter reset.
+// ErrNotFound is returned if there are no dead segments for this message, ErrQueueFull if there was no room
+// for them in queue before ctx was done. Segments stay dead letters if they were not queued.
+func (c *Client) ReplayDeadLetter(ctx context.Context, id string) error {
+	letters, err := c.deadLetters.Take(id)
+	if err != nil {
+		return err
+	}
+	if len(letters) == 0 {
+		return ErrNotFound
+	}
+
+	msgs := make([]Msg, 0, len(letters))
+	for _, l := range letters {
+		m := l.Msg
+		m.Attempts = 0
+		m.NextAttempt = time.Time{}
+		msgs = append(msgs, m)
+	}
+
+	if err := c.store.Put(msgs); err != nil {
+		// Letters are kept, so replay can be tried again.
+		c.keepDeadLetters(letters)
+		return err
+	}
+
+	for _, m := range msgs {
+		c.updateStatus(m, StateQueued, "", "")
+	}
+
+	if err := c.enqueue(ctx, msgs); err != nil {
+		for _, m := range msgs {
+			c.updateStatus(m, StateFailed, "", "")
+			c.done(m)
+		}
+		c.keepDeadLetters(letters)
+		return err
+	}
+
+	return nil
+}
+
+// keepDeadLetters puts back dead letters that were taken for replay.
+func (c *Client) keepDeadLetters(letters []DeadLetter) {
+	for _, l := range letters {
+		if err := c.deadLetters.Add(l); err != nil {
+			log.Printf("Failed to keep dead letter of message %s segment %d: %s\n", l.ID, l.Segment, err)
+		}
+	}
+}
+
+// trackPending registers messages loaded from store, so their status can be checked again.
+// Segments that are not pending anymore were processed before restart, they are considered submitted.
+func (c *Client) trackPending(pending []Msg) {
+	bySegment := make(map[string]bool, len(pending))
+	for _, m := range pending {
+		bySegment[msgKey(m.ID, m.Segment)] = true
+	}
+
+	tracked := make(map[string]bool)
+	for _, m := range pending {
+		if tracked[m.ID] {
+			continue
+		}
+		tracked[m.ID] = true
+
+		if err := c.tracker.Track(m.ID, m.Tenant, m.Segments); err != nil {
+			log.Printf("Failed to track pending message %s: %s\n", m.ID, err)
+			continue
+		}
+
+		for i := 1; i <= m.Segments; i++ {
+			if !bySegment[msgKey(m.ID, i)] {
+				c.updateStatus(Msg{ID: m.ID, Segment: i}, StateSubmitted, "", "")
+			}
+		}
+	}
+}
+
+// segmentCount returns number of SMS body is sent in, gateways that split body themselves charge the same.
+// wide is true if parts have 16-bit reference header.
+func segmentCount(body string, wide bool) int {
+	enc := DetectEncoding(body)
+	if getBodyCount(body) <= enc.singleLen() {
+		return 1
 	}
+	return len(chunkBody(body, enc.concatLen(wide), enc))
 }
 
-// getBodyCount evaluates each symbol in provided body in terms of GSM_03.38 encoding.
+// getBodyCount evaluates each symbol in provided body in terms of encoding detected for it.
 func getBodyCount(body string) int {
 	var sum int
 
+	enc := DetectEncoding(body)
 	for _, r := range body {
-		sum += getSymbolSize(r)
+		sum += enc.symbolSize(r)
 	}
 
 	return sum
@@ -118,58 +863,67 @@ func getBodyCount(body string) int {
 // getSymbolSize returns number of characters needed to represent given symbol in GSM_03.38
 // Symbols from extended set require preceding escape symbol.
 func getSymbolSize(r rune) int {
-	if strings.ContainsRune(escapedChars, r) {
+	if isGSMExtension(r) {
 		return 2
 	}
 	return 1
 }
 
 // splitToMsgs creates multiple messages of valid size based on body size
-func splitToMsgs(originator, recipient, body string) []Msg {
-	bodyParts := chunkBody(body, PlainConcatSMSLen)
+// All of them share the same reference number. Number of messages is limited by maxSegments.
+func splitToMsgs(originator, recipient, body string, ref concatRef, maxSegments int) ([]Msg, error) {
+	enc := DetectEncoding(body)
+	bodyParts := chunkBody(body, enc.concatLen(ref.wide), enc)
 	msgCount := len(bodyParts)
 
-	if msgCount > MaxSeqSMSCount {
-		// Panicking is bad but in this case better to fail than violite SMS Gateway API.
-		panic("message body does not fit in 9 messages")
+	if msgCount > maxSegments || msgCount > MaxUDHSegments {
+		// Better to fail than violate SMS Gateway API.
+		return nil, ErrTooManySegments
 	}
 
 	msgs := make([]Msg, 0, msgCount)
 
 	for i, b := range bodyParts {
+		header, err := ref.header(byte(msgCount), byte(i+1)) // Casting is safe here as count is not over 255.
+		if err != nil {
+			return nil, err
+		}
+
 		msg := Msg{
-			Header:     NewUDH(byte(msgCount), byte(i+1)), // Casting is safe here as we panic if count is over 9.
+			Header:     header,
 			Originator: originator,
 			Recipient:  recipient,
 			Body:       b,
+			Encoding:   enc,
 		}
 		msgs = append(msgs, msg)
 	}
 
-	return msgs
+	return msgs, nil
 }
 
-// chunkBody splits string to chunks of requested size
+// chunkBody splits string to chunks of requested size counted in chars of provided encoding.
 // string may be less than requested if next symbol overflows limit.
-func chunkBody(b string, maxChars int) []string {
+// Symbols are never cut in half, so UCS-2 surrogate pairs always stay in the same chunk.
+func chunkBody(b string, maxChars int, enc Encoding) []string {
 	var (
-		chunks       []string
-		chars        int
-		nextSymbSize int
+		chunks   []string
+		chars    int
+		symbSize int
 	)
 
 	chunk := make([]rune, 0, maxChars)
-	for i, r := range b {
-		nextSymbSize = chars + getSymbolSize(rune(b[i]))
+	for _, r := range b {
+		symbSize = enc.symbolSize(r)
 
-		if chars == maxChars || nextSymbSize > maxChars {
+		if chars+symbSize > maxChars {
 			// this chunk is full
 			chunks = append(chunks, string(chunk))
 			chunk = make([]rune, 0, maxChars)
 			chars = 0
 		}
 
-		chars += getSymbolSize(r)
+		chars += symbSize
 		chunk = append(chunk, r)
 	}
 
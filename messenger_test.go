@@ -1,6 +1,7 @@
 package smsd
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"strconv"
@@ -12,27 +13,62 @@ import (
 	mb "github.com/messagebird/go-rest-api"
 )
 
-func TestSplitToMessagesPanicsIfBodyIsToLong(t *testing.T) {
-	defer func() {
-		err := recover()
-		if err == nil {
-			t.Error("Expected panic never occurred")
-		}
-	}()
-
+func TestSplitToMessagesFailsIfBodyIsToLong(t *testing.T) {
 	body := strings.Repeat("m", PlainConcatSMSLen*MaxSeqSMSCount+1) // More than 9 SMS
 
-	splitToMsgs("notUsed", "notUsed", body)
+	_, err := splitToMsgs("notUsed", "notUsed", body, concatRef{}, MaxSeqSMSCount)
+	if err != ErrTooManySegments {
+		t.Errorf("Got error: %v, expected: %v", err, ErrTooManySegments)
+	}
+}
+
+func TestSplitToMessagesRespectsSegmentCap(t *testing.T) {
+	body := strings.Repeat("m", PlainConcatSMSLen*16) // 16 SMS
+
+	msgs, err := splitToMsgs("notUsed", "notUsed", body, concatRef{}, 16)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(msgs) != 16 {
+		t.Errorf("Got %d messages, expected: 16", len(msgs))
+	}
+
+	_, err = splitToMsgs("notUsed", "notUsed", body, concatRef{}, 15)
+	if err != ErrTooManySegments {
+		t.Errorf("Got error: %v, expected: %v", err, ErrTooManySegments)
+	}
+}
+
+func TestClientMaxSegments(t *testing.T) {
+	cases := []struct {
+		gateway MBClient
+		want    int
+	}{
+		{gateway: &MockedMBClient{}, want: MaxSeqSMSCount},
+		{gateway: &MockedLimitedMBClient{maxSegments: 16}, want: 16},
+		{gateway: &MockedLimitedMBClient{maxSegments: 1000}, want: MaxUDHSegments},
+		{gateway: &MockedLimitedMBClient{maxSegments: 0}, want: 1},
+	}
+
+	for _, c := range cases {
+		client := NewMsgBirdClient(c.gateway, 1, time.Hour)
+		if actual := client.MaxSegments(); actual != c.want {
+			t.Errorf("Max segments is: %d, expected: %d", actual, c.want)
+		}
+	}
 }
 
 func TestSplitToMessagesCreatesMsgRequestsWithProperData(t *testing.T) {
 	body := strings.Repeat("m", PlainConcatSMSLen*3)
 
-	expectedBodies := chunkBody(body, PlainConcatSMSLen)
+	expectedBodies := chunkBody(body, PlainConcatSMSLen, GSM7)
 	originator := "Mr. Smith"
 	recipient := "Mr. Davis"
 
-	msgs := splitToMsgs(originator, recipient, body)
+	msgs, err := splitToMsgs(originator, recipient, body, concatRef{}, MaxSeqSMSCount)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
 
 	for i, m := range msgs {
 		if m.Originator != originator {
@@ -44,13 +80,45 @@ func TestSplitToMessagesCreatesMsgRequestsWithProperData(t *testing.T) {
 		if m.Body != expectedBodies[i] {
 			t.Errorf("Actual body: %q, expected: %q", m.Body, expectedBodies[i])
 		}
-		expectedHeader := NewUDH(byte(len(expectedBodies)), byte(i+1))
+		expectedHeader := mustHeader(NewUDH(byte(len(expectedBodies)), byte(i+1)))
 		if m.Header != expectedHeader {
 			t.Errorf("Actual header: %q, expected header: %q", m.Header.ToHexStr(), expectedHeader.ToHexStr())
 		}
 	}
 }
 
+func TestSplitToMessagesFitsUserData(t *testing.T) {
+	const maxUserData = 140 // octets
+
+	bodies := []string{
+		strings.Repeat("m", PlainConcatSMSLen*3),
+		strings.Repeat("ї", UnicodeConcatSMSLen*3),
+	}
+
+	for _, wide := range []bool{false, true} {
+		for _, body := range bodies {
+			msgs, err := splitToMsgs("notUsed", "notUsed", body, concatRef{num: 1, wide: wide}, MaxSeqSMSCount)
+			if err != nil {
+				t.Fatal("Unexpected error:", err)
+			}
+
+			for _, m := range msgs {
+				headerLen := len(m.Header.ToHexStr()) / 2
+				bodyLen := getBodyCount(m.Body) * 2
+				if m.Encoding == GSM7 {
+					// Septets are packed after header padded to septet boundary.
+					bodyLen = (headerLen*8+getBodyCount(m.Body)*7+7)/8 - headerLen
+				}
+
+				if headerLen+bodyLen > maxUserData {
+					t.Errorf("%v part with wide reference %t takes %d octets, expected at most %d",
+						m.Encoding, wide, headerLen+bodyLen, maxUserData)
+				}
+			}
+		}
+	}
+}
+
 // TestGetSymbCount checks if we take into account that some symbols must be escaped in SMS.
 // That's why the are counted as 2 symbols.
 func TestGetSymbCount(t *testing.T) {
@@ -63,9 +131,13 @@ func TestGetSymbCount(t *testing.T) {
 			Expected: 10,
 		},
 		{
-			Body:     "\n\\^[]{}|~€", // Each symbol in this string belongs to char set extension and counts as 2.
+			Body:     "\f\\^[]{}|~€", // Each symbol in this string belongs to char set extension and counts as 2.
 			Expected: 20,
 		},
+		{
+			Body:     "\r\n", // Line breaks belong to basic char set.
+			Expected: 2,
+		},
 		{
 			Body:     "",
 			Expected: 0,
@@ -122,7 +194,7 @@ func TestChunkBody(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		actual := chunkBody(c.Body, c.Length)
+		actual := chunkBody(c.Body, c.Length, GSM7)
 		if !reflect.DeepEqual(actual, c.Result) {
 			t.Errorf("Got chunks: %q, expected: %q", actual, c.Result)
 		}
@@ -151,7 +223,7 @@ func TestSendText(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		numOfSMS := len(chunkBody(c.body, PlainConcatSMSLen))
+		numOfSMS := len(chunkBody(c.body, PlainConcatSMSLen, GSM7))
 
 		var wg sync.WaitGroup
 		wg.Add(numOfSMS)
@@ -173,14 +245,16 @@ func TestSendText(t *testing.T) {
 			},
 		}
 
-		client := NewMsgBirdClient(mock, 100, 1*time.Microsecond)
+		client := NewMsgBirdClient(mock, 100, 1*time.Microsecond, WithRefAllocator(MockedRefAllocator(7)))
 
-		client.SendText(c.originator, c.recipient, c.body)
+		if _, err := client.SendText(c.originator, c.recipient, c.body); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
 
 		// Wait for all messages to be processed.
 		wg.Wait()
 
-		for i, m := range mock.SentMsgs {
+		for i, m := range mock.SentMsgs() {
 			if m.Originator != c.originator {
 				t.Errorf("Got originator: %q, expected: %q", m.Originator, c.originator)
 			}
@@ -192,7 +266,7 @@ func TestSendText(t *testing.T) {
 			if c.udhExpected {
 				actualUDH := m.TypeDetails["udh"].(string)
 
-				if actualUDH != NewUDH(byte(numOfSMS), byte(i+1)).ToHexStr() {
+				if actualUDH != mustHeader(NewRefUDH(7, byte(numOfSMS), byte(i+1))).ToHexStr() {
 					t.Error("Wrong UDH header")
 				}
 			} else {
@@ -205,6 +279,601 @@ func TestSendText(t *testing.T) {
 	}
 }
 
+func TestSendTextUnicode(t *testing.T) {
+	body := strings.Repeat("ж", UnicodeSMSLen+1) // does not fit in single UCS-2 SMS
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	mock := &MockedMBClient{
+		NewMessageFunc: func(originator string, recipients []string, body string, msgParams *mb.MessageParams) mb.Message {
+			wg.Done()
+			return mb.Message{
+				Body:        body,
+				DataCoding:  msgParams.DataCoding,
+				TypeDetails: msgParams.TypeDetails,
+			}
+		},
+	}
+
+	client := NewMsgBirdClient(mock, 100, 1*time.Microsecond, WithRefAllocator(MockedRefAllocator(7)))
+	client.SendText("Kyivstar", "380730220022", body)
+
+	wg.Wait()
+
+	for i, m := range mock.SentMsgs() {
+		if m.DataCoding != "unicode" {
+			t.Errorf("Got datacoding: %q, expected: %q", m.DataCoding, "unicode")
+		}
+		if m.TypeDetails["udh"] != mustHeader(NewRefUDH(7, 2, byte(i+1))).ToHexStr() {
+			t.Error("Wrong UDH header")
+		}
+	}
+}
+
+func TestSendTextUsesDistinctRefs(t *testing.T) {
+	body := strings.Repeat("m", PlainSMSLen+1) // 2 parts
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	mock := &MockedMBClient{
+		NewMessageFunc: func(originator string, recipients []string, body string, msgParams *mb.MessageParams) mb.Message {
+			wg.Done()
+			return mb.Message{TypeDetails: msgParams.TypeDetails}
+		},
+	}
+
+	client := NewMsgBirdClient(mock, 100, 1*time.Microsecond, WithWideRefs())
+	client.SendText("Bank", "380730220022", body)
+	client.SendText("Bank", "380730220022", body)
+
+	wg.Wait()
+
+	first := mock.SentMsgs()[0].TypeDetails["udh"].(string)
+	second := mock.SentMsgs()[2].TypeDetails["udh"].(string)
+
+	if len(first) != 14 {
+		t.Errorf("Got header: %q, expected 16-bit reference header", first)
+	}
+
+	// Reference number is in bytes 3 and 4.
+	if first[6:10] == second[6:10] {
+		t.Errorf("Both messages have the same reference number, headers: %q and %q", first, second)
+	}
+}
+
+func TestSendTextFailsIfBodyIsTooLong(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 100, time.Hour)
+
+	body := strings.Repeat("m", PlainConcatSMSLen*MaxSeqSMSCount+1) // More than 9 SMS
+
+	if _, err := client.SendText("Valid", "380660000000", body); err != ErrTooManySegments {
+		t.Errorf("Got error: %v, expected: %v", err, ErrTooManySegments)
+	}
+
+	if client.queue.len() != 0 {
+		t.Errorf("Got %d messages in queue, expected none", client.queue.len())
+	}
+}
+
+func TestSendTextTracksStatus(t *testing.T) {
+	body := strings.Repeat("m", PlainSMSLen+1) // 2 parts
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	mock := &MockedMBClient{
+		NewMessageFunc: func(originator string, recipients []string, body string, msgParams *mb.MessageParams) mb.Message {
+			return mb.Message{Id: "mb-" + msgParams.TypeDetails["udh"].(string)}
+		},
+	}
+
+	tracker := &MockedTracker{Tracker: NewMemTracker(), updated: &wg}
+	client := NewMsgBirdClient(mock, 100, 1*time.Microsecond, WithTracker(tracker), WithRefAllocator(MockedRefAllocator(7)))
+
+	id, err := client.SendText("Bank", "380730220022", body)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	wg.Wait()
+
+	status, err := client.Status(id)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if status.State != StateSubmitted {
+		t.Errorf("Got state: %q, expected: %q", status.State, StateSubmitted)
+	}
+
+	for i, s := range status.Segments {
+		expected := "mb-" + mustHeader(NewRefUDH(7, 2, byte(i+1))).ToHexStr()
+		if s.ProviderID != expected {
+			t.Errorf("Got provider ID: %q, expected: %q", s.ProviderID, expected)
+		}
+	}
+
+	if _, err := client.Status("unknown"); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+}
+
+func TestClientSendsPendingMessagesFromStore(t *testing.T) {
+	store := &MockedStore{
+		pending: []Msg{
+			{ID: "1", Segment: 2, Segments: 2, Header: mustHeader(NewRefUDH(7, 2, 2)), Body: "left", Recipient: "380660000000"},
+		},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	mock := &MockedMBClient{
+		NewMessageFunc: func(originator string, recipients []string, body string, msgParams *mb.MessageParams) mb.Message {
+			wg.Done()
+			return mb.Message{Body: body}
+		},
+	}
+
+	client := NewMsgBirdClient(mock, 100, 1*time.Microsecond, WithStore(store))
+
+	status, err := client.Status("1")
+	if err != nil {
+		t.Fatal("Pending message is not tracked:", err)
+	}
+	if status.Segments[0].State != StateSubmitted {
+		t.Errorf("Got state of processed segment: %q, expected: %q", status.Segments[0].State, StateSubmitted)
+	}
+
+	wg.Wait()
+
+	if mock.SentMsgs()[0].Body != "left" {
+		t.Errorf("Got body: %q, expected: %q", mock.SentMsgs()[0].Body, "left")
+	}
+}
+
+func TestSendTextFailsIfStoreFails(t *testing.T) {
+	store := &MockedStore{err: errors.New("disk is full")}
+	tracker := &MockedTracker{Tracker: NewMemTracker()}
+	client := NewMsgBirdClient(&MockedMBClient{}, 100, time.Hour, WithStore(store), WithTracker(tracker))
+
+	if _, err := client.SendText("Bank", "380660000000", "Hola!"); err != store.err {
+		t.Errorf("Got error: %v, expected: %v", err, store.err)
+	}
+
+	if len(tracker.tracked) != 0 {
+		t.Errorf("Got tracked messages: %q, expected none", tracker.tracked)
+	}
+
+	if client.queue.len() != 0 {
+		t.Errorf("Got %d messages in queue, expected none", client.queue.len())
+	}
+}
+
+func TestClientRetriesTemporaryErrors(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	mock := &MockedFlakyMBClient{
+		errs: []error{errors.New("timeout"), errors.New("timeout")},
+		sent: &wg,
+	}
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Microsecond, MaxDelay: time.Millisecond}
+	client := NewMsgBirdClient(mock, 100, 1*time.Microsecond, WithRetryPolicy(policy))
+
+	id, err := client.SendText("Bank", "380660000000", "Hola!")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	wg.Wait()
+	waitForState(t, client, id, StateSubmitted)
+
+	if len(client.DeadLetters()) != 0 {
+		t.Errorf("Got dead letters: %+v, expected none", client.DeadLetters())
+	}
+}
+
+func TestClientMovesFailedToDeadLetters(t *testing.T) {
+	cases := []struct {
+		name string
+		errs []error
+		want int // attempts
+	}{
+		{
+			name: "permanent",
+			errs: []error{mb.ErrResponse},
+			want: 1,
+		},
+		{
+			name: "out of attempts",
+			errs: []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")},
+			want: 3,
+		},
+	}
+
+	for _, c := range cases {
+		var wg sync.WaitGroup
+		wg.Add(c.want)
+
+		mock := &MockedFlakyMBClient{errs: c.errs, sent: &wg}
+
+		policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Microsecond, MaxDelay: time.Millisecond}
+		client := NewMsgBirdClient(mock, 100, 1*time.Microsecond, WithRetryPolicy(policy))
+
+		id, _ := client.SendText("Bank", "380660000000", "Hola!")
+
+		wg.Wait()
+		waitForState(t, client, id, StateFailed)
+
+		letters := client.DeadLetters()
+		if len(letters) != 1 || letters[0].Attempts != c.want {
+			t.Errorf("Case %s: got dead letters: %+v, expected one with %d attempts", c.name, letters, c.want)
+		}
+
+		// Gateway works again.
+		wg.Add(1)
+		if err := client.ReplayDeadLetter(context.Background(), id); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		wg.Wait()
+		waitForState(t, client, id, StateSubmitted)
+
+		if err := client.ReplayDeadLetter(context.Background(), id); err != ErrNotFound {
+			t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+		}
+	}
+}
+
+func TestClientReplayKeepsDeadLettersIfQueueIsFull(t *testing.T) {
+	deadLetters := NewMemDeadLetters(10)
+	client := NewMsgBirdClient(&MockedMBClient{}, 0, time.Hour, WithDeadLetters(deadLetters)) // queue is always full
+
+	m := Msg{ID: "1", Segment: 1, Segments: 1, Recipient: "380660000000", Body: "Hola", Attempts: 3}
+	deadLetters.Add(newDeadLetter(m, "timeout", time.Now()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := client.ReplayDeadLetter(ctx, "1"); err != ErrQueueFull {
+		t.Errorf("Got error: %v, expected: %v", err, ErrQueueFull)
+	}
+
+	if letters := client.DeadLetters(); len(letters) != 1 || letters[0].ID != "1" {
+		t.Errorf("Got dead letters: %+v, expected message 1 to be kept", letters)
+	}
+}
+
+func TestClientRetriesRestOfUnitTogether(t *testing.T) {
+	provider := &MockedScriptedProvider{errs: []error{nil, errors.New("timeout")}}
+	provider.sent.Add(4)
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Microsecond, MaxDelay: time.Millisecond}
+	client := NewClient(provider, 100, time.Microsecond, WithRetryPolicy(policy))
+
+	id, err := client.SendText("Bank", "380660000000", strings.Repeat("m", PlainConcatSMSLen*3))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	provider.sent.Wait()
+	waitForState(t, client, id, StateSubmitted)
+
+	// Third part waits for the second one instead of going ahead of it.
+	if segments := provider.Segments(); !reflect.DeepEqual(segments, []int{1, 2, 2, 3}) {
+		t.Errorf("Got segments sent in order: %v, expected: [1 2 2 3]", segments)
+	}
+}
+
+func TestClientMovesRestOfUnitToDeadLetters(t *testing.T) {
+	permanent := &SendError{Kind: Permanent, Err: errors.New("invalid recipient")}
+	provider := &MockedScriptedProvider{errs: []error{nil, permanent}}
+	provider.sent.Add(2)
+
+	client := NewClient(provider, 100, time.Microsecond)
+
+	id, err := client.SendText("Bank", "380660000000", strings.Repeat("m", PlainConcatSMSLen*3))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	provider.sent.Wait()
+	// First part is submitted already, so message never gets failed as a whole.
+	waitForState(t, client, id, StateSubmitted)
+
+	var letters []DeadLetter
+	for deadline := time.Now().Add(time.Second); len(letters) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		letters = client.DeadLetters()
+	}
+
+	if segments := provider.Segments(); !reflect.DeepEqual(segments, []int{1, 2}) {
+		t.Errorf("Got segments sent: %v, expected: [1 2]", segments)
+	}
+
+	if len(letters) != 2 || letters[0].Segment != 2 || letters[1].Segment != 3 {
+		t.Errorf("Got dead letters: %+v, expected segments 2 and 3", letters)
+	}
+}
+
+type MockedScriptedProvider struct {
+	sent sync.WaitGroup
+
+	mu       sync.Mutex
+	errs     []error
+	segments []int
+}
+
+func (p *MockedScriptedProvider) Send(m Msg) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.sent.Done()
+
+	p.segments = append(p.segments, m.Segment)
+
+	if len(p.errs) == 0 {
+		return "p" + strconv.Itoa(len(p.segments)), nil
+	}
+
+	err := p.errs[0]
+	p.errs = p.errs[1:]
+	if err != nil {
+		return "", err
+	}
+
+	return "p" + strconv.Itoa(len(p.segments)), nil
+}
+
+// Segments returns segments of messages in order they were sent.
+func (p *MockedScriptedProvider) Segments() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]int(nil), p.segments...)
+}
+
+// waitForState polls message status until it gets expected state.
+func waitForState(t *testing.T, client *Client, id string, state State) {
+	for i := 0; i < 1000; i++ {
+		status, err := client.Status(id)
+		if err == nil && status.State == state {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Message %s never got state %q", id, state)
+}
+
+func TestSendTextContextFailsIfQueueIsFull(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 1, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.SendTextContext(ctx, "Bank", "380660000000", "first"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if _, err := client.SendTextContext(ctx, "Bank", "380660000000", "second"); err != ErrQueueFull {
+		t.Errorf("Got error: %v, expected: %v", err, ErrQueueFull)
+	}
+}
+
+func TestQueueDelay(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 10, time.Hour)
+
+	client.SendText("Bank", "380660000000", "first")
+	client.SendText("Bank", "380660000000", strings.Repeat("m", PlainSMSLen+1)) // 2 parts
+
+	if d := client.QueueDelay(); d != 3*time.Hour {
+		t.Errorf("Got delay: %s, expected: %s", d, 3*time.Hour)
+	}
+}
+
+func TestSendTextContextQueuesAllPartsOrNothing(t *testing.T) {
+	store := &MockedStore{}
+	client := NewMsgBirdClient(&MockedMBClient{}, 1, time.Hour, WithStore(store))
+
+	client.SendText("Bank", "380660000000", "first")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := client.SendTextContext(ctx, "Bank", "380660000000", strings.Repeat("m", PlainSMSLen+1))
+	if err != ErrQueueFull {
+		t.Errorf("Got error: %v, expected: %v", err, ErrQueueFull)
+	}
+
+	if client.queue.len() != 1 {
+		t.Error("Expected only first message in queue")
+	}
+	if unit, _ := client.queue.take(); len(unit) != 1 {
+		t.Error("Expected only first message in queue")
+	}
+
+	if len(store.done) != 2 {
+		t.Errorf("Got %d parts removed from store, expected: 2", len(store.done))
+	}
+}
+
+func TestSendTextQueuesPartsAsOneUnit(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 100, time.Hour) // worker waits for a tick, queue is not drained
+
+	client.SendText("First", "380660000000", strings.Repeat("1", PlainConcatSMSLen*3))
+	client.SendText("Second", "380660000000", strings.Repeat("2", PlainConcatSMSLen*3))
+
+	for _, expected := range []string{"First", "Second"} {
+		unit, _ := client.queue.take()
+		if len(unit) != 3 {
+			t.Errorf("Got unit of %d parts, expected: 3", len(unit))
+		}
+		for _, m := range unit {
+			if m.Originator != expected {
+				t.Errorf("Got part from: %q in unit of: %q", m.Originator, expected)
+			}
+		}
+	}
+}
+
+func TestGroupUnits(t *testing.T) {
+	msgs := []Msg{{ID: "1", Segment: 2}, {ID: "1", Segment: 3}, {ID: "2", Segment: 1}, {ID: "1", Segment: 1}}
+
+	units := groupUnits(msgs)
+
+	expected := [][]Msg{msgs[0:2], msgs[2:3], msgs[3:4]}
+	if !reflect.DeepEqual(units, expected) {
+		t.Errorf("Got units: %+v, expected: %+v", units, expected)
+	}
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	mbClient := &MockedMBClient{
+		NewMessageFunc: func(originator string, recipients []string, body string, msgParams *mb.MessageParams) mb.Message {
+			return mb.Message{Body: body}
+		},
+	}
+	client := NewMsgBirdClient(mbClient, 10, time.Millisecond)
+
+	client.SendText("Bank", "380660000000", "first")
+	client.SendText("Bank", "380660000000", strings.Repeat("m", PlainSMSLen+1)) // 2 parts
+
+	left, err := client.Close(context.Background())
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if left != 0 {
+		t.Errorf("Got %d SMS left, expected: 0", left)
+	}
+	if len(mbClient.SentMsgs()) != 3 {
+		t.Errorf("Got %d SMS sent, expected: 3", len(mbClient.SentMsgs()))
+	}
+}
+
+func TestCloseReportsUnsentMessages(t *testing.T) {
+	store := &MockedStore{}
+	client := NewMsgBirdClient(&MockedMBClient{}, 10, time.Hour, WithStore(store))
+
+	client.SendText("Bank", "380660000000", "first")
+	client.SendText("Bank", "380660000000", strings.Repeat("m", PlainSMSLen+1)) // 2 parts
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	left, err := client.Close(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Got error: %v, expected: %v", err, context.DeadlineExceeded)
+	}
+	if left != 3 {
+		t.Errorf("Got %d SMS left, expected: 3", left)
+	}
+	if len(store.done) != 0 {
+		t.Errorf("Got %d SMS removed from store, expected them to stay for next run", len(store.done))
+	}
+}
+
+func TestSendTextFailsIfClientIsClosed(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 10, time.Hour)
+
+	if _, err := client.Close(context.Background()); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if _, err := client.SendText("Bank", "380660000000", "late"); err != ErrClosed {
+		t.Errorf("Got error: %v, expected: %v", err, ErrClosed)
+	}
+}
+
+func TestClientNotifiesStatusChanges(t *testing.T) {
+	provider := &MockedProvider{sent: make(chan Msg, 1)}
+	client := NewClient(provider, 10, time.Millisecond)
+
+	statuses := make(chan Status, 1)
+	client.OnStatusChange(func(s Status) {
+		statuses <- s
+	})
+
+	id, err := client.SendText("Bank", "380660000000", "Hola")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	select {
+	case s := <-statuses:
+		if s.ID != id || s.State != StateSubmitted {
+			t.Errorf("Got status: %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No status change reported")
+	}
+}
+
+func TestClientAppliesReports(t *testing.T) {
+	tracker := NewMemTracker()
+	client := NewClient(&MockedProvider{}, 10, time.Hour, WithTracker(tracker))
+
+	tracker.Track("42", "", 2)
+	tracker.Update("42", 1, StateSubmitted, "", "p1")
+	tracker.Update("42", 2, StateSubmitted, "", "p2")
+
+	steps := []struct {
+		report Report
+		want   State
+	}{
+		{report: Report{ProviderID: "p1", State: StateDelivered}, want: StateSubmitted},
+		{report: Report{ProviderID: "p2", State: StateFailed, Reason: "absent subscriber"}, want: StateFailed},
+		// Late report does not change final state.
+		{report: Report{ProviderID: "p2", State: StateDelivered}, want: StateFailed},
+	}
+
+	for _, s := range steps {
+		if err := client.Report(s.report); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		status, _ := client.Status("42")
+		if status.State != s.want {
+			t.Errorf("Got state: %q, expected: %q after %+v", status.State, s.want, s.report)
+		}
+	}
+
+	if err := client.Report(Report{ProviderID: "p3", State: StateDelivered}); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+}
+
+func TestClientCombinesReportsOfParts(t *testing.T) {
+	tracker := NewMemTracker()
+	client := NewClient(&MockedProvider{}, 10, time.Hour, WithTracker(tracker))
+
+	// Gateway split the only segment in two parts itself.
+	tracker.Track("42", "", 1)
+	tracker.Update("42", 1, StateSubmitted, "", "vn1,vn2")
+
+	steps := []struct {
+		report Report
+		want   State
+	}{
+		{report: Report{ProviderID: "vn1", State: StateFailed, Reason: "absent subscriber"}, want: StateSubmitted},
+		// Part that was delivered does not hide one that failed.
+		{report: Report{ProviderID: "vn2", State: StateDelivered}, want: StateFailed},
+		{report: Report{ProviderID: "vn1", State: StateDelivered}, want: StateFailed},
+	}
+
+	for _, s := range steps {
+		if err := client.Report(s.report); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		status, _ := client.Status("42")
+		if status.State != s.want {
+			t.Errorf("Got state: %q, expected: %q after %+v", status.State, s.want, s.report)
+		}
+	}
+}
+
 func TestMBClientReturnedError(t *testing.T) {
 	mock := &MockedErrorproneMBClient{}
 	client := NewMsgBirdClient(mock, 100, 1*time.Microsecond)
@@ -214,17 +883,106 @@ func TestMBClientReturnedError(t *testing.T) {
 }
 
 type MockedMBClient struct {
-	SentMsgs       []mb.Message
 	NewMessageFunc func(originator string, recipients []string, body string, msgParams *mb.MessageParams) mb.Message
+
+	mu       sync.Mutex
+	sentMsgs []mb.Message
 }
 
 func (mc *MockedMBClient) NewMessage(originator string, recipients []string, body string, msgParams *mb.MessageParams) (*mb.Message, error) {
 	m := mc.NewMessageFunc(originator, recipients, body, msgParams)
-	mc.SentMsgs = append(mc.SentMsgs, m)
+
+	mc.mu.Lock()
+	mc.sentMsgs = append(mc.sentMsgs, m)
+	mc.mu.Unlock()
 
 	return &m, nil
 }
 
+// SentMsgs returns copy of messages sent so far, it is safe to call while client is sending.
+func (mc *MockedMBClient) SentMsgs() []mb.Message {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	msgs := make([]mb.Message, len(mc.sentMsgs))
+	copy(msgs, mc.sentMsgs)
+
+	return msgs
+}
+
+type MockedLimitedMBClient struct {
+	MockedMBClient
+	maxSegments int
+}
+
+func (mc *MockedLimitedMBClient) MaxSegments() int {
+	return mc.maxSegments
+}
+
+type MockedTracker struct {
+	Tracker
+	updated *sync.WaitGroup
+	tracked []string
+}
+
+func (mt *MockedTracker) Track(id, tenant string, segments int) error {
+	mt.tracked = append(mt.tracked, id)
+	return mt.Tracker.Track(id, tenant, segments)
+}
+
+func (mt *MockedTracker) Update(id string, segment int, state State, provider, providerID string) error {
+	defer mt.updated.Done()
+	return mt.Tracker.Update(id, segment, state, provider, providerID)
+}
+
+type MockedStore struct {
+	nopStore
+	pending []Msg
+	done    []Msg
+	err     error
+}
+
+func (ms *MockedStore) Done(m Msg) error {
+	ms.done = append(ms.done, m)
+	return nil
+}
+
+func (ms *MockedStore) Put(msgs []Msg) error {
+	return ms.err
+}
+
+func (ms *MockedStore) Pending() ([]Msg, error) {
+	return ms.pending, nil
+}
+
+type MockedRefAllocator uint16
+
+func (r MockedRefAllocator) NextRef(recipient string) uint16 {
+	return uint16(r)
+}
+
+// MockedFlakyMBClient returns errors one by one, and succeeds when they run out.
+type MockedFlakyMBClient struct {
+	mu   sync.Mutex
+	errs []error
+	sent *sync.WaitGroup
+}
+
+func (mc *MockedFlakyMBClient) NewMessage(originator string, recipients []string, body string, msgParams *mb.MessageParams) (*mb.Message, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	defer mc.sent.Done()
+
+	if len(mc.errs) == 0 {
+		return &mb.Message{Id: "mb1"}, nil
+	}
+
+	err := mc.errs[0]
+	mc.errs = mc.errs[1:]
+
+	return &mb.Message{Errors: []mb.Error{{Code: 2, Description: "Request not allowed"}}}, err
+}
+
 type MockedErrorproneMBClient struct{}
 
 func (mec *MockedErrorproneMBClient) NewMessage(originator string, recipients []string, body string, msgParams *mb.MessageParams) (*mb.Message, error) {
@@ -232,3 +990,73 @@ func (mec *MockedErrorproneMBClient) NewMessage(originator string, recipients []
 		Errors: []mb.Error{{Code: 42, Description: "Expected error", Parameter: ""}},
 	}, errors.New("something went wrong")
 }
+
+func TestClientBacksOffWhenThrottled(t *testing.T) {
+	provider := &MockedFailingProvider{err: &SendError{Kind: Throttled, Err: errors.New("too many requests")}}
+	limiter := NewRateLimiter(1000, 1)
+	client := NewClient(provider, 10, time.Hour, WithRateLimiter(limiter), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+
+	id, err := client.SendText("Bank", "380660000000", "Hola")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	waitForState(t, client, id, StateFailed)
+
+	if got := limiter.Limit().EffectiveRate; got != 500 {
+		t.Errorf("Got effective rate: %g, expected: 500", got)
+	}
+}
+
+type MockedBlockingProvider struct {
+	blocked string
+	release chan struct{}
+	sent    chan Msg
+}
+
+func (p *MockedBlockingProvider) Send(m Msg) (string, error) {
+	if m.Recipient == p.blocked {
+		<-p.release
+	}
+	p.sent <- m
+
+	return m.ID, nil
+}
+
+func TestClientWorkersKeepRecipientOrder(t *testing.T) {
+	const workers = 4
+
+	slow, fast := "380660000000", "380660000001"
+	for i := 2; shardOf(fast, workers) == shardOf(slow, workers); i++ {
+		fast = "38066000000" + strconv.Itoa(i)
+	}
+
+	provider := &MockedBlockingProvider{blocked: slow, release: make(chan struct{}), sent: make(chan Msg, 5)}
+	client := NewClient(provider, 10, time.Millisecond, WithWorkers(workers))
+
+	messages := []struct{ recipient, body string }{{slow, "s1"}, {slow, "s2"}, {slow, "s3"}, {fast, "f1"}, {fast, "f2"}}
+	for _, m := range messages {
+		if _, err := client.SendText("Bank", m.recipient, m.body); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+
+	var order []string
+	for len(order) < len(messages) {
+		if len(order) == 2 {
+			// Messages to other recipient are not held up by backlog of slow one.
+			close(provider.release)
+		}
+
+		select {
+		case m := <-provider.sent:
+			order = append(order, m.Body)
+		case <-time.After(time.Second):
+			t.Fatalf("Got only: %v", order)
+		}
+	}
+
+	if expected := []string{"f1", "f2", "s1", "s2", "s3"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Got order: %v, expected: %v", order, expected)
+	}
+}
@@ -0,0 +1,200 @@
+package smsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	mb "github.com/messagebird/go-rest-api"
+)
+
+// defaultHTTPTimeout limits single request to gateway API.
+const defaultHTTPTimeout = 10 * time.Second
+
+// Provider is an SMS gateway. Send submits single SMS with its encoding and UDH, if message has one.
+// Returns gateway message ID or SendError that tells if it makes sense to try again.
+type Provider interface {
+	Send(m Msg) (string, error)
+}
+
+// namedSender is implemented by providers that pass SMS to one of several named gateways.
+// It returns name of gateway that accepted SMS along with its ID, delivery reports are matched by both.
+type namedSender interface {
+	sendNamed(m Msg) (name, id string, err error)
+}
+
+// NativeConcatenator is implemented by providers that split long messages to concatenated SMS themselves
+// and do not accept UDH. Such providers get whole body in a single Msg, segment cap still applies to it.
+type NativeConcatenator interface {
+	NativeConcat() bool
+}
+
+// nativeConcat tells if provider splits long messages itself.
+func nativeConcat(p Provider) bool {
+	n, ok := p.(NativeConcatenator)
+	return ok && n.NativeConcat()
+}
+
+// MessageBirdProvider sends SMS with MessageBird.com API client.
+type MessageBirdProvider struct {
+	mbClient MBClient
+	// SigningKey of account, delivery reports are verified with it and all of them are rejected if it is empty.
+	SigningKey string
+}
+
+// NewMessageBirdProvider wraps MessageBird.com API client into Provider.
+func NewMessageBirdProvider(mbClient MBClient) *MessageBirdProvider {
+	return &MessageBirdProvider{
+		mbClient: mbClient,
+	}
+}
+
+// Send submits SMS to MessageBird.com, UDH is passed in type details.
+func (p *MessageBirdProvider) Send(mr Msg) (string, error) {
+	msgParams := &mb.MessageParams{}
+
+	if mr.Header != nil && mr.Header.IsSet() {
+		details := make(map[string]interface{})
+		details[udhField] = mr.Header.ToHexStr()
+		msgParams.TypeDetails = details
+	}
+
+	msgParams.DataCoding = mr.Encoding.DataCoding()
+
+	m, err := p.mbClient.NewMessage(
+		mr.Originator,
+		[]string{mr.Recipient},
+		mr.Body,
+		msgParams,
+	)
+	if err != nil {
+		return "", classifyMBError(m, err)
+	}
+
+	return m.Id, nil
+}
+
+// MaxSegments returns number of concatenated SMS wrapped client allows, MaxSeqSMSCount by default.
+func (p *MessageBirdProvider) MaxSegments() int {
+	if l, ok := p.mbClient.(SegmentLimiter); ok {
+		return l.MaxSegments()
+	}
+	return MaxSeqSMSCount
+}
+
+// ParseReport verifies MessageBird-Signature of status report and extracts it from query parameters.
+func (p *MessageBirdProvider) ParseReport(req *http.Request) ([]Report, error) {
+	query, err := p.verifyRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	id := query.Get("id")
+	if id == "" {
+		return nil, errReportFormat
+	}
+
+	r := Report{ProviderID: id, Reason: query.Get("statusErrorCode")}
+	switch query.Get("status") {
+	case "delivered":
+		r.State = StateDelivered
+	case "delivery_failed", "expired":
+		r.State = StateFailed
+	default:
+		// Sent and buffered messages are still on their way.
+		r.State = StateSubmitted
+	}
+
+	return []Report{r}, nil
+}
+
+// ParseInbound verifies MessageBird-Signature of incoming message and extracts it from query parameters.
+// MessageBird joins concatenated SMS itself, so message comes whole.
+func (p *MessageBirdProvider) ParseInbound(req *http.Request) ([]InboundPart, error) {
+	query, err := p.verifyRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	part := InboundPart{
+		ProviderID: query.Get("id"),
+		Originator: query.Get("originator"),
+		Recipient:  query.Get("recipient"),
+		Body:       query.Get("body"),
+	}
+	if part.Originator == "" || part.Recipient == "" {
+		return nil, errInboundFormat
+	}
+
+	return []InboundPart{part}, nil
+}
+
+// verifyRequest checks MessageBird-Signature of webhook request and returns its query parameters.
+// Signature is HMAC-SHA256 of request timestamp, sorted query and SHA-256 of body, separated by new lines.
+func (p *MessageBirdProvider) verifyRequest(req *http.Request) (url.Values, error) {
+	body, err := readReportBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := req.Header.Get("MessageBird-Request-Timestamp")
+	if err := checkReportAge(timestamp, time.Now()); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(req.Header.Get("MessageBird-Signature"))
+	if err != nil || p.SigningKey == "" {
+		return nil, ErrSignature
+	}
+
+	query := req.URL.Query()
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(p.SigningKey))
+	mac.Write([]byte(timestamp + "\n" + query.Encode() + "\n"))
+	mac.Write(bodyHash[:])
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrSignature
+	}
+
+	return query, nil
+}
+
+// maxErrorBody limits how much of gateway error response is read and logged.
+const maxErrorBody = 4096
+
+// httpStatusError is a non 2xx response of gateway API.
+type httpStatusError struct {
+	code int
+	body string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("gateway responded with %d: %s", e.code, e.body)
+}
+
+// checkResponse returns SendError if gateway responded with non 2xx code.
+// Rate limited requests are Throttled, server errors are Temporary and other client errors are Permanent.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	err := &httpStatusError{code: resp.StatusCode, body: string(b)}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &SendError{Kind: Throttled, Err: err}
+	case resp.StatusCode >= 500:
+		return &SendError{Kind: Temporary, Err: err}
+	default:
+		return &SendError{Kind: Permanent, Err: err}
+	}
+}
@@ -0,0 +1,159 @@
+package smsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageBirdProviderMaxSegments(t *testing.T) {
+	if max := NewMessageBirdProvider(&MockedMBClient{}).MaxSegments(); max != MaxSeqSMSCount {
+		t.Errorf("Got max segments: %d, expected: %d", max, MaxSeqSMSCount)
+	}
+
+	if max := NewMessageBirdProvider(&MockedLimitedMBClient{maxSegments: 16}).MaxSegments(); max != 16 {
+		t.Errorf("Got max segments: %d, expected: 16", max)
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	cases := []struct {
+		code int
+		ok   bool
+		kind ErrorKind
+	}{
+		{code: http.StatusOK, ok: true},
+		{code: http.StatusCreated, ok: true},
+		{code: http.StatusBadRequest, kind: Permanent},
+		{code: http.StatusUnauthorized, kind: Permanent},
+		{code: http.StatusTooManyRequests, kind: Throttled},
+		{code: http.StatusInternalServerError, kind: Temporary},
+		{code: http.StatusServiceUnavailable, kind: Temporary},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		rec.WriteHeader(c.code)
+
+		err := checkResponse(rec.Result())
+		if c.ok {
+			if err != nil {
+				t.Errorf("Got error: %v for code: %d", err, c.code)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("Got no error for code: %d", c.code)
+			continue
+		}
+		if kind := errorKind(err); kind != c.kind {
+			t.Errorf("Got error kind: %s, expected: %s for code: %d", kind, c.kind, c.code)
+		}
+	}
+}
+
+func TestSendTextPassesWholeBodyToNativeConcatenator(t *testing.T) {
+	provider := &MockedProvider{native: true, sent: make(chan Msg, 10)}
+	client := NewClient(provider, 10, time.Millisecond)
+
+	body := strings.Repeat("m", PlainConcatSMSLen*3)
+	if _, err := client.SendText("Bank", "380660000000", body); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	m := <-provider.sent
+	if m.Body != body {
+		t.Errorf("Got body of %d chars, expected: %d", len(m.Body), len(body))
+	}
+	if m.Header != nil || m.Segments != 1 {
+		t.Errorf("Got header: %v and %d segments, expected message without UDH", m.Header, m.Segments)
+	}
+
+	if _, err := client.SendText("Bank", "380660000000", strings.Repeat("m", PlainConcatSMSLen*MaxSeqSMSCount+1)); err != ErrTooManySegments {
+		t.Errorf("Got error: %v, expected: %v", err, ErrTooManySegments)
+	}
+}
+
+type MockedProvider struct {
+	native bool
+	sent   chan Msg
+}
+
+func (p *MockedProvider) Send(m Msg) (string, error) {
+	p.sent <- m
+	return "provider-id", nil
+}
+
+func (p *MockedProvider) NativeConcat() bool {
+	return p.native
+}
+
+func TestMessageBirdProviderParseReport(t *testing.T) {
+	p := NewMessageBirdProvider(&MockedMBClient{})
+	p.SigningKey = "secret"
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	query := "id=mb1&status=delivery_failed&statusErrorCode=104"
+
+	emptyBody := sha256.Sum256(nil)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "\n" + query + "\n"))
+	mac.Write(emptyBody[:])
+	valid := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	for _, sig := range []string{valid, "bm9wZQ=="} {
+		req := httptest.NewRequest("GET", "/reports/messagebird?"+query, nil)
+		req.Header.Set("MessageBird-Request-Timestamp", timestamp)
+		req.Header.Set("MessageBird-Signature", sig)
+
+		reports, err := p.ParseReport(req)
+		if sig != valid {
+			if err != ErrSignature {
+				t.Errorf("Got error: %v, expected: %v", err, ErrSignature)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		expected := Report{ProviderID: "mb1", State: StateFailed, Reason: "104"}
+		if len(reports) != 1 || reports[0] != expected {
+			t.Errorf("Got reports: %+v, expected: %+v", reports, expected)
+		}
+	}
+}
+
+func TestMessageBirdProviderParseInbound(t *testing.T) {
+	p := NewMessageBirdProvider(&MockedMBClient{})
+	p.SigningKey = "secret"
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	query := "body=STOP&id=mo1&originator=380501234567&recipient=4915112345678"
+
+	emptyBody := sha256.Sum256(nil)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "\n" + query + "\n"))
+	mac.Write(emptyBody[:])
+
+	req := httptest.NewRequest("GET", "/inbound/messagebird?"+query, nil)
+	req.Header.Set("MessageBird-Request-Timestamp", timestamp)
+	req.Header.Set("MessageBird-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	parts, err := p.ParseInbound(req)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	expected := InboundPart{ProviderID: "mo1", Originator: "380501234567", Recipient: "4915112345678", Body: "STOP"}
+	if len(parts) != 1 || parts[0] != expected {
+		t.Errorf("Got parts: %+v, expected: %+v", parts, expected)
+	}
+}
@@ -0,0 +1,286 @@
+package smsd
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Priority is a class of message, higher classes are sent first.
+type Priority string
+
+// Priorities from highest to lowest. Messages without priority are transactional.
+const (
+	PriorityOTP           Priority = "otp"
+	PriorityTransactional Priority = "transactional"
+	PriorityBulk          Priority = "bulk"
+)
+
+// priorities in order they are served.
+var priorities = []Priority{PriorityOTP, PriorityTransactional, PriorityBulk}
+
+// starvationLimit is number of units that can be taken from higher classes in a row while lower class waits.
+const starvationLimit = 10
+
+// rank returns index of priority in priorities, unknown priority is transactional.
+func (p Priority) rank() int {
+	for i, known := range priorities {
+		if p == known {
+			return i
+		}
+	}
+	return 1
+}
+
+type (
+	tenantKey   struct{}
+	priorityKey struct{}
+)
+
+// ContextWithTenant returns copy of ctx that makes messages sent with it belong to tenant.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns tenant of ctx, it is empty if ctx has none.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// ContextWithPriority returns copy of ctx that makes messages sent with it have priority p.
+func ContextWithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFrom returns priority of ctx, it is empty if ctx has none.
+func priorityFrom(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// fairQueue holds units of messages by priority and tenant. Higher priority is served first, but lower class
+// gets a unit after starvationLimit units of higher classes were taken while it waited.
+// Within a class tenants take turns in weighted round-robin order, so backlog of one tenant does not delay others.
+// Every turn tenant can send as many SMS as its weight, unit that does not fit in the rest of the turn is still
+// sent as a whole.
+type fairQueue struct {
+	// slots has a value for every queued unit, it limits size of the queue.
+	slots chan struct{}
+	// ready has a value when unit was added, so taker waiting for one can check again.
+	ready  chan struct{}
+	weight func(tenant string) int
+
+	mu    sync.Mutex
+	lanes []lane
+}
+
+// lane is a queue of one priority class.
+type lane struct {
+	units map[string][][]Msg
+	// active tenants that have queued units in round order, first one has its turn.
+	active []string
+	// credit is number of SMS first active tenant can still send in its turn.
+	credit int
+	// passed is number of units taken from higher classes since lane was served.
+	passed int
+	// queued is number of SMS in lane.
+	queued int
+}
+
+func newFairQueue(size int) *fairQueue {
+	q := &fairQueue{
+		slots:  make(chan struct{}, size),
+		ready:  make(chan struct{}, 1),
+		weight: func(string) int { return 1 },
+		lanes:  make([]lane, len(priorities)),
+	}
+
+	for i := range q.lanes {
+		q.lanes[i].units = make(map[string][][]Msg)
+	}
+
+	return q
+}
+
+// push adds unit to the queue of its priority and tenant. ErrQueueFull is returned if there was no room for it
+// before ctx was done, ErrClosed if closing is closed first.
+func (q *fairQueue) push(ctx context.Context, unit []Msg, closing <-chan struct{}) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ErrQueueFull
+	case <-closing:
+		return ErrClosed
+	}
+
+	q.mu.Lock()
+	q.lanes[unit[0].Priority.rank()].push(unit)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// take returns next unit, it returns false if queue is empty.
+func (q *fairQueue) take() ([]Msg, bool) {
+	return q.takeUnless(nil)
+}
+
+// takeUnless returns next unit that skip does not reject, it returns false if there is no such unit.
+// Skipped units keep their place, so the next lane or tenant is served instead.
+func (q *fairQueue) takeUnless(skip func(unit []Msg) bool) ([]Msg, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Starving lane is tried first, then lanes from highest priority.
+	order := make([]int, 0, len(q.lanes)+1)
+	for i := range q.lanes {
+		if len(q.lanes[i].active) != 0 && q.lanes[i].passed >= starvationLimit {
+			order = append(order, i)
+			break
+		}
+	}
+	for i := range q.lanes {
+		order = append(order, i)
+	}
+
+	for _, pick := range order {
+		if len(q.lanes[pick].active) == 0 {
+			continue
+		}
+
+		unit, ok := q.lanes[pick].take(q.weight, skip)
+		if !ok {
+			continue
+		}
+
+		q.lanes[pick].passed = 0
+		for i := pick + 1; i < len(q.lanes); i++ {
+			if len(q.lanes[i].active) != 0 {
+				q.lanes[i].passed++
+			}
+		}
+
+		<-q.slots
+
+		return unit, true
+	}
+
+	return nil, false
+}
+
+// len returns number of queued units.
+func (q *fairQueue) len() int {
+	return len(q.slots)
+}
+
+// depth returns number of queued SMS by priority.
+func (q *fairQueue) depth() map[Priority]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	depth := make(map[Priority]int, len(q.lanes))
+	for i, p := range priorities {
+		depth[p] = q.lanes[i].queued
+	}
+
+	return depth
+}
+
+func (l *lane) push(unit []Msg) {
+	tenant := unit[0].Tenant
+	if len(l.units[tenant]) == 0 {
+		l.active = append(l.active, tenant)
+	}
+	l.units[tenant] = append(l.units[tenant], unit)
+	l.queued += len(unit)
+}
+
+// take returns unit of tenant that has its turn, lane must not be empty. Tenants before the first one
+// that has a unit skip does not reject lose their turn. It returns false if skip rejects every unit.
+func (l *lane) take(weight func(tenant string) int, skip func(unit []Msg) bool) ([]Msg, bool) {
+	turn, pos := l.find(skip)
+	if turn < 0 {
+		return nil, false
+	}
+	if turn > 0 {
+		l.active = append(append([]string(nil), l.active[turn:]...), l.active[:turn]...)
+		l.credit = 0
+	}
+
+	tenant := l.active[0]
+	if l.credit <= 0 {
+		// Turn of tenant starts.
+		l.credit = weight(tenant)
+		if l.credit < 1 {
+			l.credit = 1
+		}
+	}
+
+	units := l.units[tenant]
+	unit := units[pos]
+	copy(units[pos:], units[pos+1:])
+	units[len(units)-1] = nil
+	units = units[:len(units)-1]
+	l.credit -= len(unit)
+	l.queued -= len(unit)
+
+	switch {
+	case len(units) == 0:
+		delete(l.units, tenant)
+		l.active = l.active[1:]
+		l.credit = 0
+	case l.credit <= 0:
+		l.units[tenant] = units
+		l.active = append(l.active[1:], tenant)
+	default:
+		l.units[tenant] = units
+	}
+
+	return unit, true
+}
+
+// find returns index of first active tenant that has a unit skip does not reject and index of that unit,
+// both are -1 if there is no such unit.
+func (l *lane) find(skip func(unit []Msg) bool) (int, int) {
+	for i, tenant := range l.active {
+		for j, unit := range l.units[tenant] {
+			if skip == nil || !skip(unit) {
+				return i, j
+			}
+		}
+	}
+	return -1, -1
+}
+
+// QueueReporter declares method that returns number of queued SMS by priority.
+type QueueReporter interface {
+	QueueDepth() map[Priority]int
+}
+
+// QueueHandler shows queue over HTTP.
+type QueueHandler struct {
+	queue QueueReporter
+}
+
+// NewQueueHandler constructs QueueHandler for provided queue.
+func NewQueueHandler(q QueueReporter) *QueueHandler {
+	return &QueueHandler{
+		queue: q,
+	}
+}
+
+// HandleQueue returns number of queued SMS by priority on GET.
+func (h *QueueHandler) HandleQueue(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.queue.QueueDepth())
+}
@@ -0,0 +1,213 @@
+package smsd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFairQueueSharesTurns(t *testing.T) {
+	q := newFairQueue(10)
+	q.weight = func(tenant string) int {
+		if tenant == "billing" {
+			return 2
+		}
+		return 1
+	}
+
+	push := func(tenant, id string, parts int) {
+		unit := make([]Msg, parts)
+		for i := range unit {
+			unit[i] = Msg{ID: id, Segment: i + 1, Tenant: tenant}
+		}
+		if err := q.push(context.Background(), unit, nil); err != nil {
+			t.Fatal("Failed to push unit:", err)
+		}
+	}
+
+	push("shop", "s1", 1)
+	push("shop", "s2", 1)
+	push("shop", "s3", 1)
+	push("billing", "b1", 1)
+	push("billing", "b2", 1)
+	push("billing", "b3", 1)
+	push("billing", "b4", 3)
+	push("billing", "b5", 1)
+	push("", "x1", 1)
+
+	var order []string
+	for {
+		unit, ok := q.take()
+		if !ok {
+			break
+		}
+		order = append(order, unit[0].ID)
+	}
+
+	// Three part unit is sent whole even though billing has one SMS left in its turn.
+	expected := []string{"s1", "b1", "b2", "x1", "s2", "b3", "b4", "s3", "b5"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Got order: %v, expected: %v", order, expected)
+	}
+
+	if q.len() != 0 {
+		t.Errorf("Got %d units in queue, expected none", q.len())
+	}
+}
+
+func TestFairQueueIsLimited(t *testing.T) {
+	q := newFairQueue(1)
+
+	if err := q.push(context.Background(), []Msg{{ID: "1"}}, nil); err != nil {
+		t.Fatal("Failed to push unit:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := q.push(ctx, []Msg{{ID: "2"}}, nil); err != ErrQueueFull {
+		t.Errorf("Got error: %v, expected: %v", err, ErrQueueFull)
+	}
+
+	closing := make(chan struct{})
+	close(closing)
+	if err := q.push(context.Background(), []Msg{{ID: "2"}}, closing); err != ErrClosed {
+		t.Errorf("Got error: %v, expected: %v", err, ErrClosed)
+	}
+}
+
+func TestFairQueueSkipsUnits(t *testing.T) {
+	q := newFairQueue(10)
+
+	push := func(tenant string, p Priority, id, recipient string) {
+		unit := []Msg{{ID: id, Tenant: tenant, Priority: p, Recipient: recipient}}
+		if err := q.push(context.Background(), unit, nil); err != nil {
+			t.Fatal("Failed to push unit:", err)
+		}
+	}
+
+	push("shop", "", "s1", "busy")
+	push("shop", "", "s2", "idle")
+	push("billing", "", "b1", "busy")
+	push("", PriorityOTP, "o1", "busy")
+	push("", PriorityBulk, "x1", "idle")
+
+	skip := func(unit []Msg) bool { return unit[0].Recipient == "busy" }
+
+	var order []string
+	for {
+		unit, ok := q.takeUnless(skip)
+		if !ok {
+			break
+		}
+		order = append(order, unit[0].ID)
+	}
+
+	// Units of busy recipient keep their place and do not hold up units of lower priority.
+	if expected := []string{"s2", "x1"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Got order: %v, expected: %v", order, expected)
+	}
+
+	order = nil
+	for {
+		unit, ok := q.take()
+		if !ok {
+			break
+		}
+		order = append(order, unit[0].ID)
+	}
+
+	if expected := []string{"o1", "b1", "s1"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Got order: %v, expected: %v", order, expected)
+	}
+}
+
+func TestSendTextContextKeepsTenant(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 10, time.Hour)
+
+	client.SendTextContext(ContextWithTenant(context.Background(), "billing"), "Bank", "380660000000", "Hi")
+
+	if unit, _ := client.queue.take(); len(unit) != 1 || unit[0].Tenant != "billing" {
+		t.Errorf("Got unit: %+v", unit)
+	}
+}
+
+func TestFairQueueServesPriorities(t *testing.T) {
+	q := newFairQueue(20)
+
+	push := func(p Priority, id string) {
+		if err := q.push(context.Background(), []Msg{{ID: id, Priority: p}}, nil); err != nil {
+			t.Fatal("Failed to push unit:", err)
+		}
+	}
+
+	push(PriorityBulk, "b1")
+	push(PriorityBulk, "b2")
+	push("", "t1")
+	for i := 1; i <= 12; i++ {
+		push(PriorityOTP, "o"+strconv.Itoa(i))
+	}
+
+	expected := map[Priority]int{PriorityOTP: 12, PriorityTransactional: 1, PriorityBulk: 2}
+	if depth := q.depth(); !reflect.DeepEqual(depth, expected) {
+		t.Errorf("Got depth: %v, expected: %v", depth, expected)
+	}
+
+	var order []string
+	for {
+		unit, ok := q.take()
+		if !ok {
+			break
+		}
+		order = append(order, unit[0].ID)
+	}
+
+	// Lower classes get a unit after ten units of higher ones.
+	expectedOrder := []string{"o1", "o2", "o3", "o4", "o5", "o6", "o7", "o8", "o9", "o10", "t1", "b1", "o11", "o12", "b2"}
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Errorf("Got order: %v, expected: %v", order, expectedOrder)
+	}
+}
+
+func TestSendTextContextKeepsPriority(t *testing.T) {
+	client := NewMsgBirdClient(&MockedMBClient{}, 10, time.Hour)
+
+	client.SendText("Bank", "380660000000", "Bulk")
+	client.SendTextContext(ContextWithPriority(context.Background(), PriorityOTP), "Bank", "380660000000", "OTP")
+
+	expected := map[Priority]int{PriorityOTP: 1, PriorityTransactional: 1, PriorityBulk: 0}
+	if depth := client.QueueDepth(); !reflect.DeepEqual(depth, expected) {
+		t.Errorf("Got depth: %v, expected: %v", depth, expected)
+	}
+
+	if unit, _ := client.queue.take(); len(unit) != 1 || unit[0].Body != "OTP" {
+		t.Errorf("Got unit: %+v, expected OTP message first", unit)
+	}
+}
+
+func TestHandleQueue(t *testing.T) {
+	reporter := &MockedQueueReporter{depth: map[Priority]int{PriorityOTP: 0, PriorityTransactional: 1, PriorityBulk: 2}}
+
+	rec := httptest.NewRecorder()
+	NewQueueHandler(reporter).HandleQueue(rec, httptest.NewRequest("GET", "/admin/queue", nil))
+
+	var depth map[Priority]int
+	if err := json.NewDecoder(rec.Body).Decode(&depth); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if !reflect.DeepEqual(depth, reporter.depth) {
+		t.Errorf("Got depth: %v, expected: %v", depth, reporter.depth)
+	}
+}
+
+type MockedQueueReporter struct {
+	depth map[Priority]int
+}
+
+func (r *MockedQueueReporter) QueueDepth() map[Priority]int {
+	return r.depth
+}
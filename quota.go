@@ -0,0 +1,141 @@
+package smsd
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned for request of API key that sends messages faster than its rate.
+	ErrRateLimited = errors.New("rate limit of API key is exceeded")
+	// ErrQuotaExceeded is returned for request of API key that sent all SMS of its daily or monthly quota.
+	ErrQuotaExceeded = errors.New("SMS quota of API key is exceeded")
+)
+
+// Limits of API key, zero value of field means there is no limit.
+type Limits struct {
+	// Rate is number of messages per second, Burst is number of messages that can be sent at once.
+	// Default burst is rate rounded up.
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	// DailySegments and MonthlySegments limit number of SMS per calendar day and month in UTC.
+	DailySegments   int `json:"daily_segments,omitempty"`
+	MonthlySegments int `json:"monthly_segments,omitempty"`
+}
+
+// validate returns static error if limits are not valid.
+func (l Limits) validate() error {
+	if l.Rate < 0 || l.Burst < 0 || l.DailySegments < 0 || l.MonthlySegments < 0 {
+		return errors.New("limits can not be negative")
+	}
+	return nil
+}
+
+// QuotaLimiter declares methods that account messages of API keys.
+type QuotaLimiter interface {
+	// Allow counts message of segments SMS, it returns ErrRateLimited or ErrQuotaExceeded with how long
+	// to wait if key can not send it now.
+	Allow(k APIKey, segments int) (time.Duration, error)
+	// Refund returns SMS of message that was allowed but not sent to quota of key.
+	Refund(k APIKey, segments int)
+}
+
+// Quotas keeps usage of API keys in memory, so counters start over on restart.
+type Quotas struct {
+	mu    sync.Mutex
+	usage map[string]*keyUsage
+	now   func() time.Time
+}
+
+// keyUsage is a rate of key and number of SMS it sent in current day and month.
+type keyUsage struct {
+	bucket *tokenBucket
+
+	day           time.Time
+	daySegments   int
+	month         time.Time
+	monthSegments int
+}
+
+// NewQuotas creates empty Quotas.
+func NewQuotas() *Quotas {
+	return &Quotas{
+		usage: make(map[string]*keyUsage),
+		now:   time.Now,
+	}
+}
+
+// Allow counts message of segments SMS if it is within limits of key.
+// Message that is over quota does not use rate of key.
+func (q *Quotas) Allow(k APIKey, segments int) (time.Duration, error) {
+	now := q.now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.usage[k.ID]
+	if !ok {
+		u = &keyUsage{}
+		q.usage[k.ID] = u
+	}
+	if !u.day.Equal(day) {
+		u.day, u.daySegments = day, 0
+	}
+	if !u.month.Equal(month) {
+		u.month, u.monthSegments = month, 0
+	}
+
+	if l := k.Limits.DailySegments; l > 0 && u.daySegments+segments > l {
+		return day.AddDate(0, 0, 1).Sub(now), ErrQuotaExceeded
+	}
+	if l := k.Limits.MonthlySegments; l > 0 && u.monthSegments+segments > l {
+		return month.AddDate(0, 1, 0).Sub(now), ErrQuotaExceeded
+	}
+
+	if rate := k.Limits.Rate; rate > 0 {
+		burst := k.Limits.Burst
+		if burst == 0 {
+			burst = int(math.Ceil(rate))
+		}
+
+		if u.bucket == nil {
+			u.bucket = newTokenBucket(rate, burst, now)
+		} else {
+			// Limits could be changed since last message.
+			u.bucket.setLimit(rate, burst)
+		}
+
+		if wait, ok := u.bucket.take(1, now); !ok {
+			return wait, ErrRateLimited
+		}
+	}
+
+	u.daySegments += segments
+	u.monthSegments += segments
+
+	return 0, nil
+}
+
+// Refund subtracts segments from SMS key sent. Rate is not refunded, message was still sent to the service.
+func (q *Quotas) Refund(k APIKey, segments int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.usage[k.ID]
+	if !ok {
+		return
+	}
+
+	u.daySegments -= segments
+	u.monthSegments -= segments
+	if u.daySegments < 0 {
+		u.daySegments = 0
+	}
+	if u.monthSegments < 0 {
+		u.monthSegments = 0
+	}
+}
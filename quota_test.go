@@ -0,0 +1,74 @@
+package smsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotasLimitRate(t *testing.T) {
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.UTC)
+	q := NewQuotas()
+	q.now = func() time.Time { return now }
+
+	k := APIKey{ID: "billing", Limits: Limits{Rate: 2}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.Allow(k, 1); err != nil {
+			t.Fatalf("Message %d is not allowed: %v", i+1, err)
+		}
+	}
+
+	wait, err := q.Allow(k, 1)
+	if err != ErrRateLimited || wait != 500*time.Millisecond {
+		t.Errorf("Got wait: %s, error: %v, expected: %s, %v", wait, err, 500*time.Millisecond, ErrRateLimited)
+	}
+
+	// Other keys have their own rate.
+	if _, err := q.Allow(APIKey{ID: "shop", Limits: Limits{Rate: 2}}, 1); err != nil {
+		t.Errorf("Message of other key is not allowed: %v", err)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if _, err := q.Allow(k, 1); err != nil {
+		t.Errorf("Message is not allowed after wait: %v", err)
+	}
+}
+
+func TestQuotasLimitSegments(t *testing.T) {
+	now := time.Date(2017, 9, 30, 23, 0, 0, 0, time.UTC)
+	q := NewQuotas()
+	q.now = func() time.Time { return now }
+
+	k := APIKey{ID: "billing", Limits: Limits{DailySegments: 3, MonthlySegments: 5}}
+
+	if _, err := q.Allow(k, 3); err != nil {
+		t.Fatal("Message is not allowed:", err)
+	}
+
+	wait, err := q.Allow(k, 1)
+	if err != ErrQuotaExceeded || wait != time.Hour {
+		t.Errorf("Got wait: %s, error: %v, expected: %s, %v", wait, err, time.Hour, ErrQuotaExceeded)
+	}
+
+	// Refunded SMS can be sent again.
+	q.Refund(k, 2)
+	if _, err := q.Allow(k, 2); err != nil {
+		t.Errorf("Refunded SMS are not allowed: %v", err)
+	}
+
+	// Day and month start over.
+	now = now.Add(time.Hour)
+	if _, err := q.Allow(k, 3); err != nil {
+		t.Errorf("Message is not allowed in new month: %v", err)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if _, err := q.Allow(k, 2); err != nil {
+		t.Errorf("Message is not allowed in new day: %v", err)
+	}
+
+	wait, err = q.Allow(k, 1)
+	if err != ErrQuotaExceeded || wait != 30*24*time.Hour {
+		t.Errorf("Got wait: %s, error: %v, expected: %s, %v", wait, err, 30*24*time.Hour, ErrQuotaExceeded)
+	}
+}
@@ -0,0 +1,252 @@
+package smsd
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate events per second on average and up to burst of them at once.
+// It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates bucket that is full, burst is at least one token.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := &tokenBucket{last: now}
+	b.setLimit(rate, burst)
+	b.tokens = b.burst
+
+	return b
+}
+
+// setLimit changes rate and burst, tokens that do not fit in new burst are dropped.
+func (b *tokenBucket) setLimit(rate float64, burst int) {
+	b.rate = rate
+	b.burst = math.Max(1, float64(burst))
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// refill adds tokens accumulated since last call.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// take removes n tokens if bucket has them, otherwise it returns false and how long it takes to get them.
+func (b *tokenBucket) take(n float64, now time.Time) (time.Duration, bool) {
+	b.refill(now)
+
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	if b.rate <= 0 {
+		return time.Duration(math.MaxInt64), false
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+const (
+	// minRateFactor is the lowest share of configured rate limiter backs off to.
+	minRateFactor = 1.0 / 64
+	// rateRecoveryStep is share of configured rate that every SMS accepted by gateway gives back.
+	rateRecoveryStep = 0.02
+	// throttleInterval is how often throttling can halve the rate, so burst of rejections counts once.
+	throttleInterval = time.Second
+)
+
+// RateLimit is configured rate of RateLimiter and rate it actually allows.
+type RateLimit struct {
+	// Rate is number of SMS per second, Burst is number of SMS that can be sent at once.
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// EffectiveRate is lower than Rate while limiter backs off from throttling gateway.
+	EffectiveRate float64 `json:"effective_rate"`
+}
+
+// RateLimiter is a token bucket that limits rate SMS are sent with. Limit can be changed while SMS are sent.
+// When gateway throttles it rate is halved, every SMS that gateway accepts after that brings it back a bit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	factor float64
+	bucket *tokenBucket
+	// changed is closed when limit changes, so waiters do not sleep by old rate.
+	changed     chan struct{}
+	throttledAt time.Time
+	now         func() time.Time
+}
+
+// NewRateLimiter creates limiter that allows rate SMS per second and burst of them at once.
+// Limiter starts empty, it does not know how many SMS were sent just before it was created.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	l := &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		factor:  1,
+		changed: make(chan struct{}),
+		now:     time.Now,
+	}
+
+	l.bucket = newTokenBucket(rate, burst, l.now())
+	l.bucket.tokens = 0
+
+	return l
+}
+
+// Limit returns current limit.
+func (l *RateLimiter) Limit() RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return RateLimit{Rate: l.rate, Burst: l.burst, EffectiveRate: l.rate * l.factor}
+}
+
+// SetLimit changes rate and burst, SMS that are waiting are sent by new limit.
+func (l *RateLimiter) SetLimit(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate, l.burst = rate, burst
+	l.apply()
+}
+
+// interval returns time between SMS sent with effective rate.
+func (l *RateLimiter) interval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return time.Duration(math.Round(float64(time.Second) / (l.rate * l.factor)))
+}
+
+// throttled halves effective rate and drops saved tokens, gateway is not going to accept burst.
+func (l *RateLimiter) throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.throttledAt) < throttleInterval {
+		return
+	}
+	l.throttledAt = now
+
+	l.factor = math.Max(minRateFactor, l.factor/2)
+	l.bucket.refill(now)
+	l.bucket.tokens = 0
+	l.apply()
+
+	log.Printf("Gateway throttles, sending rate is lowered to %.3g SMS per second.\n", l.rate*l.factor)
+}
+
+// accepted brings effective rate closer to configured one.
+func (l *RateLimiter) accepted() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.factor == 1 {
+		return
+	}
+
+	l.factor = math.Min(1, l.factor+rateRecoveryStep)
+	l.apply()
+}
+
+// apply updates bucket with effective limit and wakes up waiters. Caller has to hold the lock.
+func (l *RateLimiter) apply() {
+	burst := int(float64(l.burst) * l.factor)
+
+	l.bucket.refill(l.now())
+	l.bucket.setLimit(l.rate*l.factor, burst)
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// wait blocks until SMS can be sent, it returns false if interrupt is closed first.
+func (l *RateLimiter) wait(interrupt <-chan struct{}) bool {
+	for {
+		l.mu.Lock()
+		d, ok := l.bucket.take(1, l.now())
+		changed := l.changed
+		l.mu.Unlock()
+
+		if ok {
+			return true
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-changed:
+			t.Stop()
+		case <-interrupt:
+			t.Stop()
+			return false
+		}
+	}
+}
+
+// RateController declares methods that read and change sending rate.
+type RateController interface {
+	Limit() RateLimit
+	SetLimit(rate float64, burst int)
+}
+
+// RateHandler changes sending rate over HTTP.
+type RateHandler struct {
+	limiter RateController
+}
+
+// NewRateHandler constructs RateHandler for provided limiter.
+func NewRateHandler(l RateController) *RateHandler {
+	return &RateHandler{
+		limiter: l,
+	}
+}
+
+// rateRequest is a body of request that changes sending rate.
+type rateRequest struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// HandleRate returns current limit on GET and changes it on PUT with JSON body that has rate and burst.
+// Burst is 1 if it is not set.
+func (h *RateHandler) HandleRate(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, h.limiter.Limit())
+	case "PUT":
+		var rr rateRequest
+		if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+			http.Error(w, "request body is not valid", http.StatusBadRequest)
+			return
+		}
+		if rr.Burst == 0 {
+			rr.Burst = 1
+		}
+		if rr.Rate <= 0 || rr.Burst < 0 {
+			http.Error(w, "rate and burst have to be positive", http.StatusBadRequest)
+			return
+		}
+
+		h.limiter.SetLimit(rr.Rate, rr.Burst)
+		log.Printf("Sending rate is set to %.3g SMS per second with burst of %d.\n", rr.Rate, rr.Burst)
+
+		writeJSON(w, http.StatusOK, h.limiter.Limit())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,125 @@
+package smsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.UTC)
+	b := newTokenBucket(2, 3, now)
+
+	for i := 0; i < 3; i++ {
+		if _, ok := b.take(1, now); !ok {
+			t.Fatalf("Token %d of burst is not taken", i+1)
+		}
+	}
+
+	wait, ok := b.take(1, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Got wait: %s, taken: %t, expected: %s", wait, ok, 500*time.Millisecond)
+	}
+
+	// Bucket does not fill over burst.
+	now = now.Add(time.Hour)
+	if _, ok := b.take(4, now); ok {
+		t.Error("Took more tokens than burst")
+	}
+	if _, ok := b.take(3, now); !ok {
+		t.Error("Bucket is not full after an hour")
+	}
+
+	b.setLimit(0, 0)
+	if wait, ok := b.take(1, now.Add(time.Hour)); ok || wait <= 0 {
+		t.Errorf("Got wait: %s, taken: %t from bucket with zero rate", wait, ok)
+	}
+}
+
+func TestRateLimiterBacksOffWhenThrottled(t *testing.T) {
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(8, 4)
+	l.now = func() time.Time { return now }
+
+	l.throttled()
+	l.throttled() // Same burst of rejections.
+	if got := l.Limit(); got.EffectiveRate != 4 || got.Rate != 8 {
+		t.Errorf("Got limit: %+v, expected effective rate: 4", got)
+	}
+
+	now = now.Add(throttleInterval)
+	l.throttled()
+	if got := l.Limit().EffectiveRate; got != 2 {
+		t.Errorf("Got effective rate: %g, expected: 2", got)
+	}
+	if d := l.interval(); d != 500*time.Millisecond {
+		t.Errorf("Got interval: %s, expected: %s", d, 500*time.Millisecond)
+	}
+
+	for i := 0; i < 100; i++ {
+		l.accepted()
+	}
+	if got := l.Limit().EffectiveRate; got != 8 {
+		t.Errorf("Got effective rate: %g, expected it to recover to 8", got)
+	}
+}
+
+func TestRateLimiterWaitsForNewLimit(t *testing.T) {
+	l := NewRateLimiter(1.0/3600, 1)
+
+	done := make(chan bool)
+	go func() {
+		done <- l.wait(nil)
+	}()
+
+	l.SetLimit(1000, 1)
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Wait is interrupted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait does not use new limit")
+	}
+
+	interrupt := make(chan struct{})
+	close(interrupt)
+	l.SetLimit(1.0/3600, 1)
+	if l.wait(interrupt) {
+		t.Error("Wait is not interrupted")
+	}
+}
+
+func TestHandleRate(t *testing.T) {
+	l := NewRateLimiter(1, 1)
+	h := NewRateHandler(l)
+
+	for _, invalid := range []string{`{"rate": 0}`, `{"rate": 5, "burst": -1}`, `{`} {
+		rec := httptest.NewRecorder()
+		h.HandleRate(rec, httptest.NewRequest("PUT", "/admin/rate", strings.NewReader(invalid)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Got status: %d, expected: %d for %s", rec.Code, http.StatusBadRequest, invalid)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.HandleRate(rec, httptest.NewRequest("PUT", "/admin/rate", strings.NewReader(`{"rate": 5, "burst": 10}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleRate(rec, httptest.NewRequest("GET", "/admin/rate", nil))
+
+	var got RateLimit
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if expected := (RateLimit{Rate: 5, Burst: 10, EffectiveRate: 5}); got != expected {
+		t.Errorf("Got limit: %+v, expected: %+v", got, expected)
+	}
+}
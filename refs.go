@@ -0,0 +1,121 @@
+package smsd
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RefAllocator hands out CSMS reference numbers for concatenated messages.
+// Parts of two long messages to the same handset will be mixed up if they share reference number.
+type RefAllocator interface {
+	NextRef(recipient string) uint16
+}
+
+// rotatingRefs is a single counter shared by all recipients.
+type rotatingRefs struct {
+	mu   sync.Mutex
+	next uint16
+}
+
+// NewRotatingRefs creates RefAllocator with one global counter that wraps around.
+// Counter starts from random value, so references are not reused right after restart.
+func NewRotatingRefs() RefAllocator {
+	return &rotatingRefs{
+		next: randomRef(),
+	}
+}
+
+// NextRef returns next reference number, recipient is ignored.
+func (a *rotatingRefs) NextRef(recipient string) uint16 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.next++
+	return a.next
+}
+
+// DefaultRefTTL is how long recipientRefs keeps counter of recipient after its last message.
+// Handsets drop parts of concatenated message that did not arrive in full much sooner.
+const DefaultRefTTL = 24 * time.Hour
+
+// recipientRefs keeps separate counter per recipient.
+type recipientRefs struct {
+	mu     sync.Mutex
+	next   map[string]recipientRef
+	ttl    time.Duration
+	pruned time.Time
+	now    func() time.Time
+}
+
+// recipientRef is last reference number of recipient and time it was handed out.
+type recipientRef struct {
+	num  uint16
+	used time.Time
+}
+
+// NewRecipientRefs creates RefAllocator with counter per recipient that is kept for DefaultRefTTL.
+func NewRecipientRefs() RefAllocator {
+	return NewRecipientRefsTTL(DefaultRefTTL)
+}
+
+// NewRecipientRefsTTL creates RefAllocator with counter per recipient.
+// Counter is forgotten when recipient got no messages for ttl, so memory does not grow with every recipient ever seen.
+func NewRecipientRefsTTL(ttl time.Duration) RefAllocator {
+	return &recipientRefs{
+		next: make(map[string]recipientRef),
+		ttl:  ttl,
+		now:  time.Now,
+	}
+}
+
+// NextRef returns next reference number for recipient.
+func (a *recipientRefs) NextRef(recipient string) uint16 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	a.prune(now)
+
+	ref, ok := a.next[recipient]
+	if !ok {
+		ref.num = randomRef()
+	}
+	ref.num++
+	ref.used = now
+	a.next[recipient] = ref
+
+	return ref.num
+}
+
+// prune forgets counters of recipients that got no messages for ttl. Caller has to hold the lock.
+func (a *recipientRefs) prune(now time.Time) {
+	if now.Sub(a.pruned) < time.Minute {
+		return
+	}
+	a.pruned = now
+
+	for recipient, ref := range a.next {
+		if now.Sub(ref.used) > a.ttl {
+			delete(a.next, recipient)
+		}
+	}
+}
+
+func randomRef() uint16 {
+	return uint16(rand.New(rand.NewSource(time.Now().UnixNano())).Intn(1 << 16))
+}
+
+// concatRef is reference number of concatenated message and width of header field that holds it.
+type concatRef struct {
+	num  uint16
+	wide bool
+}
+
+// header constructs UDH for a part of concatenated message.
+func (r concatRef) header(total, current byte) (Header, error) {
+	if r.wide {
+		return NewUDH16(r.num, total, current)
+	}
+	return NewRefUDH(byte(r.num), total, current)
+}
@@ -0,0 +1,71 @@
+package smsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotatingRefs(t *testing.T) {
+	refs := NewRotatingRefs()
+
+	first := refs.NextRef("380660000000")
+	second := refs.NextRef("380660000001")
+
+	if second != first+1 {
+		t.Errorf("Got references %d and %d, expected them to follow each other", first, second)
+	}
+}
+
+func TestRecipientRefs(t *testing.T) {
+	refs := NewRecipientRefs()
+
+	seen := make(map[uint16]bool)
+	for i := 0; i < 1<<8; i++ {
+		ref := refs.NextRef("380660000000")
+		if seen[ref] {
+			t.Fatalf("Reference %d was reused after %d messages", ref, i)
+		}
+		seen[ref] = true
+	}
+
+	// Counter of other recipient is not affected.
+	a := refs.NextRef("380660000001")
+	b := refs.NextRef("380660000001")
+	if b != a+1 {
+		t.Errorf("Got references %d and %d, expected them to follow each other", a, b)
+	}
+}
+
+func TestRecipientRefsForgetsIdleRecipients(t *testing.T) {
+	refs := NewRecipientRefsTTL(time.Hour).(*recipientRefs)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	refs.now = func() time.Time { return now }
+
+	refs.NextRef("380660000000")
+
+	now = now.Add(30 * time.Minute)
+	refs.NextRef("380660000001")
+
+	now = now.Add(45 * time.Minute)
+	refs.NextRef("380660000001")
+
+	if _, ok := refs.next["380660000000"]; ok {
+		t.Error("Counter of idle recipient is kept")
+	}
+	if _, ok := refs.next["380660000001"]; !ok {
+		t.Error("Counter of active recipient is forgotten")
+	}
+}
+
+func TestConcatRefHeader(t *testing.T) {
+	narrow := mustHeader(concatRef{num: 0x0102}.header(2, 1))
+	if narrow != mustHeader(NewRefUDH(0x02, 2, 1)) {
+		t.Errorf("Header is: %q, expected 8-bit reference header", narrow.ToHexStr())
+	}
+
+	wide := mustHeader(concatRef{num: 0x0102, wide: true}.header(2, 1))
+	if wide != mustHeader(NewUDH16(0x0102, 2, 1)) {
+		t.Errorf("Header is: %q, expected 16-bit reference header", wide.ToHexStr())
+	}
+}
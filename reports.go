@@ -0,0 +1,109 @@
+package smsd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxReportBody limits how much of delivery report request is read.
+	maxReportBody = 64 * 1024
+	// maxReportAge is how old signed report timestamp can be, older ones may be replayed.
+	maxReportAge = 5 * time.Minute
+)
+
+var (
+	// ErrSignature is returned for delivery report that is not signed by gateway.
+	ErrSignature = errors.New("report signature is not valid")
+	// errReportFormat is returned for delivery report that can not be parsed.
+	errReportFormat = errors.New("report is malformed")
+)
+
+// ReportParser is implemented by gateways that send delivery reports to webhook.
+// ParseReport verifies that request is signed by gateway and extracts reports from it.
+type ReportParser interface {
+	ParseReport(req *http.Request) ([]Report, error)
+}
+
+// Reporter declares method that applies delivery report to status of message.
+type Reporter interface {
+	Report(r Report) error
+}
+
+// ReportHandler accepts delivery report callbacks of gateways.
+type ReportHandler struct {
+	reporter Reporter
+	parsers  map[string]ReportParser
+}
+
+// NewReportHandler creates handler of delivery reports, parsers are mapped by gateway name.
+func NewReportHandler(r Reporter, parsers map[string]ReportParser) *ReportHandler {
+	return &ReportHandler{
+		reporter: r,
+		parsers:  parsers,
+	}
+}
+
+// HandleReport accepts GET and POST requests with delivery reports, last element of URL path is gateway name.
+// Reports about unknown messages are acknowledged anyway, so gateway does not send them again.
+// Reporter keeps them for a while, gateway may report SMS before it answers with its ID.
+func (h *ReportHandler) HandleReport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Base(req.URL.Path)
+	parser, ok := h.parsers[name]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	reports, err := parser.ParseReport(req)
+	if err == ErrSignature {
+		log.Printf("Rejected delivery report of %s from %s: %s\n", name, req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to parse delivery report of %s, error: %s\n", name, err)
+		http.Error(w, errReportFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, r := range reports {
+		r.Provider = name
+		if err := h.reporter.Report(r); err != nil {
+			log.Printf("Failed to apply delivery report of %s for %s, error: %s\n", name, r.ProviderID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// readReportBody reads request body up to maxReportBody.
+func readReportBody(req *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(req.Body, maxReportBody))
+}
+
+// checkReportAge returns ErrSignature if unix timestamp is not recent.
+func checkReportAge(timestamp string, now time.Time) error {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrSignature
+	}
+
+	age := now.Sub(time.Unix(secs, 0))
+	if age > maxReportAge || age < -maxReportAge {
+		return ErrSignature
+	}
+
+	return nil
+}
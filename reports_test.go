@@ -0,0 +1,69 @@
+package smsd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleReport(t *testing.T) {
+	cases := []struct {
+		method  string
+		url     string
+		reports []Report
+		err     error
+		code    int
+		applied int
+	}{
+		{method: "POST", url: "/reports/mock", reports: []Report{{ProviderID: "p1"}, {ProviderID: "p2"}}, code: http.StatusOK, applied: 2},
+		{method: "GET", url: "/reports/mock", reports: []Report{{ProviderID: "unknown"}}, code: http.StatusOK, applied: 1},
+		{method: "POST", url: "/reports/mock", err: ErrSignature, code: http.StatusForbidden},
+		{method: "POST", url: "/reports/mock", err: errors.New("bad json"), code: http.StatusBadRequest},
+		{method: "POST", url: "/reports/other", code: http.StatusNotFound},
+		{method: "DELETE", url: "/reports/mock", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		reporter := &MockedReporter{}
+		h := NewReportHandler(reporter, map[string]ReportParser{
+			"mock": &MockedReportParser{reports: c.reports, err: c.err},
+		})
+
+		rec := httptest.NewRecorder()
+		h.HandleReport(rec, httptest.NewRequest(c.method, c.url, nil))
+
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %s %s", rec.Code, c.code, c.method, c.url)
+		}
+		if len(reporter.reports) != c.applied {
+			t.Errorf("Got %d reports applied, expected: %d", len(reporter.reports), c.applied)
+		}
+		for _, r := range reporter.reports {
+			if r.Provider != "mock" {
+				t.Errorf("Got report of provider: %q, expected: %q", r.Provider, "mock")
+			}
+		}
+	}
+}
+
+type MockedReportParser struct {
+	reports []Report
+	err     error
+}
+
+func (p *MockedReportParser) ParseReport(req *http.Request) ([]Report, error) {
+	return p.reports, p.err
+}
+
+type MockedReporter struct {
+	reports []Report
+}
+
+func (r *MockedReporter) Report(report Report) error {
+	r.reports = append(r.reports, report)
+	if report.ProviderID == "unknown" {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package smsd
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	mb "github.com/messagebird/go-rest-api"
+)
+
+// ErrorKind tells if it makes sense to send SMS again after failure.
+type ErrorKind int
+
+const (
+	// Permanent errors will repeat on every attempt: invalid parameters, not enough balance and so on.
+	Permanent ErrorKind = iota
+	// Temporary errors are network failures and gateway internal errors.
+	Temporary
+	// Throttled means that gateway rejected SMS because of rate limit.
+	Throttled
+)
+
+// String returns human readable name of error kind.
+func (k ErrorKind) String() string {
+	switch k {
+	case Temporary:
+		return "temporary"
+	case Throttled:
+		return "throttled"
+	default:
+		return "permanent"
+	}
+}
+
+// SendError is a failure to submit SMS to gateway.
+type SendError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+// Error returns text of underlying error with its kind.
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Kind, e.Err)
+}
+
+// errorKind returns kind of SendError, errors of other types are considered temporary.
+func errorKind(err error) ErrorKind {
+	if se, ok := err.(*SendError); ok {
+		return se.Kind
+	}
+	return Temporary
+}
+
+// MessageBird.com API error codes that can go away if we try again later.
+const (
+	mbErrInternal = 99
+)
+
+// classifyMBError wraps MessageBird.com client error into SendError.
+// Errors other than ErrResponse mean that API did not answer properly: network failures, 5xx or 429 codes.
+func classifyMBError(m *mb.Message, err error) error {
+	if err != mb.ErrResponse || m == nil {
+		return &SendError{Kind: Temporary, Err: err}
+	}
+
+	kind := Permanent
+	for _, mbErr := range m.Errors {
+		if mbErr.Code == mbErrInternal {
+			kind = Temporary
+		}
+	}
+
+	return &SendError{Kind: kind, Err: fmt.Errorf("%s: %+v", err, m.Errors)}
+}
+
+// RetryPolicy configures how many times and how often failed SMS is resent.
+type RetryPolicy struct {
+	// MaxAttempts total number of attempts including the first one.
+	MaxAttempts int
+	// BaseDelay delay after the first failed attempt, it doubles with every next one.
+	BaseDelay time.Duration
+	// MaxDelay caps delay between attempts.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy makes 5 attempts within about 15 seconds.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   1 * time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+var (
+	jitterMu  sync.Mutex
+	jitterRnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns delay before next attempt after given number of failed ones.
+// Delay is randomized between half and full exponential value, so retries of messages
+// that failed at the same time do not hit gateway at the same time again.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	half := int64(delay / 2)
+	if half == 0 {
+		return delay
+	}
+
+	jitterMu.Lock()
+	jitter := jitterRnd.Int63n(half + 1)
+	jitterMu.Unlock()
+
+	return time.Duration(half + jitter)
+}
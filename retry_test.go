@@ -0,0 +1,80 @@
+package smsd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mb "github.com/messagebird/go-rest-api"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts: 10,
+		BaseDelay:   1 * time.Second,
+		MaxDelay:    10 * time.Second,
+	}
+
+	cases := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{attempts: 1, max: 1 * time.Second},
+		{attempts: 2, max: 2 * time.Second},
+		{attempts: 3, max: 4 * time.Second},
+		{attempts: 4, max: 8 * time.Second},
+		{attempts: 5, max: 10 * time.Second},
+		{attempts: 100, max: 10 * time.Second},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			delay := p.backoff(c.attempts)
+			if delay < c.max/2 || delay > c.max {
+				t.Fatalf("Delay after %d attempts is %s, expected between %s and %s", c.attempts, delay, c.max/2, c.max)
+			}
+		}
+	}
+}
+
+func TestClassifyMBError(t *testing.T) {
+	cases := []struct {
+		msg  *mb.Message
+		err  error
+		want ErrorKind
+	}{
+		{
+			msg:  nil,
+			err:  errors.New("connection refused"),
+			want: Temporary,
+		},
+		{
+			msg:  &mb.Message{},
+			err:  mb.ErrUnexpectedResponse,
+			want: Temporary,
+		},
+		{
+			msg:  &mb.Message{Errors: []mb.Error{{Code: 25, Description: "Not enough balance"}}},
+			err:  mb.ErrResponse,
+			want: Permanent,
+		},
+		{
+			msg:  &mb.Message{Errors: []mb.Error{{Code: mbErrInternal, Description: "Internal error"}}},
+			err:  mb.ErrResponse,
+			want: Temporary,
+		},
+	}
+
+	for _, c := range cases {
+		err := classifyMBError(c.msg, c.err)
+		if kind := errorKind(err); kind != c.want {
+			t.Errorf("Error %q is %s, expected: %s", err, kind, c.want)
+		}
+	}
+}
+
+func TestErrorKindOfUnknownErrors(t *testing.T) {
+	if kind := errorKind(errors.New("boom")); kind != Temporary {
+		t.Errorf("Unknown error is %s, expected: %s", kind, Temporary)
+	}
+}
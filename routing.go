@@ -0,0 +1,278 @@
+package smsd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Route sends numbers that start with Prefix through Provider for Cost per SMS.
+type Route struct {
+	Prefix   string  `json:"prefix"`
+	Provider string  `json:"provider"`
+	Cost     float64 `json:"cost"`
+}
+
+// RoutingTable maps MSISDN prefixes to providers. Prefix can have several routes, cheapest one is preferred.
+// Table is loaded from CSV file with prefix, provider and cost per SMS columns, lines starting with # are ignored:
+//
+//	# prefix,provider,cost
+//	380,vonage,0.021
+//	38067,twilio,0.018
+type RoutingTable struct {
+	mu     sync.RWMutex
+	path   string
+	routes map[string][]Route
+}
+
+// LoadRoutingTable reads routing table from CSV file on provided path.
+func LoadRoutingTable(path string) (*RoutingTable, error) {
+	t := &RoutingTable{path: path}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Reload reads file again and replaces routes. Old routes are kept if file is invalid.
+func (t *RoutingTable) Reload() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	routes, err := parseRoutes(f)
+	if err != nil {
+		return fmt.Errorf("routing table %s: %s", t.path, err)
+	}
+
+	t.mu.Lock()
+	t.routes = routes
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Lookup returns routes of longest prefix recipient starts with, cheapest first.
+// Returns nil if there is no matching prefix.
+func (t *RoutingTable) Lookup(msisdn string) []Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for i := len(msisdn); i > 0; i-- {
+		if routes, ok := t.routes[msisdn[:i]]; ok {
+			return routes
+		}
+	}
+
+	return nil
+}
+
+// parseRoutes reads CSV records and groups them by prefix, sorted by cost.
+func parseRoutes(r io.Reader) (map[string][]Route, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	routes := make(map[string][]Route)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := strings.TrimSpace(rec[0])
+		if prefix == "" || !isDigits(prefix) {
+			return nil, fmt.Errorf("invalid prefix %q", rec[0])
+		}
+
+		provider := strings.TrimSpace(rec[1])
+		if provider == "" {
+			return nil, fmt.Errorf("no provider for prefix %s", prefix)
+		}
+
+		cost, err := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+		if err != nil || cost < 0 {
+			return nil, fmt.Errorf("invalid cost %q for prefix %s", rec[2], prefix)
+		}
+
+		routes[prefix] = append(routes[prefix], Route{Prefix: prefix, Provider: provider, Cost: cost})
+	}
+
+	for _, rs := range routes {
+		sort.SliceStable(rs, func(i, j int) bool {
+			return rs[i].Cost < rs[j].Cost
+		})
+	}
+
+	return routes, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// RouteDecision tells how SMS to a number is sent.
+type RouteDecision struct {
+	MSISDN string `json:"msisdn"`
+	// Route that is preferred, nil if number matches no prefix and default failover order is used.
+	Route *Route `json:"route"`
+	// Providers in order they are tried.
+	Providers []string `json:"providers"`
+	Segments  int      `json:"segments"`
+	// Price of all segments with preferred route.
+	Price float64 `json:"price"`
+}
+
+// RoutingProvider picks cheapest route for recipient and sends SMS through failover chain in route order.
+// Providers that are not in route are tried after routed ones, so SMS is not lost when all of them fail.
+type RoutingProvider struct {
+	table    *RoutingTable
+	failover *FailoverProvider
+}
+
+// NewRoutingProvider creates Provider that routes SMS by recipient prefix.
+func NewRoutingProvider(table *RoutingTable, failover *FailoverProvider) *RoutingProvider {
+	return &RoutingProvider{
+		table:    table,
+		failover: failover,
+	}
+}
+
+// Send submits SMS through providers of longest matching prefix, cheapest first.
+func (p *RoutingProvider) Send(m Msg) (string, error) {
+	return p.failover.SendVia(m, routeProviders(p.table.Lookup(m.Recipient)))
+}
+
+// sendNamed submits SMS same as Send and returns name of provider that accepted it.
+func (p *RoutingProvider) sendNamed(m Msg) (string, string, error) {
+	return p.failover.sendOrdered(m, p.failover.order(routeProviders(p.table.Lookup(m.Recipient))))
+}
+
+// Route returns decision made for number without sending anything.
+func (p *RoutingProvider) Route(msisdn string, segments int) RouteDecision {
+	routes := p.table.Lookup(msisdn)
+
+	d := RouteDecision{
+		MSISDN:   msisdn,
+		Segments: segments,
+	}
+	for _, e := range p.failover.order(routeProviders(routes)) {
+		d.Providers = append(d.Providers, e.name)
+	}
+
+	// Preferred route is the cheapest one with provider that is configured.
+	known := make(map[string]bool)
+	for _, name := range p.failover.Providers() {
+		known[name] = true
+	}
+	for i := range routes {
+		if known[routes[i].Provider] {
+			r := routes[i]
+			d.Route = &r
+			d.Price = r.Cost * float64(segments)
+			break
+		}
+	}
+
+	return d
+}
+
+// NativeConcat delegates to failover chain.
+func (p *RoutingProvider) NativeConcat() bool {
+	return p.failover.NativeConcat()
+}
+
+// MaxSegments delegates to failover chain.
+func (p *RoutingProvider) MaxSegments() int {
+	return p.failover.MaxSegments()
+}
+
+// Breakers delegates to failover chain.
+func (p *RoutingProvider) Breakers() []BreakerStatus {
+	return p.failover.Breakers()
+}
+
+// Reload reads routing table again.
+func (p *RoutingProvider) Reload() error {
+	return p.table.Reload()
+}
+
+func routeProviders(routes []Route) []string {
+	names := make([]string, 0, len(routes))
+	for _, r := range routes {
+		names = append(names, r.Provider)
+	}
+	return names
+}
+
+// Router declares methods to inspect and reload routing.
+type Router interface {
+	Route(msisdn string, segments int) RouteDecision
+	Reload() error
+}
+
+// RouteHandler exposes routing dry-run and reload over HTTP.
+type RouteHandler struct {
+	r Router
+}
+
+// NewRouteHandler constructs RouteHandler for provided router.
+func NewRouteHandler(r Router) *RouteHandler {
+	return &RouteHandler{
+		r: r,
+	}
+}
+
+// HandleRoutes shows route for number on GET to URL that ends with MSISDN, optional segments parameter
+// sets number of SMS price is calculated for. POST to collection URL reloads routing table.
+func (h *RouteHandler) HandleRoutes(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		msisdn := path.Base(req.URL.Path)
+		if !MSISDNRegex.MatchString(msisdn) {
+			http.Error(w, "invalid msisdn", http.StatusBadRequest)
+			return
+		}
+
+		segments := 1
+		if s := req.URL.Query().Get("segments"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > MaxUDHSegments {
+				http.Error(w, "invalid segments", http.StatusBadRequest)
+				return
+			}
+			segments = n
+		}
+
+		writeJSON(w, http.StatusOK, h.r.Route(msisdn, segments))
+	case "POST":
+		if err := h.r.Reload(); err != nil {
+			log.Println("Failed to reload routing table, error:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,148 @@
+package smsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRoutes = `# prefix,provider,cost
+380,vonage,0.021
+380,twilio,0.025
+38067,twilio,0.018
+1,unknown,0.001
+1,messagebird,0.009
+`
+
+func TestRoutingTableLookup(t *testing.T) {
+	table := mustRoutingTable(t, testRoutes)
+
+	cases := []struct {
+		msisdn    string
+		providers []string
+	}{
+		{msisdn: "380671234567", providers: []string{"twilio"}},
+		{msisdn: "380501234567", providers: []string{"vonage", "twilio"}},
+		{msisdn: "12025550100", providers: []string{"unknown", "messagebird"}},
+		{msisdn: "4915112345678", providers: []string{}},
+	}
+
+	for _, c := range cases {
+		if actual := routeProviders(table.Lookup(c.msisdn)); !reflect.DeepEqual(actual, c.providers) {
+			t.Errorf("Got providers: %v, expected: %v for %s", actual, c.providers, c.msisdn)
+		}
+	}
+}
+
+func TestRoutingTableKeepsRoutesIfReloadFails(t *testing.T) {
+	path := tempStorePath(t)
+	if err := ioutil.WriteFile(path, []byte(testRoutes), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := LoadRoutingTable(path)
+	if err != nil {
+		t.Fatal("Failed to load routing table:", err)
+	}
+
+	for _, broken := range []string{"380,vonage\n", "+380,vonage,0.1\n", "380,vonage,cheap\n", "380,,0.1\n"} {
+		if err := ioutil.WriteFile(path, []byte(broken), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := table.Reload(); err == nil {
+			t.Errorf("Reloaded broken table: %q", broken)
+		}
+	}
+
+	if routes := table.Lookup("380671234567"); len(routes) != 1 {
+		t.Errorf("Got routes: %+v, expected old ones", routes)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("380671,messagebird,0.01\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Reload(); err != nil {
+		t.Fatal("Failed to reload routing table:", err)
+	}
+	if routes := table.Lookup("380501234567"); routes != nil {
+		t.Errorf("Got routes: %+v, expected none after reload", routes)
+	}
+}
+
+func TestRoutingProviderSendsThroughCheapestRoute(t *testing.T) {
+	mbird := &MockedFailingProvider{id: "messagebird"}
+	vonage := &MockedFailingProvider{id: "vonage"}
+	twilio := &MockedFailingProvider{id: "twilio"}
+
+	p := NewRoutingProvider(mustRoutingTable(t, testRoutes), NewFailoverProvider(DefaultBreakerConfig,
+		NamedProvider{Name: "messagebird", Provider: mbird},
+		NamedProvider{Name: "vonage", Provider: vonage},
+		NamedProvider{Name: "twilio", Provider: twilio},
+	))
+
+	cases := map[string]string{
+		"380671234567":  "twilio",
+		"380501234567":  "vonage",
+		"12025550100":   "messagebird",
+		"4915112345678": "messagebird",
+	}
+	for msisdn, expected := range cases {
+		if id, _ := p.Send(Msg{Recipient: msisdn}); id != expected {
+			t.Errorf("Got provider: %q, expected: %q for %s", id, expected, msisdn)
+		}
+	}
+
+	d := p.Route("12025550100", 3)
+	if d.Route == nil || d.Route.Provider != "messagebird" {
+		t.Fatalf("Got route: %+v, expected messagebird as unknown provider is skipped", d.Route)
+	}
+	if math.Abs(d.Price-0.027) > 1e-9 {
+		t.Errorf("Got price: %v, expected: 0.027", d.Price)
+	}
+	if expected := []string{"messagebird", "vonage", "twilio"}; !reflect.DeepEqual(d.Providers, expected) {
+		t.Errorf("Got providers: %v, expected: %v", d.Providers, expected)
+	}
+}
+
+func TestHandleRoutes(t *testing.T) {
+	p := NewRoutingProvider(mustRoutingTable(t, testRoutes), NewFailoverProvider(DefaultBreakerConfig,
+		NamedProvider{Name: "vonage", Provider: &MockedFailingProvider{}},
+	))
+	h := NewRouteHandler(p)
+
+	rec := httptest.NewRecorder()
+	h.HandleRoutes(rec, httptest.NewRequest("GET", "/admin/routes/380501234567?segments=2", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+
+	var d RouteDecision
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+		t.Fatal("Failed to decode response:", err)
+	}
+	if d.Route == nil || d.Route.Prefix != "380" || d.Price != 0.042 || d.Segments != 2 {
+		t.Errorf("Got decision: %+v", d)
+	}
+
+	for _, url := range []string{"/admin/routes/abc", "/admin/routes/380501234567?segments=0"} {
+		rec = httptest.NewRecorder()
+		h.HandleRoutes(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Got status: %d, expected: %d for %s", rec.Code, http.StatusBadRequest, url)
+		}
+	}
+}
+
+func mustRoutingTable(t *testing.T, csv string) *RoutingTable {
+	routes, err := parseRoutes(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal("Failed to parse routes:", err)
+	}
+	return &RoutingTable{routes: routes}
+}
@@ -0,0 +1,159 @@
+package smpp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// link is a connection between ESME and SMSC. Both sides send requests and answer requests of the other side,
+// link matches responses to requests by sequence number and limits number of requests waiting for response.
+type link struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	// wmu serializes writes, so PDUs are not interleaved.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint32
+	pending map[uint32]chan PDU
+
+	window    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newLink(conn net.Conn, window int, timeout time.Duration) *link {
+	return &link{
+		conn:    conn,
+		timeout: timeout,
+		pending: make(map[uint32]chan PDU),
+		window:  make(chan struct{}, window),
+		closed:  make(chan struct{}),
+	}
+}
+
+// request sends PDU and waits for its response. Non zero status is returned as StatusError.
+func (l *link) request(commandID uint32, body []byte) (PDU, error) {
+	select {
+	case <-l.closed:
+		return PDU{}, ErrClosed
+	default:
+	}
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.window <- struct{}{}:
+		defer func() { <-l.window }()
+	case <-l.closed:
+		return PDU{}, ErrClosed
+	case <-timer.C:
+		return PDU{}, ErrTimeout
+	}
+
+	respChan := make(chan PDU, 1)
+
+	l.mu.Lock()
+	l.seq++
+	if l.seq > 0x7FFFFFFF {
+		l.seq = 1
+	}
+	seq := l.seq
+	l.pending[seq] = respChan
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.pending, seq)
+		l.mu.Unlock()
+	}()
+
+	if err := l.write(PDU{CommandID: commandID, Sequence: seq, Body: body}); err != nil {
+		select {
+		case <-l.closed:
+			return PDU{}, ErrClosed
+		default:
+		}
+		l.shutdown()
+		return PDU{}, err
+	}
+
+	select {
+	case resp := <-respChan:
+		if resp.Status != StatusOK {
+			return resp, StatusError(resp.Status)
+		}
+		if resp.CommandID != commandID|respMask {
+			return resp, StatusError(StatusInvCmdID)
+		}
+		return resp, nil
+	case <-l.closed:
+		return PDU{}, ErrClosed
+	case <-timer.C:
+		return PDU{}, ErrTimeout
+	}
+}
+
+// respond answers request of the other side.
+func (l *link) respond(req PDU, status uint32, body []byte) error {
+	return l.write(PDU{CommandID: req.CommandID | respMask, Status: status, Sequence: req.Sequence, Body: body})
+}
+
+// nack answers request that can not be parsed or is not supported.
+func (l *link) nack(req PDU, status uint32) error {
+	return l.write(PDU{CommandID: GenericNack, Status: status, Sequence: req.Sequence})
+}
+
+func (l *link) write(p PDU) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+
+	l.conn.SetWriteDeadline(time.Now().Add(l.timeout))
+	return WritePDU(l.conn, p)
+}
+
+// dispatch passes response to request waiting for it. Request gets only the first response,
+// duplicate or late ones are dropped, so they never block reading of the connection.
+func (l *link) dispatch(resp PDU) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	respChan, ok := l.pending[resp.Sequence]
+	if !ok {
+		return
+	}
+	delete(l.pending, resp.Sequence)
+
+	select {
+	case respChan <- resp:
+	default:
+	}
+}
+
+// keepAlive sends enquire_link periodically and drops connection if the other side stops answering.
+func (l *link) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := l.request(EnquireLink, nil); err != nil {
+				l.shutdown()
+				return
+			}
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *link) shutdown() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+	})
+}
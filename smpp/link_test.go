@@ -0,0 +1,40 @@
+package smpp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLinkDropsDuplicateResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	l := newLink(client, 1, time.Second)
+	defer l.shutdown()
+
+	// Request is waiting for response, but does not read it yet.
+	respChan := make(chan PDU, 1)
+	l.pending[1] = respChan
+
+	dispatched := make(chan struct{})
+	go func() {
+		resp := PDU{CommandID: EnquireLink | respMask, Sequence: 1}
+		l.dispatch(resp)
+		l.dispatch(resp)
+		close(dispatched)
+	}()
+
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch is blocked by duplicate response")
+	}
+
+	if resp := <-respChan; resp.Sequence != 1 {
+		t.Errorf("Got response to sequence: %d, expected: %d", resp.Sequence, 1)
+	}
+	if _, ok := l.pending[1]; ok {
+		t.Error("Got request still pending after it was answered")
+	}
+}
@@ -0,0 +1,385 @@
+// Package smpp implements subset of SMPP 3.4 protocol that is needed to submit SMS to SMSC
+// and receive delivery receipts from it.
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Command IDs. Response ID is request ID with the highest bit set.
+const (
+	GenericNack         uint32 = 0x80000000
+	BindReceiver        uint32 = 0x00000001
+	BindReceiverResp    uint32 = 0x80000001
+	BindTransmitter     uint32 = 0x00000002
+	BindTransmitterResp uint32 = 0x80000002
+	SubmitSM            uint32 = 0x00000004
+	SubmitSMResp        uint32 = 0x80000004
+	DeliverSM           uint32 = 0x00000005
+	DeliverSMResp       uint32 = 0x80000005
+	Unbind              uint32 = 0x00000006
+	UnbindResp          uint32 = 0x80000006
+	BindTransceiver     uint32 = 0x00000009
+	BindTransceiverResp uint32 = 0x80000009
+	EnquireLink         uint32 = 0x00000015
+	EnquireLinkResp     uint32 = 0x80000015
+
+	respMask uint32 = 0x80000000
+)
+
+// Command statuses that are used by this package or need special handling by its users.
+const (
+	StatusOK          uint32 = 0x00000000
+	StatusInvMsgLen   uint32 = 0x00000001
+	StatusInvCmdLen   uint32 = 0x00000002
+	StatusInvCmdID    uint32 = 0x00000003
+	StatusInvBndSts   uint32 = 0x00000004
+	StatusAlyBnd      uint32 = 0x00000005
+	StatusSysErr      uint32 = 0x00000008
+	StatusInvSrcAdr   uint32 = 0x0000000A
+	StatusInvDstAdr   uint32 = 0x0000000B
+	StatusBindFail    uint32 = 0x0000000D
+	StatusInvPaswd    uint32 = 0x0000000E
+	StatusInvSysID    uint32 = 0x0000000F
+	StatusMsgQFul     uint32 = 0x00000014
+	StatusInvESMClass uint32 = 0x00000043
+	StatusSubmitFail  uint32 = 0x00000045
+	StatusThrottled   uint32 = 0x00000058
+	StatusInvOptParam uint32 = 0x000000C3
+)
+
+// InterfaceVersion is SMPP version sent in bind requests.
+const InterfaceVersion = 0x34
+
+// Type of number and numbering plan indicators.
+const (
+	TONUnknown       = 0x00
+	TONInternational = 0x01
+	TONAlphanumeric  = 0x05
+	NPIUnknown       = 0x00
+	NPIISDN          = 0x01
+)
+
+// ESM class bits.
+const (
+	// ESMDeliveryReceipt marks deliver_sm that carries SMSC delivery receipt.
+	ESMDeliveryReceipt = 0x04
+	// ESMUDHI tells that short message starts with User Data Header.
+	ESMUDHI = 0x40
+)
+
+// Data codings.
+const (
+	CodingDefault = 0x00
+	CodingIA5     = 0x01
+	CodingLatin1  = 0x03
+	CodingUCS2    = 0x08
+)
+
+// Optional parameter tags.
+const (
+	TagReceiptedMessageID = 0x001E
+	TagMessagePayload     = 0x0424
+	TagMessageState       = 0x0427
+)
+
+const (
+	headerLen = 16
+	// MaxPDULen protects from peers that send garbage as length.
+	MaxPDULen = 64 * 1024
+)
+
+// ErrMalformed is returned when PDU body does not match its command.
+var ErrMalformed = errors.New("smpp: malformed pdu")
+
+// PDU is SMPP protocol data unit with raw body.
+type PDU struct {
+	CommandID uint32
+	Status    uint32
+	Sequence  uint32
+	Body      []byte
+}
+
+// IsResponse tells if PDU is a response to request.
+func (p PDU) IsResponse() bool {
+	return p.CommandID&respMask != 0
+}
+
+// ReadPDU reads single PDU.
+func ReadPDU(r io.Reader) (PDU, error) {
+	var header [headerLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return PDU{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < headerLen || length > MaxPDULen {
+		return PDU{}, fmt.Errorf("smpp: invalid pdu length %d", length)
+	}
+
+	p := PDU{
+		CommandID: binary.BigEndian.Uint32(header[4:8]),
+		Status:    binary.BigEndian.Uint32(header[8:12]),
+		Sequence:  binary.BigEndian.Uint32(header[12:16]),
+		Body:      make([]byte, length-headerLen),
+	}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return PDU{}, err
+	}
+
+	return p, nil
+}
+
+// WritePDU writes PDU with single Write call.
+func WritePDU(w io.Writer, p PDU) error {
+	b := make([]byte, headerLen+len(p.Body))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.BigEndian.PutUint32(b[4:8], p.CommandID)
+	binary.BigEndian.PutUint32(b[8:12], p.Status)
+	binary.BigEndian.PutUint32(b[12:16], p.Sequence)
+	copy(b[headerLen:], p.Body)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// Bind is a body of bind_transmitter, bind_receiver and bind_transceiver.
+type Bind struct {
+	SystemID         string
+	Password         string
+	SystemType       string
+	InterfaceVersion byte
+	AddrTON          byte
+	AddrNPI          byte
+	AddressRange     string
+}
+
+// Bytes encodes bind body.
+func (b Bind) Bytes() []byte {
+	var e encoder
+	e.cstring(b.SystemID)
+	e.cstring(b.Password)
+	e.cstring(b.SystemType)
+	e.byte(b.InterfaceVersion)
+	e.byte(b.AddrTON)
+	e.byte(b.AddrNPI)
+	e.cstring(b.AddressRange)
+	return e.buf.Bytes()
+}
+
+// ParseBind decodes bind body.
+func ParseBind(body []byte) (Bind, error) {
+	d := decoder{b: body}
+	b := Bind{
+		SystemID:         d.cstring(),
+		Password:         d.cstring(),
+		SystemType:       d.cstring(),
+		InterfaceVersion: d.byte(),
+		AddrTON:          d.byte(),
+		AddrNPI:          d.byte(),
+		AddressRange:     d.cstring(),
+	}
+	return b, d.err
+}
+
+// Message is a body of submit_sm and deliver_sm, they share mandatory fields.
+type Message struct {
+	ServiceType          string
+	SourceAddrTON        byte
+	SourceAddrNPI        byte
+	SourceAddr           string
+	DestAddrTON          byte
+	DestAddrNPI          byte
+	DestAddr             string
+	ESMClass             byte
+	ProtocolID           byte
+	PriorityFlag         byte
+	ScheduleDeliveryTime string
+	ValidityPeriod       string
+	RegisteredDelivery   byte
+	ReplaceIfPresent     byte
+	DataCoding           byte
+	SMDefaultMsgID       byte
+	ShortMessage         []byte
+	// TLVs optional parameters by tag.
+	TLVs map[uint16][]byte
+}
+
+// Bytes encodes message body, optional parameters are written in order of their tags.
+func (m Message) Bytes() []byte {
+	var e encoder
+	e.cstring(m.ServiceType)
+	e.byte(m.SourceAddrTON)
+	e.byte(m.SourceAddrNPI)
+	e.cstring(m.SourceAddr)
+	e.byte(m.DestAddrTON)
+	e.byte(m.DestAddrNPI)
+	e.cstring(m.DestAddr)
+	e.byte(m.ESMClass)
+	e.byte(m.ProtocolID)
+	e.byte(m.PriorityFlag)
+	e.cstring(m.ScheduleDeliveryTime)
+	e.cstring(m.ValidityPeriod)
+	e.byte(m.RegisteredDelivery)
+	e.byte(m.ReplaceIfPresent)
+	e.byte(m.DataCoding)
+	e.byte(m.SMDefaultMsgID)
+	e.byte(byte(len(m.ShortMessage)))
+	e.buf.Write(m.ShortMessage)
+
+	tags := make([]int, 0, len(m.TLVs))
+	for tag := range m.TLVs {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+	for _, tag := range tags {
+		e.tlv(uint16(tag), m.TLVs[uint16(tag)])
+	}
+
+	return e.buf.Bytes()
+}
+
+// Payload returns short message or message_payload parameter if short message is empty.
+func (m Message) Payload() []byte {
+	if len(m.ShortMessage) == 0 {
+		return m.TLVs[TagMessagePayload]
+	}
+	return m.ShortMessage
+}
+
+// ParseMessage decodes submit_sm or deliver_sm body.
+func ParseMessage(body []byte) (Message, error) {
+	d := decoder{b: body}
+	m := Message{
+		ServiceType:          d.cstring(),
+		SourceAddrTON:        d.byte(),
+		SourceAddrNPI:        d.byte(),
+		SourceAddr:           d.cstring(),
+		DestAddrTON:          d.byte(),
+		DestAddrNPI:          d.byte(),
+		DestAddr:             d.cstring(),
+		ESMClass:             d.byte(),
+		ProtocolID:           d.byte(),
+		PriorityFlag:         d.byte(),
+		ScheduleDeliveryTime: d.cstring(),
+		ValidityPeriod:       d.cstring(),
+		RegisteredDelivery:   d.byte(),
+		ReplaceIfPresent:     d.byte(),
+		DataCoding:           d.byte(),
+		SMDefaultMsgID:       d.byte(),
+	}
+	m.ShortMessage = d.bytes(int(d.byte()))
+
+	for d.err == nil && len(d.b) != 0 {
+		tag, value := d.tlv()
+		if d.err != nil {
+			break
+		}
+		if m.TLVs == nil {
+			m.TLVs = make(map[uint16][]byte)
+		}
+		m.TLVs[tag] = value
+	}
+
+	return m, d.err
+}
+
+// CString encodes body that holds single C-octet string, like bind and submit_sm responses.
+func CString(s string) []byte {
+	var e encoder
+	e.cstring(s)
+	return e.buf.Bytes()
+}
+
+// ParseCString decodes body that starts with C-octet string. Empty body is an empty string,
+// SMSCs omit body of failed responses.
+func ParseCString(body []byte) (string, error) {
+	if len(body) == 0 {
+		return "", nil
+	}
+	d := decoder{b: body}
+	s := d.cstring()
+	return s, d.err
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) cstring(s string) {
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+func (e *encoder) byte(b byte) {
+	e.buf.WriteByte(b)
+}
+
+func (e *encoder) tlv(tag uint16, value []byte) {
+	var h [4]byte
+	binary.BigEndian.PutUint16(h[0:2], tag)
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(value)))
+	e.buf.Write(h[:])
+	e.buf.Write(value)
+}
+
+// decoder reads fields one by one, first error is kept and makes the rest of reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) cstring() string {
+	if d.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(d.b, 0)
+	if i < 0 {
+		d.err = ErrMalformed
+		return ""
+	}
+	s := string(d.b[:i])
+	d.b = d.b[i+1:]
+	return s
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) == 0 {
+		d.err = ErrMalformed
+		return 0
+	}
+	b := d.b[0]
+	d.b = d.b[1:]
+	return b
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = ErrMalformed
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.b[:n])
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) tlv() (uint16, []byte) {
+	h := d.bytes(4)
+	if d.err != nil {
+		return 0, nil
+	}
+	tag := binary.BigEndian.Uint16(h[0:2])
+	return tag, d.bytes(int(binary.BigEndian.Uint16(h[2:4])))
+}
@@ -0,0 +1,81 @@
+package smpp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPDURoundTrip(t *testing.T) {
+	p := PDU{CommandID: SubmitSM, Status: StatusOK, Sequence: 42, Body: []byte("body")}
+
+	var buf bytes.Buffer
+	if err := WritePDU(&buf, p); err != nil {
+		t.Fatal("Failed to write pdu:", err)
+	}
+
+	if buf.Len() != 20 || !bytes.Equal(buf.Bytes()[:4], []byte{0, 0, 0, 20}) {
+		t.Errorf("Got encoded pdu: % X", buf.Bytes())
+	}
+
+	actual, err := ReadPDU(&buf)
+	if err != nil {
+		t.Fatal("Failed to read pdu:", err)
+	}
+	if !reflect.DeepEqual(actual, p) {
+		t.Errorf("Got pdu: %+v, expected: %+v", actual, p)
+	}
+}
+
+func TestReadPDURejectsInvalidLength(t *testing.T) {
+	for _, header := range [][]byte{
+		{0, 0, 0, 4, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1},
+		{0xFF, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1},
+	} {
+		if _, err := ReadPDU(bytes.NewReader(header)); err == nil {
+			t.Errorf("Read pdu with invalid length: % X", header[:4])
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := Message{
+		SourceAddrTON:      TONAlphanumeric,
+		SourceAddr:         "Bank",
+		DestAddrTON:        TONInternational,
+		DestAddrNPI:        NPIISDN,
+		DestAddr:           "380660000000",
+		ESMClass:           ESMUDHI,
+		RegisteredDelivery: 1,
+		DataCoding:         CodingUCS2,
+		ShortMessage:       []byte{0x05, 0x00, 0x03, 0x07, 0x02, 0x01, 0x04, 0x1F},
+		TLVs: map[uint16][]byte{
+			TagReceiptedMessageID: []byte("abc\x00"),
+			TagMessageState:       {2},
+		},
+	}
+
+	actual, err := ParseMessage(m.Bytes())
+	if err != nil {
+		t.Fatal("Failed to parse message:", err)
+	}
+	if !reflect.DeepEqual(actual, m) {
+		t.Errorf("Got message: %+v, expected: %+v", actual, m)
+	}
+
+	if _, err := ParseMessage(m.Bytes()[:20]); err != ErrMalformed {
+		t.Errorf("Got error: %v, expected: %v", err, ErrMalformed)
+	}
+}
+
+func TestBindRoundTrip(t *testing.T) {
+	b := Bind{SystemID: "smsd", Password: "secret", InterfaceVersion: InterfaceVersion}
+
+	actual, err := ParseBind(b.Bytes())
+	if err != nil {
+		t.Fatal("Failed to parse bind:", err)
+	}
+	if actual != b {
+		t.Errorf("Got bind: %+v, expected: %+v", actual, b)
+	}
+}
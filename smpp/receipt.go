@@ -0,0 +1,127 @@
+package smpp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Final message states reported in delivery receipts.
+const (
+	StateEnroute       = "ENROUTE"
+	StateDelivered     = "DELIVRD"
+	StateExpired       = "EXPIRED"
+	StateDeleted       = "DELETED"
+	StateUndeliverable = "UNDELIV"
+	StateAccepted      = "ACCEPTD"
+	StateUnknown       = "UNKNOWN"
+	StateRejected      = "REJECTD"
+)
+
+// messageStates maps message_state parameter values to receipt states.
+var messageStates = map[byte]string{
+	1: StateEnroute,
+	2: StateDelivered,
+	3: StateExpired,
+	4: StateDeleted,
+	5: StateUndeliverable,
+	6: StateAccepted,
+	7: StateUnknown,
+	8: StateRejected,
+}
+
+// Receipt is SMSC delivery receipt.
+type Receipt struct {
+	// MessageID is ID SMSC returned in submit_sm_resp.
+	MessageID string
+	State     string
+	Err       string
+}
+
+// ParseReceipt extracts receipt from deliver_sm. Returns false if message is not a receipt.
+// Optional parameters are preferred, text in format of SMPP 3.4 Appendix B is used if they are missing:
+//
+//	id:IIIIIIIIII sub:SSS dlvrd:DDD submit date:YYMMDDhhmm done date:YYMMDDhhmm stat:DDDDDDD err:E text:...
+func ParseReceipt(m Message) (Receipt, bool) {
+	if m.ESMClass&ESMDeliveryReceipt == 0 {
+		return Receipt{}, false
+	}
+
+	fields := receiptFields(string(m.Payload()))
+
+	r := Receipt{
+		MessageID: fields["id"],
+		State:     fields["stat"],
+		Err:       fields["err"],
+	}
+
+	if id, ok := m.TLVs[TagReceiptedMessageID]; ok {
+		r.MessageID = strings.TrimRight(string(id), "\x00")
+	}
+	if st, ok := m.TLVs[TagMessageState]; ok && len(st) == 1 {
+		if state, ok := messageStates[st[0]]; ok {
+			r.State = state
+		}
+	}
+
+	return r, r.MessageID != ""
+}
+
+// receiptDate is date format of receipt text.
+const receiptDate = "0601021504"
+
+// Message builds deliver_sm that carries receipt both as text and as optional parameters.
+// Addresses are left for caller to fill.
+func (r Receipt) Message(submitted, done time.Time) Message {
+	dlvrd := 0
+	if r.State == StateDelivered {
+		dlvrd = 1
+	}
+
+	errCode := r.Err
+	if errCode == "" {
+		errCode = "000"
+	}
+
+	text := fmt.Sprintf("id:%s sub:001 dlvrd:%03d submit date:%s done date:%s stat:%s err:%s text:",
+		r.MessageID, dlvrd, submitted.UTC().Format(receiptDate), done.UTC().Format(receiptDate), r.State, errCode)
+
+	m := Message{
+		ESMClass:     ESMDeliveryReceipt,
+		ShortMessage: []byte(text),
+		TLVs: map[uint16][]byte{
+			TagReceiptedMessageID: CString(r.MessageID),
+		},
+	}
+
+	for value, state := range messageStates {
+		if state == r.State {
+			m.TLVs[TagMessageState] = []byte{value}
+		}
+	}
+
+	return m
+}
+
+// receiptFields splits receipt text to key-value pairs. Text field is the last one and can have spaces.
+func receiptFields(text string) map[string]string {
+	fields := make(map[string]string)
+
+	if i := strings.Index(strings.ToLower(text), "text:"); i >= 0 {
+		fields["text"] = text[i+len("text:"):]
+		text = text[:i]
+	}
+
+	// Date keys have spaces, joining them so every field is a single word.
+	text = strings.Replace(text, "submit date:", "submit_date:", 1)
+	text = strings.Replace(text, "done date:", "done_date:", 1)
+
+	for _, f := range strings.Fields(text) {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) == 2 {
+			fields[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,66 @@
+package smpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReceipt(t *testing.T) {
+	cases := []struct {
+		m        Message
+		expected Receipt
+		ok       bool
+	}{
+		{
+			m: Message{
+				ESMClass:     ESMDeliveryReceipt,
+				ShortMessage: []byte("id:1A2B sub:001 dlvrd:001 submit date:1709011000 done date:1709011001 stat:DELIVRD err:000 text:Hola amigo"),
+			},
+			expected: Receipt{MessageID: "1A2B", State: StateDelivered, Err: "000"},
+			ok:       true,
+		},
+		{
+			m: Message{
+				ESMClass:     ESMDeliveryReceipt,
+				ShortMessage: []byte("id:ignored stat:DELIVRD"),
+				TLVs: map[uint16][]byte{
+					TagReceiptedMessageID: []byte("3C4D\x00"),
+					TagMessageState:       {5},
+				},
+			},
+			expected: Receipt{MessageID: "3C4D", State: StateUndeliverable},
+			ok:       true,
+		},
+		{
+			m:  Message{ShortMessage: []byte("id:1A2B stat:DELIVRD")}, // Regular MO message.
+			ok: false,
+		},
+	}
+
+	for _, c := range cases {
+		r, ok := ParseReceipt(c.m)
+		if ok != c.ok || r != c.expected {
+			t.Errorf("Got receipt: %+v, %t, expected: %+v, %t", r, ok, c.expected, c.ok)
+		}
+	}
+}
+
+func TestReceiptMessage(t *testing.T) {
+	submitted := time.Date(2017, 9, 1, 10, 0, 0, 0, time.UTC)
+	r := Receipt{MessageID: "5E6F", State: StateUndeliverable, Err: "001"}
+
+	m := r.Message(submitted, submitted.Add(time.Minute))
+
+	expected := "id:5E6F sub:001 dlvrd:000 submit date:1709011000 done date:1709011001 stat:UNDELIV err:001 text:"
+	if string(m.ShortMessage) != expected {
+		t.Errorf("Got text: %q, expected: %q", m.ShortMessage, expected)
+	}
+
+	parsed, ok := ParseReceipt(m)
+	if !ok || parsed != r {
+		t.Errorf("Got receipt: %+v, expected: %+v", parsed, r)
+	}
+	if st := m.TLVs[TagMessageState]; len(st) != 1 || st[0] != 5 {
+		t.Errorf("Got message_state: %v, expected: 5", st)
+	}
+}
@@ -0,0 +1,249 @@
+package smpp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrNotReceiver is returned when message is delivered to session that is bound as transmitter.
+var ErrNotReceiver = errors.New("smpp: session is not bound as receiver")
+
+// Server accepts ESME connections as SMSC does. It supports bind_transmitter, bind_receiver and bind_transceiver.
+type Server struct {
+	// Authenticate checks credentials of bind request.
+	Authenticate func(systemID, password string) bool
+	// Submit handles submit_sm of bound session. Returns ID of accepted message or command status of failure.
+	// Requests of single session are handled one by one, in order they came.
+	Submit func(s *Session, m Message) (string, uint32)
+	// SystemID is sent to ESME in bind response.
+	SystemID string
+	// Timeout for writes and responses to deliver_sm. Default is 10 seconds.
+	Timeout time.Duration
+	// EnquireLink interval of keepalive requests. Default is 30 seconds.
+	EnquireLink time.Duration
+
+	mu       sync.Mutex
+	ln       net.Listener
+	sessions map[*Session]bool
+	closed   bool
+}
+
+// Session is ESME connection accepted by Server.
+type Session struct {
+	*link
+	srv *Server
+
+	mu       sync.Mutex
+	bind     uint32
+	systemID string
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("smpp: server closed")
+
+// Serve accepts connections on listener until Close is called.
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.ln = ln
+	if srv.sessions == nil {
+		srv.sessions = make(map[*Session]bool)
+	}
+	srv.mu.Unlock()
+
+	timeout := srv.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s := &Session{
+			link: newLink(conn, 1, timeout),
+			srv:  srv,
+		}
+
+		srv.mu.Lock()
+		srv.sessions[s] = true
+		srv.mu.Unlock()
+
+		go s.serve()
+	}
+}
+
+// Close stops accepting connections and closes all sessions.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closed = true
+	for s := range srv.sessions {
+		s.shutdown()
+	}
+
+	if srv.ln == nil {
+		return nil
+	}
+	return srv.ln.Close()
+}
+
+// Receivers returns sessions of system that are bound as receiver or transceiver.
+func (srv *Server) Receivers(systemID string) []*Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var sessions []*Session
+	for s := range srv.sessions {
+		if id, ok := s.bound(); ok && id == systemID && s.canReceive() {
+			sessions = append(sessions, s)
+		}
+	}
+
+	return sessions
+}
+
+// SystemID returns system ID session is bound with.
+func (s *Session) SystemID() string {
+	id, _ := s.bound()
+	return id
+}
+
+// Deliver sends deliver_sm and waits for ESME to acknowledge it.
+func (s *Session) Deliver(m Message) error {
+	if !s.canReceive() {
+		return ErrNotReceiver
+	}
+
+	_, err := s.request(DeliverSM, m.Bytes())
+	return err
+}
+
+func (s *Session) bound() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.systemID, s.bind != 0
+}
+
+func (s *Session) canReceive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bind == BindReceiver || s.bind == BindTransceiver
+}
+
+func (s *Session) canTransmit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bind == BindTransmitter || s.bind == BindTransceiver
+}
+
+// serve reads requests of ESME until connection is closed or ESME unbinds.
+func (s *Session) serve() {
+	defer func() {
+		s.shutdown()
+
+		s.srv.mu.Lock()
+		delete(s.srv.sessions, s)
+		s.srv.mu.Unlock()
+	}()
+
+	for {
+		p, err := ReadPDU(s.conn)
+		if err != nil {
+			return
+		}
+
+		if p.IsResponse() {
+			s.dispatch(p)
+			continue
+		}
+
+		switch p.CommandID {
+		case BindTransmitter, BindReceiver, BindTransceiver:
+			if err := s.handleBind(p); err != nil {
+				return
+			}
+		case SubmitSM:
+			if err := s.handleSubmit(p); err != nil {
+				return
+			}
+		case EnquireLink:
+			if err := s.respond(p, StatusOK, nil); err != nil {
+				return
+			}
+		case Unbind:
+			s.respond(p, StatusOK, nil)
+			return
+		default:
+			if err := s.nack(p, StatusInvCmdID); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) handleBind(p PDU) error {
+	if _, ok := s.bound(); ok {
+		return s.respond(p, StatusAlyBnd, nil)
+	}
+
+	b, err := ParseBind(p.Body)
+	if err != nil {
+		return s.respond(p, StatusInvCmdLen, nil)
+	}
+
+	if s.srv.Authenticate == nil || !s.srv.Authenticate(b.SystemID, b.Password) {
+		s.respond(p, StatusBindFail, nil)
+		// Not giving a chance to guess password on the same connection.
+		return ErrClosed
+	}
+
+	s.mu.Lock()
+	s.bind = p.CommandID
+	s.systemID = b.SystemID
+	s.mu.Unlock()
+
+	if err := s.respond(p, StatusOK, CString(s.srv.SystemID)); err != nil {
+		return err
+	}
+
+	interval := s.srv.EnquireLink
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+	go s.keepAlive(interval)
+
+	return nil
+}
+
+func (s *Session) handleSubmit(p PDU) error {
+	if !s.canTransmit() {
+		return s.respond(p, StatusInvBndSts, nil)
+	}
+
+	m, err := ParseMessage(p.Body)
+	if err != nil {
+		return s.respond(p, StatusInvCmdLen, nil)
+	}
+
+	id, status := s.srv.Submit(s, m)
+	if status != StatusOK {
+		return s.respond(p, status, nil)
+	}
+
+	return s.respond(p, StatusOK, CString(id))
+}
@@ -0,0 +1,114 @@
+package smpp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerAcceptsSubmitsAndDelivers(t *testing.T) {
+	srv := &Server{
+		Authenticate: func(systemID, password string) bool {
+			return systemID == "billing" && password == "secret"
+		},
+		Submit: func(s *Session, m Message) (string, uint32) {
+			if m.DestAddr == "full" {
+				return "", StatusMsgQFul
+			}
+			return s.SystemID() + "-1", StatusOK
+		},
+	}
+	addr := serve(t, srv)
+	defer srv.Close()
+
+	delivered := make(chan Message, 1)
+	tr, err := Dial(Config{
+		Addr:     addr,
+		SystemID: "billing",
+		Password: "secret",
+		OnDeliver: func(m Message) {
+			delivered <- m
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to bind:", err)
+	}
+	defer tr.Close()
+
+	id, err := tr.Submit(Message{DestAddr: "380660000000", ShortMessage: []byte("Hola")})
+	if err != nil {
+		t.Fatal("Failed to submit:", err)
+	}
+	if id != "billing-1" {
+		t.Errorf("Got ID: %q, expected: %q", id, "billing-1")
+	}
+
+	if _, err := tr.Submit(Message{DestAddr: "full"}); err != StatusError(StatusMsgQFul) {
+		t.Errorf("Got error: %v, expected: %v", err, StatusError(StatusMsgQFul))
+	}
+
+	sessions := srv.Receivers("billing")
+	if len(sessions) != 1 {
+		t.Fatalf("Got %d receiver sessions, expected: 1", len(sessions))
+	}
+	if err := sessions[0].Deliver(Message{SourceAddr: "380660000000", ShortMessage: []byte("Gracias")}); err != nil {
+		t.Fatal("Failed to deliver:", err)
+	}
+
+	select {
+	case m := <-delivered:
+		if string(m.ShortMessage) != "Gracias" {
+			t.Errorf("Got short message: %q", m.ShortMessage)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message is not delivered")
+	}
+}
+
+func TestServerRejectsWrongPassword(t *testing.T) {
+	srv := &Server{
+		Authenticate: func(systemID, password string) bool { return false },
+	}
+	addr := serve(t, srv)
+	defer srv.Close()
+
+	_, err := Dial(Config{Addr: addr, SystemID: "billing", Password: "guess"})
+	if err != StatusError(StatusBindFail) {
+		t.Errorf("Got error: %v, expected: %v", err, StatusError(StatusBindFail))
+	}
+}
+
+func TestServerRejectsSubmitBeforeBind(t *testing.T) {
+	srv := &Server{}
+	addr := serve(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := WritePDU(conn, PDU{CommandID: SubmitSM, Sequence: 1, Body: Message{}.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := ReadPDU(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.CommandID != SubmitSMResp || resp.Status != StatusInvBndSts {
+		t.Errorf("Got command: 0x%08X, status: 0x%08X", resp.CommandID, resp.Status)
+	}
+}
+
+func serve(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(ln)
+
+	return ln.Addr().String()
+}
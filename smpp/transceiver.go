@@ -0,0 +1,163 @@
+package smpp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// ErrClosed is returned for requests on connection that is closed or lost.
+	ErrClosed = errors.New("smpp: connection closed")
+	// ErrTimeout is returned when SMSC did not respond in time.
+	ErrTimeout = errors.New("smpp: response timeout")
+)
+
+// StatusError is non zero command status of response.
+type StatusError uint32
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("smpp: command status 0x%08X", uint32(e))
+}
+
+// Config of transceiver session.
+type Config struct {
+	// Addr of SMSC, host:port.
+	Addr       string
+	SystemID   string
+	Password   string
+	SystemType string
+	// Window max number of requests waiting for response. Default is 10.
+	Window int
+	// EnquireLink interval of keepalive requests. Default is 30 seconds.
+	EnquireLink time.Duration
+	// Timeout for connection and every response. Default is 10 seconds.
+	Timeout time.Duration
+	// OnDeliver is called for every deliver_sm after it is acknowledged. It is called from read loop,
+	// so it must not block for long.
+	OnDeliver func(Message)
+}
+
+func (c *Config) setDefaults() {
+	if c.Window < 1 {
+		c.Window = 10
+	}
+	if c.EnquireLink == 0 {
+		c.EnquireLink = 30 * time.Second
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+}
+
+// Transceiver is a bound bind_transceiver session. It can submit messages concurrently,
+// up to Window of them wait for responses at the same time.
+type Transceiver struct {
+	*link
+	cfg Config
+}
+
+// Dial connects to SMSC and binds as transceiver.
+func Dial(cfg Config) (*Transceiver, error) {
+	cfg.setDefaults()
+
+	conn, err := net.DialTimeout("tcp", cfg.Addr, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Transceiver{
+		link: newLink(conn, cfg.Window, cfg.Timeout),
+		cfg:  cfg,
+	}
+
+	go t.readLoop()
+
+	bind := Bind{
+		SystemID:         cfg.SystemID,
+		Password:         cfg.Password,
+		SystemType:       cfg.SystemType,
+		InterfaceVersion: InterfaceVersion,
+	}
+	if _, err := t.request(BindTransceiver, bind.Bytes()); err != nil {
+		t.shutdown()
+		return nil, err
+	}
+
+	go t.keepAlive(cfg.EnquireLink)
+
+	return t, nil
+}
+
+// Submit sends submit_sm and returns message ID assigned by SMSC.
+func (t *Transceiver) Submit(m Message) (string, error) {
+	resp, err := t.request(SubmitSM, m.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	return ParseCString(resp.Body)
+}
+
+// Done is closed when connection is closed or lost.
+func (t *Transceiver) Done() <-chan struct{} {
+	return t.closed
+}
+
+// Close unbinds and closes connection.
+func (t *Transceiver) Close() error {
+	select {
+	case <-t.closed:
+		return nil
+	default:
+	}
+
+	_, err := t.request(Unbind, nil)
+	t.shutdown()
+
+	return err
+}
+
+// readLoop dispatches responses to waiting requests and answers requests of SMSC.
+func (t *Transceiver) readLoop() {
+	defer t.shutdown()
+
+	for {
+		p, err := ReadPDU(t.conn)
+		if err != nil {
+			return
+		}
+
+		if p.IsResponse() {
+			t.dispatch(p)
+			continue
+		}
+
+		switch p.CommandID {
+		case DeliverSM:
+			m, err := ParseMessage(p.Body)
+			if err != nil {
+				t.respond(p, StatusSysErr, nil)
+				continue
+			}
+			if err := t.respond(p, StatusOK, CString("")); err != nil {
+				return
+			}
+			if t.cfg.OnDeliver != nil {
+				t.cfg.OnDeliver(m)
+			}
+		case EnquireLink:
+			if err := t.respond(p, StatusOK, nil); err != nil {
+				return
+			}
+		case Unbind:
+			t.respond(p, StatusOK, nil)
+			return
+		default:
+			if err := t.nack(p, StatusInvCmdID); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package smpp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransceiverSubmitsAndReceivesReceipts(t *testing.T) {
+	smsc := newFakeSMSC(t)
+	defer smsc.close()
+
+	receipts := make(chan Receipt, 1)
+	tr, err := Dial(Config{
+		Addr:     smsc.addr(),
+		SystemID: "smsd",
+		Password: "secret",
+		OnDeliver: func(m Message) {
+			if r, ok := ParseReceipt(m); ok {
+				receipts <- r
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to bind:", err)
+	}
+	defer tr.Close()
+
+	id, err := tr.Submit(Message{DestAddr: "380660000000", ShortMessage: []byte("Hola"), RegisteredDelivery: 1})
+	if err != nil {
+		t.Fatal("Failed to submit:", err)
+	}
+	if id != "msg-1" {
+		t.Errorf("Got ID: %q, expected: %q", id, "msg-1")
+	}
+
+	select {
+	case r := <-receipts:
+		if r.MessageID != id || r.State != StateDelivered {
+			t.Errorf("Got receipt: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No receipt received")
+	}
+
+	if _, err := tr.Submit(Message{DestAddr: "throttle"}); err != StatusError(StatusThrottled) {
+		t.Errorf("Got error: %v, expected: %v", err, StatusError(StatusThrottled))
+	}
+}
+
+func TestTransceiverFailsToBindWithWrongPassword(t *testing.T) {
+	smsc := newFakeSMSC(t)
+	defer smsc.close()
+
+	_, err := Dial(Config{Addr: smsc.addr(), SystemID: "smsd", Password: "wrong"})
+	if err != StatusError(StatusInvPaswd) {
+		t.Errorf("Got error: %v, expected: %v", err, StatusError(StatusInvPaswd))
+	}
+}
+
+func TestTransceiverLimitsRequestsInFlight(t *testing.T) {
+	smsc := newFakeSMSC(t)
+	smsc.batch = 2
+	defer smsc.close()
+
+	tr, err := Dial(Config{Addr: smsc.addr(), SystemID: "smsd", Password: "secret", Window: 2})
+	if err != nil {
+		t.Fatal("Failed to bind:", err)
+	}
+	defer tr.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tr.Submit(Message{DestAddr: "380660000000"}); err != nil {
+				t.Error("Failed to submit:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max := smsc.maxInFlight(); max != 2 {
+		t.Errorf("Got %d requests in flight, expected: 2", max)
+	}
+}
+
+func TestTransceiverClosesWhenSMSCStopsAnswering(t *testing.T) {
+	smsc := newFakeSMSC(t)
+	defer smsc.close()
+
+	tr, err := Dial(Config{
+		Addr:        smsc.addr(),
+		SystemID:    "smsd",
+		Password:    "secret",
+		EnquireLink: 10 * time.Millisecond,
+		Timeout:     50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Failed to bind:", err)
+	}
+
+	smsc.mu.Lock()
+	smsc.mute = true
+	smsc.mu.Unlock()
+
+	select {
+	case <-tr.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Connection is not closed after enquire_link timed out")
+	}
+
+	if _, err := tr.Submit(Message{}); err != ErrClosed {
+		t.Errorf("Got error: %v, expected: %v", err, ErrClosed)
+	}
+}
+
+// fakeSMSC accepts single transceiver session. It answers submit_sm with sequential IDs and sends
+// delivery receipt for every message that asks for it. Destination "throttle" is rejected.
+type fakeSMSC struct {
+	ln net.Listener
+
+	mu sync.Mutex
+	// batch holds submit_sm responses until that many requests are received.
+	batch    int
+	held     []PDU
+	inFlight int
+	max      int
+	// mute stops answering any requests.
+	mute bool
+	ids  int
+}
+
+func newFakeSMSC(t *testing.T) *fakeSMSC {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMSC{ln: ln, batch: 1}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMSC) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMSC) close() {
+	s.ln.Close()
+}
+
+func (s *fakeSMSC) maxInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+func (s *fakeSMSC) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var wmu sync.Mutex
+	write := func(p PDU) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		WritePDU(conn, p)
+	}
+
+	for {
+		p, err := ReadPDU(conn)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		mute := s.mute
+		s.mu.Unlock()
+		if mute || p.IsResponse() {
+			continue
+		}
+
+		switch p.CommandID {
+		case BindTransceiver:
+			b, _ := ParseBind(p.Body)
+			status := StatusOK
+			if b.SystemID != "smsd" || b.Password != "secret" {
+				status = StatusInvPaswd
+			}
+			write(PDU{CommandID: BindTransceiverResp, Status: status, Sequence: p.Sequence, Body: CString("fake")})
+		case SubmitSM:
+			m, _ := ParseMessage(p.Body)
+			if m.DestAddr == "throttle" {
+				write(PDU{CommandID: SubmitSMResp, Status: StatusThrottled, Sequence: p.Sequence})
+				continue
+			}
+			s.submit(p, m, write)
+		case EnquireLink:
+			write(PDU{CommandID: EnquireLinkResp, Sequence: p.Sequence})
+		case Unbind:
+			write(PDU{CommandID: UnbindResp, Sequence: p.Sequence})
+			return
+		}
+	}
+}
+
+func (s *fakeSMSC) submit(p PDU, m Message, write func(PDU)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ids++
+	id := fmt.Sprintf("msg-%d", s.ids)
+
+	s.inFlight++
+	if s.inFlight > s.max {
+		s.max = s.inFlight
+	}
+	s.held = append(s.held, PDU{CommandID: SubmitSMResp, Sequence: p.Sequence, Body: CString(id)})
+
+	if len(s.held) < s.batch {
+		// Releasing the rest if no more requests come.
+		time.AfterFunc(50*time.Millisecond, func() { s.release(write) })
+		return
+	}
+	s.flush(write)
+
+	if m.RegisteredDelivery != 0 {
+		receipt := Message{
+			ESMClass:     ESMDeliveryReceipt,
+			ShortMessage: []byte("id:" + id + " sub:001 dlvrd:001 submit date:1709011000 done date:1709011001 stat:DELIVRD err:000 text:"),
+		}
+		write(PDU{CommandID: DeliverSM, Sequence: uint32(1000 + s.ids), Body: receipt.Bytes()})
+	}
+}
+
+func (s *fakeSMSC) release(write func(PDU)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush(write)
+}
+
+func (s *fakeSMSC) flush(write func(PDU)) {
+	for _, resp := range s.held {
+		write(resp)
+	}
+	s.inFlight -= len(s.held)
+	s.held = nil
+}
@@ -0,0 +1,394 @@
+package smsd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooldarkdryplace/sms-service/smpp"
+)
+
+// receiptTTL is how long SMPP front-end waits for final status of message to send receipt for it.
+const receiptTTL = 72 * time.Hour
+
+// errDataCoding is returned for submit_sm with data_coding that front-end can not decode.
+var errDataCoding = errors.New("data coding is not supported")
+
+// SMPPFrontend lets systems that only speak SMPP send SMS through Messenger as if it was SMSC.
+// Messages go through the same validation as HTTP requests, delivery receipts are sent back as deliver_sm
+// to sessions of the same system that are bound as receiver or transceiver.
+type SMPPFrontend struct {
+	messenger      Messenger
+	accounts       map[string]SMPPAccount
+	maxSegments    int
+	wideRefs       bool
+	enqueueTimeout time.Duration
+	srv            *smpp.Server
+	// Suppressions rejects messages to numbers that opted out, if it is set.
+	// SMPP has no way to skip the check per message.
+	Suppressions SuppressionList
+	// Keys makes messages of every system go through the same checks as HTTP requests with its API key:
+	// originator has to be allowed for key, SMS are counted in Quotas if they are set,
+	// and queue is shared with other keys. System without key can not submit messages if Keys are set.
+	Keys   KeyStore
+	Quotas QuotaLimiter
+
+	mu      sync.Mutex
+	origins map[string]smppOrigin
+	pruned  time.Time
+}
+
+// smppOrigin is submit_sm that asked for delivery receipt.
+type smppOrigin struct {
+	systemID   string
+	sm         smpp.Message
+	submitted  time.Time
+	failedOnly bool
+}
+
+// SMPPAccount is a system that can bind to SMPP front-end.
+type SMPPAccount struct {
+	Password string
+	// KeyID is ID of API key that messages of system are checked with.
+	KeyID string
+}
+
+// NewSMPPFrontend creates SMPP front-end of Messenger. Accounts are keyed by system ID.
+// Messages are limited to number of concatenated SMS Messenger allows if it implements SegmentLimiter.
+func NewSMPPFrontend(m Messenger, accounts map[string]SMPPAccount) *SMPPFrontend {
+	f := &SMPPFrontend{
+		messenger:      m,
+		accounts:       accounts,
+		maxSegments:    segmentCap(m),
+		wideRefs:       wideRefs(m),
+		enqueueTimeout: DefaultEnqueueTimeout,
+		origins:        make(map[string]smppOrigin),
+	}
+
+	f.srv = &smpp.Server{
+		Authenticate: f.authenticate,
+		Submit:       f.submit,
+		SystemID:     "smsd",
+	}
+
+	return f
+}
+
+// Serve accepts SMPP sessions on listener until Close is called.
+func (f *SMPPFrontend) Serve(ln net.Listener) error {
+	return f.srv.Serve(ln)
+}
+
+// Close stops accepting sessions and drops bound ones.
+func (f *SMPPFrontend) Close() error {
+	return f.srv.Close()
+}
+
+// StatusChanged sends delivery receipt when message submitted over SMPP is delivered or failed.
+// It does not block, so it can be registered with Client.OnStatusChange.
+func (f *SMPPFrontend) StatusChanged(s Status) {
+	if !isFinal(s.State) {
+		return
+	}
+
+	f.mu.Lock()
+	origin, ok := f.origins[s.ID]
+	delete(f.origins, s.ID)
+	f.mu.Unlock()
+
+	if !ok || (origin.failedOnly && s.State != StateFailed) {
+		return
+	}
+
+	go f.sendReceipt(s, origin)
+}
+
+func (f *SMPPFrontend) authenticate(systemID, password string) bool {
+	account, ok := f.accounts[systemID]
+	expected := account.Password
+	if !ok {
+		// Comparing anyway, so response time does not tell which system IDs exist.
+		expected = password + "x"
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// submit validates submit_sm the same way Handler validates HTTP request and queues it.
+func (f *SMPPFrontend) submit(s *smpp.Session, sm smpp.Message) (string, uint32) {
+	if sm.ESMClass&smpp.ESMUDHI != 0 {
+		// Messenger splits long messages itself, they have to come whole in message_payload.
+		return "", smpp.StatusInvESMClass
+	}
+
+	body, err := decodeSMPPBody(sm.DataCoding, sm.Payload())
+	if err != nil {
+		log.Printf("Rejected submit_sm from %s: %s\n", s.SystemID(), err)
+		return "", smpp.StatusSubmitFail
+	}
+
+	if !MSISDNRegex.MatchString(sm.SourceAddr) && !OriginatorRegex.MatchString(sm.SourceAddr) {
+		return "", smpp.StatusInvSrcAdr
+	}
+
+	recipient := strings.TrimPrefix(sm.DestAddr, "+")
+	if !MSISDNRegex.MatchString(recipient) {
+		return "", smpp.StatusInvDstAdr
+	}
+	msisdn, err := strconv.Atoi(recipient)
+	if err != nil {
+		return "", smpp.StatusInvDstAdr
+	}
+
+	if f.Suppressions != nil {
+		suppressed, err := f.Suppressions.Contains(recipient)
+		if err != nil {
+			log.Printf("Failed to check suppression list, error: %s\n", err)
+			return "", smpp.StatusSysErr
+		}
+		if suppressed {
+			log.Printf("Rejected submit_sm from %s: %s\n", s.SystemID(), ErrSuppressed)
+			return "", smpp.StatusSubmitFail
+		}
+	}
+
+	if getBodyCount(body) > maxBodyLen(DetectEncoding(body), f.maxSegments, f.wideRefs) {
+		return "", smpp.StatusInvMsgLen
+	}
+
+	msg := MsgRequest{
+		Originator: sm.SourceAddr,
+		Message:    body,
+		Recipient:  msisdn,
+	}
+	if err := msg.validate(f.maxSegments, f.wideRefs); err != nil {
+		log.Printf("Rejected submit_sm from %s: %s\n", s.SystemID(), err)
+		return "", smpp.StatusSubmitFail
+	}
+
+	ctx := context.Background()
+
+	var key APIKey
+	if f.Keys != nil {
+		var status uint32
+		if key, status = f.admit(s.SystemID(), msg); status != smpp.StatusOK {
+			return "", status
+		}
+
+		// Queue is shared fairly between API keys.
+		ctx = ContextWithTenant(ctx, key.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.enqueueTimeout)
+	defer cancel()
+
+	id, err := f.messenger.SendTextContext(ctx, msg.Originator, recipient, body)
+	if err != nil {
+		log.Printf("Failed to submit message from %s, error: %s\n", s.SystemID(), err)
+		f.refund(key, body)
+
+		switch err {
+		case ErrTooManySegments:
+			return "", smpp.StatusInvMsgLen
+		case ErrQueueFull:
+			return "", smpp.StatusMsgQFul
+		}
+		return "", smpp.StatusSysErr
+	}
+
+	if mode := sm.RegisteredDelivery & 0x03; mode != 0 {
+		f.track(id, smppOrigin{
+			systemID:   s.SystemID(),
+			sm:         sm,
+			submitted:  time.Now(),
+			failedOnly: mode == 2,
+		})
+	}
+
+	return id, smpp.StatusOK
+}
+
+// admit checks message of system with its API key the same way Handler checks HTTP request
+// and counts its SMS in quota of key. It returns key and status submit_sm is rejected with if it is not StatusOK.
+func (f *SMPPFrontend) admit(systemID string, msg MsgRequest) (APIKey, uint32) {
+	key, err := f.Keys.Get(f.accounts[systemID].KeyID)
+	if err == ErrNotFound {
+		log.Printf("Rejected submit_sm from %s: system has no API key\n", systemID)
+		return APIKey{}, smpp.StatusSubmitFail
+	}
+	if err != nil {
+		log.Printf("Failed to get API key of %s, error: %s\n", systemID, err)
+		return APIKey{}, smpp.StatusSysErr
+	}
+
+	if err := msg.ValidateKey(key); err != nil {
+		log.Printf("Rejected submit_sm from %s: %s\n", systemID, err)
+		return APIKey{}, smpp.StatusInvSrcAdr
+	}
+
+	if f.Quotas == nil {
+		return key, smpp.StatusOK
+	}
+
+	_, err = f.Quotas.Allow(key, segmentCount(msg.Body(), f.wideRefs))
+	switch err {
+	case nil:
+		return key, smpp.StatusOK
+	case ErrRateLimited:
+		log.Printf("Rejected submit_sm from %s: %s\n", systemID, err)
+		return APIKey{}, smpp.StatusThrottled
+	case ErrQuotaExceeded:
+		log.Printf("Rejected submit_sm from %s: %s\n", systemID, err)
+		return APIKey{}, smpp.StatusSubmitFail
+	}
+
+	log.Printf("Failed to check quota of %s, error: %s\n", systemID, err)
+	return APIKey{}, smpp.StatusSysErr
+}
+
+// refund returns SMS of body that was not queued to quota of API key.
+func (f *SMPPFrontend) refund(k APIKey, body string) {
+	if f.Keys != nil && f.Quotas != nil {
+		f.Quotas.Refund(k, segmentCount(body, f.wideRefs))
+	}
+}
+
+// track remembers where to send receipt for message.
+func (f *SMPPFrontend) track(id string, origin smppOrigin) {
+	f.mu.Lock()
+	f.origins[id] = origin
+
+	// Forgetting messages that never got final status.
+	if time.Since(f.pruned) > time.Minute {
+		for id, o := range f.origins {
+			if time.Since(o.submitted) > receiptTTL {
+				delete(f.origins, id)
+			}
+		}
+		f.pruned = time.Now()
+	}
+	f.mu.Unlock()
+
+	// Status may have changed before it was tracked.
+	if s, err := f.messenger.Status(id); err == nil {
+		f.StatusChanged(s)
+	}
+}
+
+// sendReceipt delivers receipt to first session of system that takes it.
+func (f *SMPPFrontend) sendReceipt(s Status, origin smppOrigin) {
+	r := smpp.Receipt{MessageID: s.ID, State: smpp.StateDelivered}
+	if s.State == StateFailed {
+		r.State = smpp.StateUndeliverable
+	}
+
+	m := r.Message(origin.submitted, time.Now())
+	m.SourceAddrTON = origin.sm.DestAddrTON
+	m.SourceAddrNPI = origin.sm.DestAddrNPI
+	m.SourceAddr = origin.sm.DestAddr
+	m.DestAddrTON = origin.sm.SourceAddrTON
+	m.DestAddrNPI = origin.sm.SourceAddrNPI
+	m.DestAddr = origin.sm.SourceAddr
+
+	for _, session := range f.srv.Receivers(origin.systemID) {
+		if err := session.Deliver(m); err != nil {
+			log.Printf("Failed to deliver receipt of %s to %s: %s\n", s.ID, origin.systemID, err)
+			continue
+		}
+		return
+	}
+
+	log.Printf("Receipt of %s is dropped, %s has no receiver session.\n", s.ID, origin.systemID)
+}
+
+// decodeSMPPBody converts short message to text according to data_coding.
+func decodeSMPPBody(dataCoding byte, b []byte) (string, error) {
+	switch dataCoding {
+	case smpp.CodingDefault:
+		return decodeGSM7(b), nil
+	case smpp.CodingIA5, smpp.CodingLatin1:
+		// ASCII is a subset of Latin-1, and Latin-1 codes are the same as Unicode code points.
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	case smpp.CodingUCS2:
+		return decodeUCS2(b), nil
+	}
+
+	return "", errDataCoding
+}
+
+// LoadSMPPAccounts reads system IDs and passwords of SMPP clients from CSV file, lines starting with # are ignored.
+// Optional third column is ID of API key that messages of system are checked with:
+//
+//	# system_id,password,key_id
+//	billing,s3cret,5f2b9c1e7a4d3b60
+//	crm,pass
+func LoadSMPPAccounts(path string) (map[string]SMPPAccount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	accounts, err := parseSMPPAccounts(f)
+	if err != nil {
+		return nil, fmt.Errorf("smpp accounts %s: %s", path, err)
+	}
+
+	return accounts, nil
+}
+
+func parseSMPPAccounts(r io.Reader) (map[string]SMPPAccount, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	accounts := make(map[string]SMPPAccount)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rec) != 2 && len(rec) != 3 {
+			return nil, fmt.Errorf("line has %d fields, expected system_id,password and optional key_id", len(rec))
+		}
+
+		systemID := strings.TrimSpace(rec[0])
+		// SMPP 3.4 limits system_id to 15 and password to 8 octets.
+		if systemID == "" || len(systemID) > 15 {
+			return nil, fmt.Errorf("invalid system ID %q", rec[0])
+		}
+		if rec[1] == "" || len(rec[1]) > 8 {
+			return nil, fmt.Errorf("invalid password for system %s", systemID)
+		}
+		if _, ok := accounts[systemID]; ok {
+			return nil, fmt.Errorf("duplicate system ID %s", systemID)
+		}
+
+		account := SMPPAccount{Password: rec[1]}
+		if len(rec) == 3 {
+			account.KeyID = strings.TrimSpace(rec[2])
+		}
+		accounts[systemID] = account
+	}
+
+	return accounts, nil
+}
@@ -0,0 +1,253 @@
+package smsd
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cooldarkdryplace/sms-service/smpp"
+)
+
+func TestSMPPFrontendSubmitsAndSendsReceipts(t *testing.T) {
+	f := NewSMPPFrontend(&MockedMessenger{id: "msg-1"}, map[string]SMPPAccount{"billing": {Password: "secret"}})
+	addr := serveSMPPFrontend(t, f)
+	defer f.Close()
+
+	receipts := make(chan smpp.Message, 1)
+	tr, err := smpp.Dial(smpp.Config{
+		Addr:     addr,
+		SystemID: "billing",
+		Password: "secret",
+		OnDeliver: func(m smpp.Message) {
+			receipts <- m
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to bind:", err)
+	}
+	defer tr.Close()
+
+	id, err := tr.Submit(smpp.Message{
+		SourceAddr:         "Bank",
+		DestAddr:           "380660000000",
+		DataCoding:         smpp.CodingUCS2,
+		ShortMessage:       UCS2.encode("Привіт"),
+		RegisteredDelivery: 1,
+	})
+	if err != nil {
+		t.Fatal("Failed to submit:", err)
+	}
+	if id != "msg-1" {
+		t.Errorf("Got ID: %q, expected: %q", id, "msg-1")
+	}
+
+	f.StatusChanged(Status{ID: "msg-1", State: StateSubmitted})
+	f.StatusChanged(Status{ID: "msg-1", State: StateDelivered})
+
+	select {
+	case m := <-receipts:
+		r, ok := smpp.ParseReceipt(m)
+		if !ok || r.MessageID != id || r.State != smpp.StateDelivered {
+			t.Errorf("Got receipt: %+v", r)
+		}
+		if m.SourceAddr != "380660000000" || m.DestAddr != "Bank" {
+			t.Errorf("Got receipt from %q to %q", m.SourceAddr, m.DestAddr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No receipt received")
+	}
+}
+
+func TestSMPPFrontendRejectsInvalidSubmits(t *testing.T) {
+	cases := []struct {
+		name   string
+		m      smpp.Message
+		err    error
+		status uint32
+	}{
+		{
+			name:   "udh",
+			m:      smpp.Message{SourceAddr: "Bank", DestAddr: "380660000000", ESMClass: smpp.ESMUDHI, ShortMessage: []byte("Hola")},
+			status: smpp.StatusInvESMClass,
+		},
+		{
+			name:   "source",
+			m:      smpp.Message{SourceAddr: "Bank of Mars", DestAddr: "380660000000", ShortMessage: []byte("Hola")},
+			status: smpp.StatusInvSrcAdr,
+		},
+		{
+			name:   "destination",
+			m:      smpp.Message{SourceAddr: "Bank", DestAddr: "0660000000", ShortMessage: []byte("Hola")},
+			status: smpp.StatusInvDstAdr,
+		},
+		{
+			name: "length",
+			m: smpp.Message{SourceAddr: "Bank", DestAddr: "380660000000", TLVs: map[uint16][]byte{
+				smpp.TagMessagePayload: []byte(strings.Repeat("m", MaxMsgLen+1)),
+			}},
+			status: smpp.StatusInvMsgLen,
+		},
+		{
+			name:   "coding",
+			m:      smpp.Message{SourceAddr: "Bank", DestAddr: "380660000000", DataCoding: 0x04, ShortMessage: []byte("Hola")},
+			status: smpp.StatusSubmitFail,
+		},
+		{
+			name:   "empty",
+			m:      smpp.Message{SourceAddr: "Bank", DestAddr: "380660000000"},
+			status: smpp.StatusSubmitFail,
+		},
+		{
+			name:   "suppressed",
+			m:      smpp.Message{SourceAddr: "Bank", DestAddr: "+380669999999", ShortMessage: []byte("Hola")},
+			status: smpp.StatusSubmitFail,
+		},
+		{
+			name:   "queue",
+			m:      smpp.Message{SourceAddr: "Bank", DestAddr: "380660000000", ShortMessage: []byte("Hola")},
+			err:    ErrQueueFull,
+			status: smpp.StatusMsgQFul,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := NewSMPPFrontend(&MockedMessenger{id: "msg-1", err: c.err}, map[string]SMPPAccount{"billing": {Password: "secret"}})
+			f.Suppressions = NewMemSuppressionList()
+			f.Suppressions.Add(Suppression{MSISDN: "380669999999"})
+			addr := serveSMPPFrontend(t, f)
+			defer f.Close()
+
+			tr, err := smpp.Dial(smpp.Config{Addr: addr, SystemID: "billing", Password: "secret"})
+			if err != nil {
+				t.Fatal("Failed to bind:", err)
+			}
+			defer tr.Close()
+
+			if _, err := tr.Submit(c.m); err != smpp.StatusError(c.status) {
+				t.Errorf("Got error: %v, expected: %v", err, smpp.StatusError(c.status))
+			}
+		})
+	}
+}
+
+func TestSMPPFrontendChecksAPIKeys(t *testing.T) {
+	ks := NewMemKeyStore()
+	billing, _ := NewAPIKey("billing", []string{"Bank"}, "")
+	billing.Limits = Limits{DailySegments: 1}
+	ks.Add(billing)
+
+	f := NewSMPPFrontend(&MockedMessenger{id: "msg-1"}, map[string]SMPPAccount{
+		"billing": {Password: "secret", KeyID: billing.ID},
+		"crm":     {Password: "secret"},
+	})
+	f.Keys = ks
+	f.Quotas = NewQuotas()
+	addr := serveSMPPFrontend(t, f)
+	defer f.Close()
+
+	cases := []struct {
+		systemID   string
+		originator string
+		status     uint32
+	}{
+		{systemID: "billing", originator: "Shop", status: smpp.StatusInvSrcAdr},
+		{systemID: "billing", originator: "Bank", status: smpp.StatusOK},
+		// Daily quota of key is used up.
+		{systemID: "billing", originator: "Bank", status: smpp.StatusSubmitFail},
+		{systemID: "crm", originator: "Bank", status: smpp.StatusSubmitFail},
+	}
+
+	for _, c := range cases {
+		tr, err := smpp.Dial(smpp.Config{Addr: addr, SystemID: c.systemID, Password: "secret"})
+		if err != nil {
+			t.Fatal("Failed to bind:", err)
+		}
+
+		_, err = tr.Submit(smpp.Message{SourceAddr: c.originator, DestAddr: "380660000000", ShortMessage: []byte("Hola")})
+		if c.status == smpp.StatusOK && err != nil {
+			t.Errorf("Got error: %v, expected none for %s from %s", err, c.systemID, c.originator)
+		}
+		if c.status != smpp.StatusOK && err != smpp.StatusError(c.status) {
+			t.Errorf("Got error: %v, expected: %v for %s from %s", err, smpp.StatusError(c.status), c.systemID, c.originator)
+		}
+
+		tr.Close()
+	}
+}
+
+func TestSMPPFrontendRejectsUnknownSystem(t *testing.T) {
+	f := NewSMPPFrontend(&MockedMessenger{}, map[string]SMPPAccount{"billing": {Password: "secret"}})
+	addr := serveSMPPFrontend(t, f)
+	defer f.Close()
+
+	for _, creds := range [][2]string{{"billing", "wrong"}, {"crm", "secret"}} {
+		if _, err := smpp.Dial(smpp.Config{Addr: addr, SystemID: creds[0], Password: creds[1]}); err != smpp.StatusError(smpp.StatusBindFail) {
+			t.Errorf("Got error: %v, expected: %v for %s", err, smpp.StatusError(smpp.StatusBindFail), creds[0])
+		}
+	}
+}
+
+func TestDecodeSMPPBody(t *testing.T) {
+	cases := []struct {
+		coding   byte
+		b        []byte
+		expected string
+	}{
+		{coding: smpp.CodingDefault, b: encodeGSM7("€5 @"), expected: "€5 @"},
+		{coding: smpp.CodingIA5, b: []byte("Hola"), expected: "Hola"},
+		{coding: smpp.CodingLatin1, b: []byte{'S', 0xED}, expected: "Sí"},
+		{coding: smpp.CodingUCS2, b: UCS2.encode("Привіт"), expected: "Привіт"},
+	}
+
+	for _, c := range cases {
+		body, err := decodeSMPPBody(c.coding, c.b)
+		if err != nil {
+			t.Errorf("Unexpected error: %v for data coding: %d", err, c.coding)
+		}
+		if body != c.expected {
+			t.Errorf("Got body: %q, expected: %q", body, c.expected)
+		}
+	}
+
+	if _, err := decodeSMPPBody(0x04, nil); err != errDataCoding {
+		t.Errorf("Got error: %v, expected: %v", err, errDataCoding)
+	}
+}
+
+func TestParseSMPPAccounts(t *testing.T) {
+	accounts, err := parseSMPPAccounts(strings.NewReader("# system_id,password,key_id\nbilling,s3cret, key1\ncrm, pass\n"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	expected := map[string]SMPPAccount{"billing": {Password: "s3cret", KeyID: "key1"}, "crm": {Password: "pass"}}
+	if !reflect.DeepEqual(accounts, expected) {
+		t.Errorf("Got accounts: %v, expected: %v", accounts, expected)
+	}
+
+	for _, bad := range []string{
+		"billing\n",
+		",secret\n",
+		"billing,\n",
+		"billing,toolongpassword\n",
+		"billing,a\nbilling,b\n",
+		"billing,a,key1,extra\n",
+	} {
+		if _, err := parseSMPPAccounts(strings.NewReader(bad)); err == nil {
+			t.Errorf("Got no error for: %q", bad)
+		}
+	}
+}
+
+func serveSMPPFrontend(t *testing.T, f *SMPPFrontend) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go f.Serve(ln)
+
+	return ln.Addr().String()
+}
@@ -0,0 +1,203 @@
+package smsd
+
+import (
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/cooldarkdryplace/sms-service/smpp"
+)
+
+// SMPPProvider sends SMS to SMSC over SMPP 3.4 transceiver session.
+// Session is established on first SMS and again after it is lost.
+type SMPPProvider struct {
+	cfg      smpp.Config
+	onReport func(Report)
+	// OnInbound takes mobile originated messages SMSC delivers, they are dropped if it is nil.
+	OnInbound func(InboundPart)
+
+	mu sync.Mutex
+	t  *smpp.Transceiver
+}
+
+// NewSMPPProvider creates Provider for SMSC. Delivery receipts are passed to onReport, if it is not nil.
+func NewSMPPProvider(cfg smpp.Config, onReport func(Report)) *SMPPProvider {
+	p := &SMPPProvider{
+		onReport: onReport,
+	}
+
+	cfg.OnDeliver = p.deliver
+	p.cfg = cfg
+
+	return p
+}
+
+// Send submits SMS with submit_sm, UDH is put in front of short message and marked in esm_class.
+func (p *SMPPProvider) Send(m Msg) (string, error) {
+	t, err := p.session()
+	if err != nil {
+		return "", &SendError{Kind: Temporary, Err: err}
+	}
+
+	sm, err := toSubmitSM(m)
+	if err != nil {
+		return "", &SendError{Kind: Permanent, Err: err}
+	}
+
+	id, err := t.Submit(sm)
+	if err != nil {
+		return "", classifySMPPError(err)
+	}
+
+	return id, nil
+}
+
+// Close unbinds session if it is established.
+func (p *SMPPProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.t == nil {
+		return nil
+	}
+
+	return p.t.Close()
+}
+
+// session returns bound transceiver, connecting again if previous session is lost.
+func (p *SMPPProvider) session() (*smpp.Transceiver, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.t != nil {
+		select {
+		case <-p.t.Done():
+		default:
+			return p.t, nil
+		}
+	}
+
+	t, err := smpp.Dial(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.t = t
+
+	return t, nil
+}
+
+// deliver passes delivery receipts to report callback and mobile originated messages to OnInbound.
+func (p *SMPPProvider) deliver(m smpp.Message) {
+	if r, ok := smpp.ParseReceipt(m); ok {
+		if p.onReport != nil {
+			p.onReport(Report{
+				ProviderID: r.MessageID,
+				State:      receiptState(r.State),
+				Reason:     r.Err,
+			})
+		}
+		return
+	}
+
+	if p.OnInbound == nil {
+		return
+	}
+
+	part, err := fromDeliverSM(m)
+	if err != nil {
+		log.Printf("Dropped deliver_sm from %s: %s\n", m.SourceAddr, err)
+		return
+	}
+	p.OnInbound(part)
+}
+
+// receiptState maps SMPP message state to State.
+func receiptState(state string) State {
+	switch state {
+	case smpp.StateDelivered:
+		return StateDelivered
+	case smpp.StateEnroute, smpp.StateAccepted:
+		return StateSubmitted
+	default:
+		return StateFailed
+	}
+}
+
+// toSubmitSM builds submit_sm body, delivery receipt is always requested.
+func toSubmitSM(m Msg) (smpp.Message, error) {
+	sm := smpp.Message{
+		SourceAddrTON:      smpp.TONAlphanumeric,
+		SourceAddrNPI:      smpp.NPIUnknown,
+		SourceAddr:         m.Originator,
+		DestAddrTON:        smpp.TONInternational,
+		DestAddrNPI:        smpp.NPIISDN,
+		DestAddr:           m.Recipient,
+		RegisteredDelivery: 1,
+		DataCoding:         smpp.CodingDefault,
+	}
+
+	if MSISDNRegex.MatchString(m.Originator) {
+		sm.SourceAddrTON = smpp.TONInternational
+		sm.SourceAddrNPI = smpp.NPIISDN
+	}
+
+	if m.Encoding == UCS2 {
+		sm.DataCoding = smpp.CodingUCS2
+	}
+
+	if m.Header != nil && m.Header.IsSet() {
+		udh, err := hex.DecodeString(m.Header.ToHexStr())
+		if err != nil {
+			return smpp.Message{}, err
+		}
+		sm.ESMClass = smpp.ESMUDHI
+		sm.ShortMessage = udh
+	}
+	sm.ShortMessage = append(sm.ShortMessage, m.Encoding.encode(m.Body)...)
+
+	return sm, nil
+}
+
+// fromDeliverSM extracts mobile originated SMS from deliver_sm, UDH is split from short message if esm_class marks it.
+func fromDeliverSM(m smpp.Message) (InboundPart, error) {
+	part := InboundPart{
+		Originator: strings.TrimPrefix(m.SourceAddr, "+"),
+		Recipient:  strings.TrimPrefix(m.DestAddr, "+"),
+	}
+
+	payload := m.Payload()
+	if m.ESMClass&smpp.ESMUDHI != 0 {
+		h, err := ParseHeader(payload)
+		if err != nil {
+			return InboundPart{}, err
+		}
+		part.Header = h
+		payload = payload[int(payload[0])+1:]
+	}
+
+	body, err := decodeSMPPBody(m.DataCoding, payload)
+	if err != nil {
+		return InboundPart{}, err
+	}
+	part.Body = body
+
+	return part, nil
+}
+
+// classifySMPPError wraps transceiver error into SendError. Lost connections and timeouts are temporary.
+func classifySMPPError(err error) error {
+	status, ok := err.(smpp.StatusError)
+	if !ok {
+		return &SendError{Kind: Temporary, Err: err}
+	}
+
+	switch uint32(status) {
+	case smpp.StatusThrottled, smpp.StatusMsgQFul:
+		return &SendError{Kind: Throttled, Err: err}
+	case smpp.StatusSysErr:
+		return &SendError{Kind: Temporary, Err: err}
+	default:
+		return &SendError{Kind: Permanent, Err: err}
+	}
+}
@@ -0,0 +1,151 @@
+package smsd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cooldarkdryplace/sms-service/smpp"
+)
+
+func TestToSubmitSM(t *testing.T) {
+	sm, err := toSubmitSM(Msg{
+		Originator: "Bank",
+		Recipient:  "380660000000",
+		Header:     mustHeader(NewRefUDH(7, 2, 1)),
+		Body:       "Пр",
+		Encoding:   UCS2,
+	})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if sm.ESMClass != smpp.ESMUDHI || sm.DataCoding != smpp.CodingUCS2 || sm.RegisteredDelivery != 1 {
+		t.Errorf("Got esm_class: %X, data_coding: %X, registered_delivery: %d", sm.ESMClass, sm.DataCoding, sm.RegisteredDelivery)
+	}
+	if sm.SourceAddrTON != smpp.TONAlphanumeric || sm.DestAddrTON != smpp.TONInternational {
+		t.Errorf("Got source TON: %d, destination TON: %d", sm.SourceAddrTON, sm.DestAddrTON)
+	}
+
+	expected := []byte{0x05, 0x00, 0x03, 0x07, 0x02, 0x01, 0x04, 0x1F, 0x04, 0x40}
+	if !bytes.Equal(sm.ShortMessage, expected) {
+		t.Errorf("Got short message: % X, expected: % X", sm.ShortMessage, expected)
+	}
+
+	sm, _ = toSubmitSM(Msg{Originator: "380670000000", Body: "€1 @"})
+	if sm.ESMClass != 0 || sm.SourceAddrTON != smpp.TONInternational {
+		t.Errorf("Got esm_class: %X, source TON: %d", sm.ESMClass, sm.SourceAddrTON)
+	}
+	if expected := []byte{0x1B, 0x65, '1', ' ', 0x00}; !bytes.Equal(sm.ShortMessage, expected) {
+		t.Errorf("Got short message: % X, expected: % X", sm.ShortMessage, expected)
+	}
+}
+
+func TestClassifySMPPError(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{err: smpp.StatusError(smpp.StatusThrottled), kind: Throttled},
+		{err: smpp.StatusError(smpp.StatusMsgQFul), kind: Throttled},
+		{err: smpp.StatusError(smpp.StatusSysErr), kind: Temporary},
+		{err: smpp.StatusError(smpp.StatusInvDstAdr), kind: Permanent},
+		{err: smpp.ErrTimeout, kind: Temporary},
+		{err: errors.New("connection reset"), kind: Temporary},
+	}
+
+	for _, c := range cases {
+		if kind := errorKind(classifySMPPError(c.err)); kind != c.kind {
+			t.Errorf("Got kind: %s, expected: %s for: %v", kind, c.kind, c.err)
+		}
+	}
+}
+
+func TestSMPPProviderSendsAndReportsReceipts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go serveFakeSMSC(ln)
+
+	reports := make(chan Report, 1)
+	p := NewSMPPProvider(smpp.Config{Addr: ln.Addr().String(), SystemID: "smsd"}, func(r Report) {
+		reports <- r
+	})
+	defer p.Close()
+
+	id, err := p.Send(Msg{Originator: "Bank", Recipient: "380660000000", Body: "Hola"})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if id != "smsc-1" {
+		t.Errorf("Got ID: %q, expected: %q", id, "smsc-1")
+	}
+
+	select {
+	case r := <-reports:
+		if r.ProviderID != id || r.State != StateDelivered {
+			t.Errorf("Got report: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No report received")
+	}
+}
+
+// serveFakeSMSC accepts any bind, answers submit_sm and sends delivery receipt for it.
+func serveFakeSMSC(ln net.Listener) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		p, err := smpp.ReadPDU(conn)
+		if err != nil {
+			return
+		}
+
+		switch p.CommandID {
+		case smpp.BindTransceiver:
+			smpp.WritePDU(conn, smpp.PDU{CommandID: smpp.BindTransceiverResp, Sequence: p.Sequence, Body: smpp.CString("fake")})
+		case smpp.SubmitSM:
+			smpp.WritePDU(conn, smpp.PDU{CommandID: smpp.SubmitSMResp, Sequence: p.Sequence, Body: smpp.CString("smsc-1")})
+
+			receipt := smpp.Message{
+				ESMClass:     smpp.ESMDeliveryReceipt,
+				ShortMessage: []byte("id:smsc-1 sub:001 dlvrd:001 submit date:1709011000 done date:1709011001 stat:DELIVRD err:000 text:"),
+			}
+			smpp.WritePDU(conn, smpp.PDU{CommandID: smpp.DeliverSM, Sequence: 1, Body: receipt.Bytes()})
+		case smpp.Unbind:
+			smpp.WritePDU(conn, smpp.PDU{CommandID: smpp.UnbindResp, Sequence: p.Sequence})
+			return
+		}
+	}
+}
+
+func TestFromDeliverSM(t *testing.T) {
+	part, err := fromDeliverSM(smpp.Message{
+		SourceAddr:   "+380501234567",
+		DestAddr:     "4915112345678",
+		ESMClass:     smpp.ESMUDHI,
+		DataCoding:   smpp.CodingUCS2,
+		ShortMessage: []byte{0x05, 0x00, 0x03, 0x07, 0x02, 0x01, 0x04, 0x1F, 0x04, 0x40},
+	})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	expected := InboundPart{Originator: "380501234567", Recipient: "4915112345678", Body: "Пр", Header: mustHeader(NewRefUDH(7, 2, 1))}
+	if part != expected {
+		t.Errorf("Got part: %+v, expected: %+v", part, expected)
+	}
+
+	if _, err := fromDeliverSM(smpp.Message{ESMClass: smpp.ESMUDHI, ShortMessage: []byte{0x05, 0x00}}); err != ErrInvalidUDH {
+		t.Errorf("Got error: %v, expected: %v", err, ErrInvalidUDH)
+	}
+}
@@ -0,0 +1,395 @@
+package smsd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when there is no message with requested ID.
+var ErrNotFound = errors.New("message not found")
+
+// State is a lifecycle state of SMS.
+type State string
+
+// Message goes from queued to submitted when gateway accepts it,
+// and then to delivered or failed when gateway reports back.
+const (
+	StateQueued    State = "queued"
+	StateSubmitted State = "submitted"
+	StateDelivered State = "delivered"
+	StateFailed    State = "failed"
+)
+
+// Report is delivery status of single SMS that gateway sent back.
+type Report struct {
+	// Provider is name of gateway that sent report, provider IDs are unique only within one gateway.
+	Provider   string
+	ProviderID string
+	State      State
+	// Reason gateway error code or description for failed SMS.
+	Reason string
+}
+
+// SegmentStatus is a state of single SMS. Messages that fit in one SMS have one segment.
+type SegmentStatus struct {
+	Segment    int       `json:"segment"`
+	State      State     `json:"state"`
+	Provider   string    `json:"provider,omitempty"`
+	ProviderID string    `json:"provider_id,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Status is a state of message and all its segments.
+type Status struct {
+	ID string `json:"id"`
+	// Tenant is ID of API key message was sent with, only this key can see the status.
+	Tenant   string          `json:"-"`
+	State    State           `json:"state"`
+	Segments []SegmentStatus `json:"segments"`
+}
+
+// Tracker keeps lifecycle state of accepted messages.
+type Tracker interface {
+	// Track registers new message of tenant with all segments queued.
+	Track(id, tenant string, segments int) error
+	// Update sets state of segment, provider and providerID are kept if providerID is empty.
+	Update(id string, segment int, state State, provider, providerID string) error
+	// Status returns ErrNotFound if message is unknown.
+	Status(id string) (Status, error)
+	// Lookup finds segment that gateway provider accepted with providerID, ErrNotFound is returned if there is none.
+	Lookup(provider, providerID string) (id string, segment int, err error)
+	// Report applies delivery report to segment SMS belongs to, ErrNotFound is returned if there is none.
+	// changed is false if state of segment stays the same.
+	Report(r Report) (id string, segment int, changed bool, err error)
+}
+
+// DefaultStatusTTL is how long memory Tracker keeps status of message after its last change.
+const DefaultStatusTTL = 72 * time.Hour
+
+// earlyReportTTL is how long memory Tracker keeps report that came before gateway answered with provider ID.
+const earlyReportTTL = 10 * time.Minute
+
+// memTracker keeps statuses in memory, so they are lost on restart.
+// Messages are forgotten when they did not change for ttl.
+type memTracker struct {
+	mu       sync.RWMutex
+	statuses map[string][]SegmentStatus
+	tenants  map[string]string
+	// segments maps provider IDs to message ID and segment.
+	segments map[providerKey]segmentRef
+	// early keeps reports that are not matched yet, gateway can send report before it answers with provider ID.
+	early  map[providerKey]earlyReport
+	ttl    time.Duration
+	pruned time.Time
+	now    func() time.Time
+}
+
+// providerKey is provider ID of SMS within gateway that accepted it. Provider is empty if SMS was sent
+// through a single unnamed gateway, such SMS match reports of any gateway.
+type providerKey struct {
+	provider string
+	id       string
+}
+
+type earlyReport struct {
+	report     Report
+	receivedAt time.Time
+}
+
+type segmentRef struct {
+	id      string
+	segment int
+	// state of SMS with provider ID, segment that gateway split itself has several of them.
+	state State
+}
+
+// NewMemTracker creates Tracker that keeps statuses in memory for DefaultStatusTTL.
+// Statuses do not survive restart.
+func NewMemTracker() Tracker {
+	return NewMemTrackerTTL(DefaultStatusTTL)
+}
+
+// NewMemTrackerTTL creates Tracker that keeps statuses in memory until they did not change for ttl.
+func NewMemTrackerTTL(ttl time.Duration) Tracker {
+	return &memTracker{
+		statuses: make(map[string][]SegmentStatus),
+		tenants:  make(map[string]string),
+		segments: make(map[providerKey]segmentRef),
+		early:    make(map[providerKey]earlyReport),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// Track registers new message of tenant with all segments queued.
+func (t *memTracker) Track(id, tenant string, segments int) error {
+	now := t.now().UTC()
+
+	s := make([]SegmentStatus, segments)
+	for i := range s {
+		s[i] = SegmentStatus{
+			Segment:   i + 1,
+			State:     StateQueued,
+			UpdatedAt: now,
+		}
+	}
+
+	t.mu.Lock()
+	t.statuses[id] = s
+	if tenant != "" {
+		t.tenants[id] = tenant
+	}
+	t.prune(now)
+	t.mu.Unlock()
+
+	return nil
+}
+
+// prune forgets messages that did not change for ttl and their provider IDs, and reports that were not matched
+// in time. Caller has to hold the lock.
+func (t *memTracker) prune(now time.Time) {
+	if now.Sub(t.pruned) < time.Minute {
+		return
+	}
+	t.pruned = now
+
+	for id, s := range t.statuses {
+		var updated time.Time
+		for _, seg := range s {
+			if seg.UpdatedAt.After(updated) {
+				updated = seg.UpdatedAt
+			}
+		}
+		if now.Sub(updated) <= t.ttl {
+			continue
+		}
+
+		for _, seg := range s {
+			if seg.ProviderID == "" {
+				continue
+			}
+			for _, pid := range strings.Split(seg.ProviderID, ",") {
+				delete(t.segments, providerKey{provider: seg.Provider, id: pid})
+			}
+		}
+		delete(t.statuses, id)
+		delete(t.tenants, id)
+	}
+
+	for key, e := range t.early {
+		if now.Sub(e.receivedAt) > earlyReportTTL {
+			delete(t.early, key)
+		}
+	}
+}
+
+// Update sets state of segment, provider and providerID are kept if providerID is empty.
+// Reports that came for providerID before are applied right after.
+func (t *memTracker) Update(id string, segment int, state State, provider, providerID string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.statuses[id]
+	if !ok || segment < 1 || segment > len(s) {
+		return ErrNotFound
+	}
+
+	seg := &s[segment-1]
+	seg.State = state
+	seg.UpdatedAt = t.now().UTC()
+	if providerID == "" {
+		return nil
+	}
+
+	seg.Provider = provider
+	seg.ProviderID = providerID
+
+	// Gateways that split long messages themselves return comma separated IDs of parts and report each of them.
+	pids := strings.Split(providerID, ",")
+	for _, pid := range pids {
+		t.segments[providerKey{provider: provider, id: pid}] = segmentRef{id: id, segment: segment, state: state}
+	}
+
+	for _, pid := range pids {
+		for _, r := range t.takeEarly(provider, pid) {
+			t.report(r)
+		}
+	}
+
+	return nil
+}
+
+// takeEarly removes reports that came for providerID before it was known and returns them.
+// SMS of unnamed gateway take reports of any provider. Caller has to hold the lock.
+func (t *memTracker) takeEarly(provider, providerID string) []Report {
+	if provider != "" {
+		key := providerKey{provider: provider, id: providerID}
+		e, ok := t.early[key]
+		if !ok {
+			return nil
+		}
+		delete(t.early, key)
+
+		return []Report{e.report}
+	}
+
+	var reports []Report
+	for key, e := range t.early {
+		if key.id == providerID {
+			delete(t.early, key)
+			reports = append(reports, e.report)
+		}
+	}
+
+	return reports
+}
+
+// Lookup finds segment that gateway provider accepted with providerID.
+func (t *memTracker) Lookup(provider, providerID string) (string, int, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	_, ref, ok := t.lookup(provider, providerID)
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+
+	return ref.id, ref.segment, nil
+}
+
+// lookup finds segment of provider ID, SMS of unnamed gateway are found for any provider. Caller has to hold the lock.
+func (t *memTracker) lookup(provider, providerID string) (providerKey, segmentRef, bool) {
+	key := providerKey{provider: provider, id: providerID}
+	if ref, ok := t.segments[key]; ok {
+		return key, ref, true
+	}
+
+	key.provider = ""
+	ref, ok := t.segments[key]
+
+	return key, ref, ok
+}
+
+// Report sets state of SMS gateway accepted with provider ID of report. Segment gateway split itself gets
+// combined state of its parts the same way message gets it from segments, so it is final only when all parts are.
+// Final states do not change. Report that matches no SMS is kept for a while, gateway can send it before it
+// answers with provider ID, it is applied by Update then.
+func (t *memTracker) Report(r Report) (string, int, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id, segment, changed, err := t.report(r)
+	if err == ErrNotFound {
+		now := t.now().UTC()
+		t.early[providerKey{provider: r.Provider, id: r.ProviderID}] = earlyReport{report: r, receivedAt: now}
+		t.prune(now)
+	}
+
+	return id, segment, changed, err
+}
+
+// report applies delivery report to segment it matches. Caller has to hold the lock.
+func (t *memTracker) report(r Report) (string, int, bool, error) {
+	key, ref, ok := t.lookup(r.Provider, r.ProviderID)
+	if !ok {
+		return "", 0, false, ErrNotFound
+	}
+
+	s, ok := t.statuses[ref.id]
+	if !ok || ref.segment > len(s) {
+		return "", 0, false, ErrNotFound
+	}
+
+	seg := &s[ref.segment-1]
+	if isFinal(seg.State) || isFinal(ref.state) {
+		return ref.id, ref.segment, false, nil
+	}
+
+	ref.state = r.State
+	t.segments[key] = ref
+
+	parts := strings.Split(seg.ProviderID, ",")
+	states := make([]SegmentStatus, 0, len(parts))
+	for _, pid := range parts {
+		states = append(states, SegmentStatus{State: t.segments[providerKey{provider: key.provider, id: pid}].state})
+	}
+
+	state := overallState(states)
+	if state == seg.State {
+		return ref.id, ref.segment, false, nil
+	}
+
+	seg.State = state
+	seg.UpdatedAt = t.now().UTC()
+
+	return ref.id, ref.segment, true, nil
+}
+
+// Status returns copy of message status.
+func (t *memTracker) Status(id string) (Status, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s, ok := t.statuses[id]
+	if !ok {
+		return Status{}, ErrNotFound
+	}
+
+	segments := make([]SegmentStatus, len(s))
+	copy(segments, s)
+
+	return Status{
+		ID:       id,
+		Tenant:   t.tenants[id],
+		State:    overallState(segments),
+		Segments: segments,
+	}, nil
+}
+
+// overallState sums up segment states. Message is final only when all segments are:
+// it is delivered if all of them are delivered and failed if any of them failed.
+// Until then message is submitted when all segments are at least submitted.
+func overallState(segments []SegmentStatus) State {
+	delivered, submitted, failed := 0, 0, 0
+
+	for _, s := range segments {
+		switch s.State {
+		case StateFailed:
+			failed++
+		case StateDelivered:
+			delivered++
+		case StateSubmitted:
+			submitted++
+		}
+	}
+
+	switch {
+	case delivered+failed == len(segments) && failed != 0:
+		return StateFailed
+	case delivered == len(segments):
+		return StateDelivered
+	case delivered+submitted+failed == len(segments):
+		return StateSubmitted
+	default:
+		return StateQueued
+	}
+}
+
+// isFinal returns true for states that do not change anymore.
+func isFinal(s State) bool {
+	return s == StateDelivered || s == StateFailed
+}
+
+// newID generates random message ID.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// System random generator is broken, nothing good can happen after that.
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
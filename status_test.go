@@ -0,0 +1,218 @@
+package smsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemTracker(t *testing.T) {
+	tracker := NewMemTracker()
+
+	if err := tracker.Track("42", "billing", 2); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	steps := []struct {
+		segment int
+		state   State
+		want    State
+	}{
+		{segment: 1, state: StateSubmitted, want: StateQueued},
+		{segment: 2, state: StateSubmitted, want: StateSubmitted},
+		{segment: 1, state: StateDelivered, want: StateSubmitted},
+		{segment: 2, state: StateDelivered, want: StateDelivered},
+	}
+
+	for _, s := range steps {
+		if err := tracker.Update("42", s.segment, s.state, "", ""); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		status, err := tracker.Status("42")
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if status.State != s.want {
+			t.Errorf("Got state: %q, expected: %q", status.State, s.want)
+		}
+		if status.Tenant != "billing" {
+			t.Errorf("Got tenant: %q, expected: %q", status.Tenant, "billing")
+		}
+	}
+}
+
+func TestMemTrackerForgetsOldStatuses(t *testing.T) {
+	now := time.Now()
+	tracker := NewMemTrackerTTL(time.Hour).(*memTracker)
+	tracker.now = func() time.Time { return now }
+
+	tracker.Track("old", "", 1)
+	tracker.Update("old", 1, StateDelivered, "", "p1")
+
+	now = now.Add(2 * time.Hour)
+	tracker.Track("new", "", 1)
+
+	if _, err := tracker.Status("old"); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v for message older than TTL", err, ErrNotFound)
+	}
+	if _, _, err := tracker.Lookup("", "p1"); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v for provider ID of forgotten message", err, ErrNotFound)
+	}
+	if _, err := tracker.Status("new"); err != nil {
+		t.Errorf("Got error: %v, expected new message to be kept", err)
+	}
+}
+
+func TestMemTrackerKeepsProviderID(t *testing.T) {
+	tracker := NewMemTracker()
+	tracker.Track("42", "", 1)
+	tracker.Update("42", 1, StateSubmitted, "", "mb1")
+	tracker.Update("42", 1, StateDelivered, "", "")
+
+	status, _ := tracker.Status("42")
+	if status.Segments[0].ProviderID != "mb1" {
+		t.Errorf("Got provider ID: %q, expected: %q", status.Segments[0].ProviderID, "mb1")
+	}
+}
+
+func TestMemTrackerUnknownMessage(t *testing.T) {
+	tracker := NewMemTracker()
+	tracker.Track("42", "", 1)
+
+	if _, err := tracker.Status("43"); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+	if err := tracker.Update("43", 1, StateFailed, "", ""); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+	if err := tracker.Update("42", 2, StateFailed, "", ""); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+}
+
+func TestOverallStateFailsIfAnySegmentFailed(t *testing.T) {
+	segments := []SegmentStatus{{State: StateDelivered}, {State: StateFailed}}
+
+	if s := overallState(segments); s != StateFailed {
+		t.Errorf("Got state: %q, expected: %q", s, StateFailed)
+	}
+}
+
+func TestNewIDIsUnique(t *testing.T) {
+	if newID() == newID() {
+		t.Error("Got the same ID twice")
+	}
+}
+
+func TestMemTrackerLookup(t *testing.T) {
+	tracker := NewMemTracker()
+	tracker.Track("42", "", 2)
+	tracker.Update("42", 1, StateSubmitted, "", "mb1")
+	tracker.Update("42", 2, StateSubmitted, "", "vn1,vn2")
+
+	cases := []struct {
+		providerID string
+		segment    int
+	}{
+		{providerID: "mb1", segment: 1},
+		{providerID: "vn1", segment: 2},
+		{providerID: "vn2", segment: 2},
+	}
+
+	for _, c := range cases {
+		id, segment, err := tracker.Lookup("", c.providerID)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if id != "42" || segment != c.segment {
+			t.Errorf("Got message %s segment %d, expected: 42 segment %d for %s", id, segment, c.segment, c.providerID)
+		}
+	}
+
+	if _, _, err := tracker.Lookup("", "unknown"); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+}
+
+func TestMemTrackerReportWaitsForAllParts(t *testing.T) {
+	tracker := NewMemTracker()
+	tracker.Track("42", "", 1)
+	tracker.Update("42", 1, StateSubmitted, "", "vn1,vn2")
+
+	steps := []struct {
+		report  Report
+		changed bool
+		want    State
+	}{
+		{report: Report{ProviderID: "vn1", State: StateDelivered}, changed: false, want: StateSubmitted},
+		{report: Report{ProviderID: "vn2", State: StateDelivered}, changed: true, want: StateDelivered},
+		{report: Report{ProviderID: "vn2", State: StateFailed}, changed: false, want: StateDelivered},
+	}
+
+	for _, s := range steps {
+		id, segment, changed, err := tracker.Report(s.report)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if id != "42" || segment != 1 || changed != s.changed {
+			t.Errorf("Got message %s segment %d changed %t, expected: 42 segment 1 changed %t after %+v",
+				id, segment, changed, s.changed, s.report)
+		}
+
+		status, _ := tracker.Status("42")
+		if status.State != s.want {
+			t.Errorf("Got state: %q, expected: %q after %+v", status.State, s.want, s.report)
+		}
+	}
+
+	if _, _, _, err := tracker.Report(Report{ProviderID: "unknown"}); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+}
+
+func TestMemTrackerKeepsProvidersApart(t *testing.T) {
+	tracker := NewMemTracker()
+	tracker.Track("twilio-msg", "", 1)
+	tracker.Track("vonage-msg", "", 1)
+	tracker.Update("twilio-msg", 1, StateSubmitted, "twilio", "x1")
+	tracker.Update("vonage-msg", 1, StateSubmitted, "vonage", "x1")
+
+	id, _, _, err := tracker.Report(Report{Provider: "vonage", ProviderID: "x1", State: StateDelivered})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if id != "vonage-msg" {
+		t.Errorf("Got message %s, expected: vonage-msg", id)
+	}
+
+	if status, _ := tracker.Status("twilio-msg"); status.State != StateSubmitted {
+		t.Errorf("Got state: %q, expected: %q for SMS of other gateway", status.State, StateSubmitted)
+	}
+	if _, _, err := tracker.Lookup("smpp", "x1"); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+}
+
+func TestMemTrackerAppliesEarlyReport(t *testing.T) {
+	tracker := NewMemTracker()
+	tracker.Track("42", "", 1)
+
+	// Gateway reports SMS before sending loop got its ID.
+	if _, _, _, err := tracker.Report(Report{Provider: "smpp", ProviderID: "s1", State: StateDelivered}); err != ErrNotFound {
+		t.Errorf("Got error: %v, expected: %v", err, ErrNotFound)
+	}
+
+	tracker.Update("42", 1, StateSubmitted, "smpp", "s1")
+
+	if status, _ := tracker.Status("42"); status.State != StateDelivered {
+		t.Errorf("Got state: %q, expected: %q", status.State, StateDelivered)
+	}
+}
+
+func TestOverallStateWaitsForAllSegments(t *testing.T) {
+	segments := []SegmentStatus{{State: StateFailed}, {State: StateSubmitted}}
+
+	if s := overallState(segments); s != StateSubmitted {
+		t.Errorf("Got state: %q, expected: %q", s, StateSubmitted)
+	}
+}
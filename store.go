@@ -0,0 +1,432 @@
+package smsd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// compactEvery number of records appended to the log after which it is rewritten with pending messages only.
+const compactEvery = 10000
+
+// Store keeps queued messages, so they are not lost if process stops before sending them.
+type Store interface {
+	// Put saves messages before they are queued. Either all of them are saved or none.
+	Put(msgs []Msg) error
+	// Done removes message that does not need to be sent anymore.
+	Done(m Msg) error
+	// Pending returns messages that were put but are not done, in order they were put.
+	Pending() ([]Msg, error)
+	Close() error
+}
+
+// nopStore does not persist anything, messages are kept only in queue.
+type nopStore struct{}
+
+func (nopStore) Put(msgs []Msg) error    { return nil }
+func (nopStore) Done(m Msg) error        { return nil }
+func (nopStore) Pending() ([]Msg, error) { return nil, nil }
+func (nopStore) Close() error            { return nil }
+
+// logRecord is a line of FileStore log.
+// Put record holds all messages of a batch, so batch is either saved or lost as a whole.
+type logRecord struct {
+	Op   string      `json:"op"`
+	Msgs []storedMsg `json:"msgs,omitempty"`
+	Key  string      `json:"key,omitempty"`
+}
+
+const (
+	opPut  = "put"
+	opDone = "done"
+)
+
+// storedMsg is a serializable form of Msg.
+type storedMsg struct {
+	ID          string    `json:"id"`
+	Segment     int       `json:"segment"`
+	Segments    int       `json:"segments"`
+	Header      string    `json:"header,omitempty"`
+	Body        string    `json:"body"`
+	Originator  string    `json:"originator"`
+	Recipient   string    `json:"recipient"`
+	Encoding    Encoding  `json:"encoding"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Priority    Priority  `json:"priority,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+// pendingMsg is a message that is not done yet with its position in the log.
+type pendingMsg struct {
+	seq int
+	msg storedMsg
+}
+
+// FileStore is an append-only log of queued and done messages.
+// Log is replayed when store is opened, and compacted so it does not grow forever.
+type FileStore struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	seq      int
+	appended int
+	pending  map[string]pendingMsg
+}
+
+// OpenFileStore opens or creates log file on provided path and loads pending messages from it.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:    path,
+		pending: make(map[string]pendingMsg),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Put appends messages to the log and syncs it to disk.
+func (s *FileStore) Put(msgs []Msg) error {
+	rec := logRecord{Op: opPut, Msgs: make([]storedMsg, 0, len(msgs))}
+	for _, m := range msgs {
+		rec.Msgs = append(rec.Msgs, toStoredMsg(m))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+
+	return nil
+}
+
+// Done appends record that message was processed.
+func (s *FileStore) Done(m Msg) error {
+	rec := logRecord{Op: opDone, Key: msgKey(m.ID, m.Segment)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+
+	if s.appended >= compactEvery {
+		return s.compact()
+	}
+
+	return nil
+}
+
+// Pending returns messages that are not done, in order they were put.
+func (s *FileStore) Pending() ([]Msg, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.sortedPending()
+
+	msgs := make([]Msg, 0, len(pending))
+	for _, p := range pending {
+		m, err := fromStoredMsg(p.msg)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+// Close closes log file.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// load replays log file.
+func (s *FileStore) load() error {
+	return replayLog(s.path, func(line []byte) error {
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		s.apply(rec)
+
+		return nil
+	})
+}
+
+// apply updates pending messages with log record.
+func (s *FileStore) apply(rec logRecord) {
+	switch rec.Op {
+	case opPut:
+		for _, m := range rec.Msgs {
+			s.seq++
+			s.pending[msgKey(m.ID, m.Segment)] = pendingMsg{seq: s.seq, msg: m}
+		}
+	case opDone:
+		delete(s.pending, rec.Key)
+	}
+}
+
+// append writes record to the log and waits for it to reach the disk.
+func (s *FileStore) append(rec logRecord) error {
+	if err := appendLog(s.f, rec); err != nil {
+		return err
+	}
+	s.appended++
+
+	return nil
+}
+
+// compact rewrites log with pending messages only and replaces old log with it.
+func (s *FileStore) compact() error {
+	f, err := rewriteLog(s.path, s.f, func(enc *json.Encoder) error {
+		for _, p := range s.sortedPending() {
+			if err := enc.Encode(logRecord{Op: opPut, Msgs: []storedMsg{p.msg}}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.f = f
+	s.appended = 0
+
+	return nil
+}
+
+// replayLog passes every line of log file on path to apply, missing file is an empty log.
+// Last line is skipped if apply fails on it, as process could die while writing it.
+func replayLog(path string, apply func(line []byte) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var broken int
+	for scanner.Scan() {
+		if err := apply(scanner.Bytes()); err != nil {
+			broken++
+			continue
+		}
+		if broken != 0 {
+			return fmt.Errorf("log %s is corrupted", path)
+		}
+	}
+
+	if broken != 0 {
+		log.Printf("Log %s has unfinished record, skipping it.\n", path)
+	}
+
+	return scanner.Err()
+}
+
+// appendLog writes record to the log file and waits for it to reach the disk.
+func appendLog(f *os.File, rec interface{}) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// rewriteLog writes new log to temporary file with write and replaces log on path with it.
+// Old log file is closed, if there is one, and new one is returned open for appending.
+func rewriteLog(path string, old *os.File, write func(enc *json.Encoder) error) (*os.File, error) {
+	tmpPath := path + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(tmp)
+	if err := write(json.NewEncoder(w)); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+
+	if old != nil {
+		old.Close()
+	}
+
+	return os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+}
+
+// readJSONFile decodes file on path into v, v is left as it is if file does not exist or is empty.
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(v); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// writeJSONFile writes v to temporary file and replaces file on path with it,
+// so file has either old or new content even if process dies while writing.
+func writeJSONFile(path string, v interface{}) error {
+	tmpPath := path + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// sortedPending returns pending messages in order they were put.
+func (s *FileStore) sortedPending() []pendingMsg {
+	pending := make([]pendingMsg, 0, len(s.pending))
+	for _, p := range s.pending {
+		pending = append(pending, p)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].seq < pending[j].seq
+	})
+
+	return pending
+}
+
+// msgKey identifies single SMS in store.
+func msgKey(id string, segment int) string {
+	return fmt.Sprintf("%s/%d", id, segment)
+}
+
+func toStoredMsg(m Msg) storedMsg {
+	sm := storedMsg{
+		ID:          m.ID,
+		Segment:     m.Segment,
+		Segments:    m.Segments,
+		Body:        m.Body,
+		Originator:  m.Originator,
+		Recipient:   m.Recipient,
+		Encoding:    m.Encoding,
+		Tenant:      m.Tenant,
+		Priority:    m.Priority,
+		Attempts:    m.Attempts,
+		NextAttempt: m.NextAttempt,
+	}
+
+	if m.Header != nil && m.Header.IsSet() {
+		sm.Header = m.Header.ToHexStr()
+	}
+
+	return sm
+}
+
+func fromStoredMsg(sm storedMsg) (Msg, error) {
+	m := Msg{
+		ID:          sm.ID,
+		Segment:     sm.Segment,
+		Segments:    sm.Segments,
+		Body:        sm.Body,
+		Originator:  sm.Originator,
+		Recipient:   sm.Recipient,
+		Encoding:    sm.Encoding,
+		Tenant:      sm.Tenant,
+		Priority:    sm.Priority,
+		Attempts:    sm.Attempts,
+		NextAttempt: sm.NextAttempt,
+	}
+
+	if sm.Header == "" {
+		return m, nil
+	}
+
+	b, err := hex.DecodeString(sm.Header)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	switch len(b) {
+	case len(UDH{}):
+		var h UDH
+		copy(h[:], b)
+		m.Header = h
+	case len(UDH16{}):
+		var h UDH16
+		copy(h[:], b)
+		m.Header = h
+	default:
+		return Msg{}, errors.New("stored header has unknown length")
+	}
+
+	return m, nil
+}
@@ -0,0 +1,112 @@
+package smsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStoreReplaysPendingMessages(t *testing.T) {
+	path := tempStorePath(t)
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal("Failed to open store:", err)
+	}
+
+	single := Msg{ID: "1", Segment: 1, Segments: 1, Body: "Hola", Originator: "Bank", Recipient: "380660000000"}
+	parts := []Msg{
+		{ID: "2", Segment: 1, Segments: 2, Header: mustHeader(NewRefUDH(7, 2, 1)), Body: "Привіт", Encoding: UCS2},
+		{ID: "2", Segment: 2, Segments: 2, Header: mustHeader(NewUDH16(7, 2, 2)), Body: "світ", Encoding: UCS2},
+	}
+
+	if err := s.Put([]Msg{single}); err != nil {
+		t.Fatal("Failed to put message:", err)
+	}
+	if err := s.Put(parts); err != nil {
+		t.Fatal("Failed to put messages:", err)
+	}
+	if err := s.Done(parts[0]); err != nil {
+		t.Fatal("Failed to mark message done:", err)
+	}
+	s.Close()
+
+	// Open again as if process restarted.
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal("Failed to reopen store:", err)
+	}
+	defer s.Close()
+
+	pending, err := s.Pending()
+	if err != nil {
+		t.Fatal("Failed to load pending messages:", err)
+	}
+
+	expected := []Msg{single, parts[1]}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Errorf("Got pending: %+v, expected: %+v", pending, expected)
+	}
+}
+
+func TestFileStoreSkipsUnfinishedRecord(t *testing.T) {
+	path := tempStorePath(t)
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal("Failed to open store:", err)
+	}
+	s.Put([]Msg{{ID: "1", Segment: 1, Segments: 1, Body: "Hola"}})
+	s.Close()
+
+	// Process died while writing second batch.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","msgs":[{"id":"2","segm`)
+	f.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal("Failed to reopen store:", err)
+	}
+	defer s.Close()
+
+	pending, _ := s.Pending()
+	if len(pending) != 1 || pending[0].ID != "1" {
+		t.Errorf("Got pending: %+v, expected only message 1", pending)
+	}
+
+	// Log must be usable after compaction removed broken record.
+	if err := s.Put([]Msg{{ID: "3", Segment: 1, Segments: 1}}); err != nil {
+		t.Error("Failed to put message after recovery:", err)
+	}
+}
+
+func TestFileStoreFailsOnCorruptedLog(t *testing.T) {
+	path := tempStorePath(t)
+
+	content := `{"op":"put","msgs":[{"id":"1","segment":1,"segments":1}]}` + "\n" +
+		`garbage` + "\n" +
+		`{"op":"done","key":"1/1"}` + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileStore(path); err == nil {
+		t.Error("Store opened, expected it to fail on broken record in the middle of log.")
+	}
+}
+
+func tempStorePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "smsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "queue.log")
+}
@@ -0,0 +1,311 @@
+package smsd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSuppressed is returned for message to number that opted out.
+	ErrSuppressed = errors.New("recipient opted out")
+	// errNotSuppressed is returned when number that is not in suppression list is removed from it.
+	errNotSuppressed = errors.New("number is not suppressed")
+	// errInvalidMSISDN is returned when number that is not an MSISDN is suppressed.
+	errInvalidMSISDN = errors.New("number is not an MSISDN")
+)
+
+// Replies that opt number out of messages and back in. Reply has to be the keyword alone, case is ignored.
+var (
+	StopKeywords  = []string{"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT"}
+	StartKeywords = []string{"START", "UNSTOP"}
+)
+
+// Suppression is a number that messages are not sent to.
+type Suppression struct {
+	MSISDN    string    `json:"msisdn"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SuppressionList keeps numbers that opted out of messages. Numbers are kept without leading plus,
+// the way recipients are checked against the list.
+type SuppressionList interface {
+	// Add suppresses number, reason and time of existing suppression are replaced.
+	// Number that is not an MSISDN is rejected.
+	Add(s Suppression) error
+	// Remove returns error if number is not suppressed.
+	Remove(msisdn string) error
+	Contains(msisdn string) (bool, error)
+	// List returns suppressions sorted by number.
+	List() ([]Suppression, error)
+}
+
+// memSuppressions keeps suppression list in memory, so it is lost on restart.
+type memSuppressions struct {
+	mu   sync.RWMutex
+	list map[string]Suppression
+}
+
+// NewMemSuppressionList creates SuppressionList that is kept in memory.
+func NewMemSuppressionList() SuppressionList {
+	return &memSuppressions{
+		list: make(map[string]Suppression),
+	}
+}
+
+func (l *memSuppressions) Add(s Suppression) error {
+	s.MSISDN = normalizeMSISDN(s.MSISDN)
+	if !MSISDNRegex.MatchString(s.MSISDN) {
+		return errInvalidMSISDN
+	}
+
+	l.mu.Lock()
+	l.list[s.MSISDN] = s
+	l.mu.Unlock()
+
+	return nil
+}
+
+func (l *memSuppressions) Remove(msisdn string) error {
+	msisdn = normalizeMSISDN(msisdn)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.list[msisdn]; !ok {
+		return errNotSuppressed
+	}
+	delete(l.list, msisdn)
+
+	return nil
+}
+
+func (l *memSuppressions) Contains(msisdn string) (bool, error) {
+	l.mu.RLock()
+	_, ok := l.list[normalizeMSISDN(msisdn)]
+	l.mu.RUnlock()
+
+	return ok, nil
+}
+
+func (l *memSuppressions) List() ([]Suppression, error) {
+	l.mu.RLock()
+	list := make([]Suppression, 0, len(l.list))
+	for _, s := range l.list {
+		list = append(list, s)
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].MSISDN < list[j].MSISDN
+	})
+
+	return list, nil
+}
+
+// FileSuppressionList keeps suppression list in JSON file. File is rewritten on every change,
+// so change is either saved completely or not at all.
+type FileSuppressionList struct {
+	path string
+
+	mu  sync.Mutex
+	mem memSuppressions
+}
+
+// OpenSuppressionList loads suppression list from file on provided path, file is created on first change.
+func OpenSuppressionList(path string) (*FileSuppressionList, error) {
+	l := &FileSuppressionList{
+		path: path,
+		mem:  memSuppressions{list: make(map[string]Suppression)},
+	}
+
+	var list []Suppression
+	if err := readJSONFile(path, &list); err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		if err := l.mem.Add(s); err != nil {
+			log.Printf("Dropped suppression of %q from %s: %s\n", s.MSISDN, path, err)
+		}
+	}
+
+	return l, nil
+}
+
+// Add suppresses number and saves list.
+func (l *FileSuppressionList) Add(s Suppression) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s.MSISDN = normalizeMSISDN(s.MSISDN)
+	prev, existed := l.mem.list[s.MSISDN]
+	if err := l.mem.Add(s); err != nil {
+		return err
+	}
+
+	if err := l.save(); err != nil {
+		// Keeping memory in line with the file.
+		if existed {
+			l.mem.Add(prev)
+		} else {
+			l.mem.Remove(s.MSISDN)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Remove takes number out of the list and saves it.
+func (l *FileSuppressionList) Remove(msisdn string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	msisdn = normalizeMSISDN(msisdn)
+	prev, ok := l.mem.list[msisdn]
+	if !ok {
+		return errNotSuppressed
+	}
+	l.mem.Remove(msisdn)
+
+	if err := l.save(); err != nil {
+		l.mem.Add(prev)
+		return err
+	}
+
+	return nil
+}
+
+// Contains returns true if number is suppressed.
+func (l *FileSuppressionList) Contains(msisdn string) (bool, error) {
+	return l.mem.Contains(msisdn)
+}
+
+// List returns suppressions sorted by number.
+func (l *FileSuppressionList) List() ([]Suppression, error) {
+	return l.mem.List()
+}
+
+// save writes list to the file.
+func (l *FileSuppressionList) save() error {
+	list, err := l.mem.List()
+	if err != nil {
+		return err
+	}
+
+	return writeJSONFile(l.path, list)
+}
+
+// ApplyOptOut suppresses sender of STOP reply and removes sender of START reply from the list.
+// Other messages are ignored. It can be registered with Inbox.OnMessage.
+// Gateways pass originator with or without leading plus, it is stripped.
+func ApplyOptOut(l SuppressionList, m InboundMessage) error {
+	words := strings.Fields(m.Body)
+	if len(words) != 1 {
+		return nil
+	}
+
+	msisdn := normalizeMSISDN(m.Originator)
+
+	switch {
+	case isKeyword(words[0], StopKeywords):
+		log.Printf("%s opted out with %s.\n", msisdn, words[0])
+		return l.Add(Suppression{MSISDN: msisdn, Reason: "replied " + strings.ToUpper(words[0]), CreatedAt: m.ReceivedAt})
+	case isKeyword(words[0], StartKeywords):
+		log.Printf("%s opted in with %s.\n", msisdn, words[0])
+		if err := l.Remove(msisdn); err != errNotSuppressed {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeMSISDN strips spaces and leading plus of international format.
+func normalizeMSISDN(number string) string {
+	return strings.TrimPrefix(strings.TrimSpace(number), "+")
+}
+
+func isKeyword(word string, keywords []string) bool {
+	for _, k := range keywords {
+		if strings.EqualFold(word, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// SuppressionHandler manages suppression list over HTTP.
+type SuppressionHandler struct {
+	list SuppressionList
+}
+
+// NewSuppressionHandler constructs SuppressionHandler for provided list.
+func NewSuppressionHandler(l SuppressionList) *SuppressionHandler {
+	return &SuppressionHandler{
+		list: l,
+	}
+}
+
+// suppressionRequest is optional body of request that suppresses number.
+type suppressionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// HandleSuppressions lists suppressed numbers on GET. PUT suppresses number that is last element of URL path,
+// with optional reason in JSON body, and DELETE removes it from the list.
+func (h *SuppressionHandler) HandleSuppressions(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		list, err := h.list.List()
+		if err != nil {
+			log.Println("Failed to list suppressions, error:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	if req.Method != "PUT" && req.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	msisdn := normalizeMSISDN(path.Base(req.URL.Path))
+	if !MSISDNRegex.MatchString(msisdn) {
+		http.Error(w, "invalid msisdn", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if req.Method == "PUT" {
+		var sr suppressionRequest
+		if err := json.NewDecoder(req.Body).Decode(&sr); err != nil && err != io.EOF {
+			http.Error(w, "request body is not valid", http.StatusBadRequest)
+			return
+		}
+		err = h.list.Add(Suppression{MSISDN: msisdn, Reason: sr.Reason, CreatedAt: time.Now().UTC()})
+	} else {
+		err = h.list.Remove(msisdn)
+	}
+
+	if err == errNotSuppressed {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to update suppressions, error:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package smsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSuppressionList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "suppressions.json")
+
+	l, err := OpenSuppressionList(path)
+	if err != nil {
+		t.Fatal("Failed to open list:", err)
+	}
+	for _, msisdn := range []string{"380670000000", "380660000000", "380680000000"} {
+		if err := l.Add(Suppression{MSISDN: msisdn, Reason: "test"}); err != nil {
+			t.Fatal("Failed to add:", err)
+		}
+	}
+	if err := l.Remove("380680000000"); err != nil {
+		t.Fatal("Failed to remove:", err)
+	}
+	if err := l.Remove("380680000000"); err != errNotSuppressed {
+		t.Errorf("Got error: %v, expected: %v", err, errNotSuppressed)
+	}
+
+	// Reopening, as if process restarted.
+	l, err = OpenSuppressionList(path)
+	if err != nil {
+		t.Fatal("Failed to reopen list:", err)
+	}
+
+	list, _ := l.List()
+	if len(list) != 2 || list[0].MSISDN != "380660000000" || list[1].MSISDN != "380670000000" {
+		t.Errorf("Got list: %+v", list)
+	}
+	if ok, _ := l.Contains("380670000000"); !ok {
+		t.Error("Number is not suppressed after restart")
+	}
+	if ok, _ := l.Contains("380680000000"); ok {
+		t.Error("Removed number is suppressed after restart")
+	}
+}
+
+func TestApplyOptOut(t *testing.T) {
+	l := NewMemSuppressionList()
+
+	cases := []struct {
+		body       string
+		suppressed bool
+	}{
+		{body: "Stop", suppressed: true},
+		{body: "stop sending me sale", suppressed: true},
+		{body: " START ", suppressed: false},
+		{body: "START", suppressed: false},
+		{body: "unsubscribe", suppressed: true},
+		{body: "Hi", suppressed: true},
+	}
+
+	for _, c := range cases {
+		if err := ApplyOptOut(l, InboundMessage{Originator: "380660000000", Body: c.body}); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if ok, _ := l.Contains("380660000000"); ok != c.suppressed {
+			t.Errorf("Got suppressed: %t, expected: %t after %q", ok, c.suppressed, c.body)
+		}
+	}
+}
+
+func TestApplyOptOutNormalizesOriginator(t *testing.T) {
+	l := NewMemSuppressionList()
+
+	if err := ApplyOptOut(l, InboundMessage{Originator: "+380660000000", Body: "STOP"}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ok, _ := l.Contains("380660000000"); !ok {
+		t.Error("Number that opted out with leading plus is not suppressed")
+	}
+
+	if err := ApplyOptOut(l, InboundMessage{Originator: "Promo", Body: "STOP"}); err != errInvalidMSISDN {
+		t.Errorf("Got error: %v, expected: %v", err, errInvalidMSISDN)
+	}
+	if list, _ := l.List(); len(list) != 1 {
+		t.Errorf("Got %d suppressions, expected: 1", len(list))
+	}
+
+	if err := ApplyOptOut(l, InboundMessage{Originator: "380660000000", Body: "START"}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ok, _ := l.Contains("+380660000000"); ok {
+		t.Error("Number that opted in is still suppressed")
+	}
+}
+
+func TestHandleSuppressions(t *testing.T) {
+	l := NewMemSuppressionList()
+	h := NewSuppressionHandler(l)
+
+	cases := []struct {
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{method: "PUT", url: "/admin/suppressions/380660000000", body: `{"reason": "complaint"}`, code: http.StatusNoContent},
+		{method: "PUT", url: "/admin/suppressions/380670000000", code: http.StatusNoContent},
+		{method: "PUT", url: "/admin/suppressions/0660000000", code: http.StatusBadRequest},
+		{method: "PUT", url: "/admin/suppressions/380680000000", body: `{`, code: http.StatusBadRequest},
+		{method: "DELETE", url: "/admin/suppressions/380670000000", code: http.StatusNoContent},
+		{method: "DELETE", url: "/admin/suppressions/380670000000", code: http.StatusNotFound},
+		{method: "POST", url: "/admin/suppressions", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.HandleSuppressions(rec, httptest.NewRequest(c.method, c.url, strings.NewReader(c.body)))
+		if rec.Code != c.code {
+			t.Errorf("Got status: %d, expected: %d for %s %s", rec.Code, c.code, c.method, c.url)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.HandleSuppressions(rec, httptest.NewRequest("GET", "/admin/suppressions", nil))
+
+	var list []Suppression
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal("Response body is not valid, error:", err)
+	}
+	if len(list) != 1 || list[0].MSISDN != "380660000000" || list[0].Reason != "complaint" {
+		t.Errorf("Got list: %+v", list)
+	}
+}
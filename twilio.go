@@ -0,0 +1,175 @@
+package smsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// TwilioBaseURL is Twilio REST API root.
+	TwilioBaseURL = "https://api.twilio.com/2010-04-01"
+	// TwilioMaxSegments Twilio rejects bodies longer than 1600 chars, that is 10 concatenated SMS.
+	TwilioMaxSegments = 10
+)
+
+// TwilioProvider sends SMS with Twilio Programmable Messaging API.
+// Twilio does not accept UDH, it splits long messages and picks encoding itself.
+type TwilioProvider struct {
+	accountSID string
+	authToken  string
+	// BaseURL of API, can be changed to point to a test server.
+	BaseURL    string
+	HTTPClient *http.Client
+	// StatusCallback is URL Twilio sends delivery reports to, they are not requested if it is empty.
+	// Reports are signed with this exact URL, so it has to be the one Twilio calls, not the one behind proxy.
+	StatusCallback string
+	// InboundURL is URL Twilio posts incoming messages to, as configured for phone number.
+	// Incoming messages are rejected if it is empty, as their signatures can not be checked.
+	InboundURL string
+}
+
+// NewTwilioProvider creates Provider for Twilio account.
+func NewTwilioProvider(accountSID, authToken string) *TwilioProvider {
+	return &TwilioProvider{
+		accountSID: accountSID,
+		authToken:  authToken,
+		BaseURL:    TwilioBaseURL,
+		HTTPClient: &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+// twilioMessage is a part of Twilio message resource we are interested in.
+type twilioMessage struct {
+	SID string `json:"sid"`
+}
+
+// Send creates Twilio message resource, returns its SID.
+func (p *TwilioProvider) Send(m Msg) (string, error) {
+	form := url.Values{}
+	form.Set("From", m.Originator)
+	form.Set("To", "+"+m.Recipient)
+	form.Set("Body", m.Body)
+	if p.StatusCallback != "" {
+		form.Set("StatusCallback", p.StatusCallback)
+	}
+
+	req, err := http.NewRequest("POST", p.BaseURL+"/Accounts/"+p.accountSID+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", &SendError{Kind: Permanent, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(p.accountSID, p.authToken)
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", &SendError{Kind: Temporary, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	// Message is accepted at this point, it is not resent or failed if response can not be read.
+	// Delivery reports can not be matched to it without ID though.
+	var tm twilioMessage
+	if err := json.NewDecoder(resp.Body).Decode(&tm); err != nil {
+		log.Printf("Failed to read Twilio response for accepted SMS to %s: %s\n", m.Recipient, err)
+		return "", nil
+	}
+
+	return tm.SID, nil
+}
+
+// NativeConcat returns true, Twilio splits long messages itself.
+func (p *TwilioProvider) NativeConcat() bool {
+	return true
+}
+
+// MaxSegments returns number of concatenated SMS Twilio allows.
+func (p *TwilioProvider) MaxSegments() int {
+	return TwilioMaxSegments
+}
+
+// ParseReport verifies X-Twilio-Signature of status callback and extracts report from its form.
+func (p *TwilioProvider) ParseReport(req *http.Request) ([]Report, error) {
+	if err := p.verifyRequest(req, p.StatusCallback); err != nil {
+		return nil, err
+	}
+
+	sid := req.PostForm.Get("MessageSid")
+	if sid == "" {
+		return nil, errReportFormat
+	}
+
+	r := Report{ProviderID: sid, Reason: req.PostForm.Get("ErrorCode")}
+	switch req.PostForm.Get("MessageStatus") {
+	case "delivered":
+		r.State = StateDelivered
+	case "failed", "undelivered":
+		r.State = StateFailed
+	default:
+		r.State = StateSubmitted
+	}
+
+	return []Report{r}, nil
+}
+
+// ParseInbound verifies X-Twilio-Signature of incoming message webhook and extracts message from its form.
+// Twilio joins concatenated SMS itself, so message comes whole.
+func (p *TwilioProvider) ParseInbound(req *http.Request) ([]InboundPart, error) {
+	if err := p.verifyRequest(req, p.InboundURL); err != nil {
+		return nil, err
+	}
+
+	part := InboundPart{
+		ProviderID: req.PostForm.Get("MessageSid"),
+		Originator: strings.TrimPrefix(req.PostForm.Get("From"), "+"),
+		Recipient:  strings.TrimPrefix(req.PostForm.Get("To"), "+"),
+		Body:       req.PostForm.Get("Body"),
+	}
+	if part.Originator == "" || part.Recipient == "" {
+		return nil, errInboundFormat
+	}
+
+	return []InboundPart{part}, nil
+}
+
+// verifyRequest checks X-Twilio-Signature of webhook request that Twilio sent to webhookURL, form is parsed.
+// Signature is HMAC-SHA1 of webhook URL followed by form keys and values sorted by key.
+func (p *TwilioProvider) verifyRequest(req *http.Request, webhookURL string) error {
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(req.Header.Get("X-Twilio-Signature"))
+	if err != nil || webhookURL == "" {
+		return ErrSignature
+	}
+
+	keys := make([]string, 0, len(req.PostForm))
+	for k := range req.PostForm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha1.New, []byte(p.authToken))
+	mac.Write([]byte(webhookURL))
+	for _, k := range keys {
+		for _, v := range req.PostForm[k] {
+			mac.Write([]byte(k + v))
+		}
+	}
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return ErrSignature
+	}
+
+	return nil
+}
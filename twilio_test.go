@@ -0,0 +1,153 @@
+package smsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTwilioProviderSend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/Accounts/AC123/Messages.json" {
+			t.Errorf("Got path: %q", r.URL.Path)
+		}
+		if user, pass, _ := r.BasicAuth(); user != "AC123" || pass != "secret" {
+			t.Errorf("Got credentials: %q:%q", user, pass)
+		}
+		if to := r.FormValue("To"); to != "+380660000000" {
+			t.Errorf("Got recipient: %q, expected: %q", to, "+380660000000")
+		}
+		if body := r.FormValue("Body"); body != "Привіт" {
+			t.Errorf("Got body: %q", body)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"sid": "SM42", "status": "queued"}`))
+	}))
+	defer srv.Close()
+
+	p := NewTwilioProvider("AC123", "secret")
+	p.BaseURL = srv.URL
+
+	id, err := p.Send(Msg{Originator: "Bank", Recipient: "380660000000", Body: "Привіт", Encoding: UCS2})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if id != "SM42" {
+		t.Errorf("Got ID: %q, expected: %q", id, "SM42")
+	}
+}
+
+func TestTwilioProviderAcceptsUnreadableResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`not JSON`))
+	}))
+	defer srv.Close()
+
+	p := NewTwilioProvider("AC123", "secret")
+	p.BaseURL = srv.URL
+
+	// Twilio accepted message, sending it again would deliver it twice.
+	if id, err := p.Send(Msg{Recipient: "1"}); err != nil || id != "" {
+		t.Errorf("Got ID: %q, error: %v, expected empty ID without error", id, err)
+	}
+}
+
+func TestTwilioProviderClassifiesErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": 21211, "message": "The 'To' number is not a valid phone number."}`))
+	}))
+	defer srv.Close()
+
+	p := NewTwilioProvider("AC123", "secret")
+	p.BaseURL = srv.URL
+
+	if _, err := p.Send(Msg{Recipient: "1"}); errorKind(err) != Permanent {
+		t.Errorf("Got error: %v, expected permanent one", err)
+	}
+
+	srv.Close()
+	if _, err := p.Send(Msg{Recipient: "1"}); errorKind(err) != Temporary {
+		t.Errorf("Got error: %v, expected temporary one", err)
+	}
+}
+
+func TestTwilioProviderParseReport(t *testing.T) {
+	p := NewTwilioProvider("AC123", "secret")
+	p.StatusCallback = "https://sms.example.com/reports/twilio"
+
+	form := url.Values{}
+	form.Set("MessageSid", "SM1")
+	form.Set("MessageStatus", "undelivered")
+	form.Set("ErrorCode", "30003")
+
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(p.StatusCallback + "ErrorCode30003MessageSidSM1MessageStatusundelivered"))
+	valid := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	for _, sig := range []string{valid, "", "bm9wZQ=="} {
+		req := httptest.NewRequest("POST", "/reports/twilio", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Twilio-Signature", sig)
+
+		reports, err := p.ParseReport(req)
+		if sig != valid {
+			if err != ErrSignature {
+				t.Errorf("Got error: %v, expected: %v for signature %q", err, ErrSignature, sig)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		expected := Report{ProviderID: "SM1", State: StateFailed, Reason: "30003"}
+		if len(reports) != 1 || reports[0] != expected {
+			t.Errorf("Got reports: %+v, expected: %+v", reports, expected)
+		}
+	}
+}
+
+func TestTwilioProviderParseInbound(t *testing.T) {
+	p := NewTwilioProvider("AC123", "secret")
+	p.InboundURL = "https://sms.example.com/inbound/twilio"
+
+	form := url.Values{}
+	form.Set("MessageSid", "SM2")
+	form.Set("From", "+380501234567")
+	form.Set("To", "+15005550006")
+	form.Set("Body", "Hello")
+
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(p.InboundURL + "BodyHelloFrom+380501234567MessageSidSM2To+15005550006"))
+
+	req := httptest.NewRequest("POST", "/inbound/twilio", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	parts, err := p.ParseInbound(req)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	expected := InboundPart{ProviderID: "SM2", Originator: "380501234567", Recipient: "15005550006", Body: "Hello"}
+	if len(parts) != 1 || parts[0] != expected {
+		t.Errorf("Got parts: %+v, expected: %+v", parts, expected)
+	}
+
+	// Status callback URL does not sign incoming messages.
+	p.InboundURL = ""
+	req = httptest.NewRequest("POST", "/inbound/twilio", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	if _, err := p.ParseInbound(req); err != ErrSignature {
+		t.Errorf("Got error: %v, expected: %v", err, ErrSignature)
+	}
+}
@@ -0,0 +1,241 @@
+package smsd
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VonageBaseURL is Vonage SMS API root.
+const VonageBaseURL = "https://rest.nexmo.com"
+
+// Vonage SMS API statuses that can go away if we try again later.
+const (
+	vonageStatusOK        = "0"
+	vonageStatusThrottled = "1"
+	vonageStatusInternal  = "5"
+)
+
+// VonageProvider sends SMS with Vonage (Nexmo) SMS API.
+// Vonage accepts UDH only for binary messages, so it is left to split long messages itself.
+type VonageProvider struct {
+	apiKey    string
+	apiSecret string
+	// BaseURL of API, can be changed to point to a test server.
+	BaseURL    string
+	HTTPClient *http.Client
+	// SignatureSecret verifies delivery receipts signed with MD5 hash method,
+	// all of them are rejected if it is empty.
+	SignatureSecret string
+}
+
+// NewVonageProvider creates Provider for Vonage account.
+func NewVonageProvider(apiKey, apiSecret string) *VonageProvider {
+	return &VonageProvider{
+		apiKey:     apiKey,
+		apiSecret:  apiSecret,
+		BaseURL:    VonageBaseURL,
+		HTTPClient: &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+// vonageResponse is a response of Vonage SMS API, it has an entry per concatenated SMS.
+type vonageResponse struct {
+	Messages []struct {
+		Status    string `json:"status"`
+		MessageID string `json:"message-id"`
+		ErrorText string `json:"error-text"`
+	} `json:"messages"`
+}
+
+// Send submits SMS to Vonage. Vonage responds with ID of every concatenated SMS,
+// they are returned separated by comma.
+func (p *VonageProvider) Send(m Msg) (string, error) {
+	form := url.Values{}
+	form.Set("api_key", p.apiKey)
+	form.Set("api_secret", p.apiSecret)
+	form.Set("from", m.Originator)
+	form.Set("to", m.Recipient)
+	form.Set("text", m.Body)
+	if m.Encoding == UCS2 {
+		form.Set("type", "unicode")
+	} else {
+		form.Set("type", "text")
+	}
+
+	resp, err := p.HTTPClient.Post(p.BaseURL+"/sms/json", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", &SendError{Kind: Temporary, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	// Message could be accepted, it is not resent or failed if response can not be read.
+	var vr vonageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+		log.Printf("Failed to read Vonage response for SMS to %s: %s\n", m.Recipient, err)
+		return "", nil
+	}
+	if len(vr.Messages) == 0 {
+		return "", &SendError{Kind: Permanent, Err: errors.New("vonage response has no messages")}
+	}
+
+	// Vonage answers 200 even if SMS was rejected, status of every part tells the result.
+	ids := make([]string, 0, len(vr.Messages))
+	for _, vm := range vr.Messages {
+		switch {
+		case vm.Status == vonageStatusOK:
+			ids = append(ids, vm.MessageID)
+			continue
+		case len(ids) != 0:
+			// Parts that were accepted are on their way, trying again would send them twice.
+			return "", &SendError{Kind: Permanent, Err: fmt.Errorf("vonage accepted parts %s only, %s",
+				strings.Join(ids, ","), vonageError(vm.Status, vm.ErrorText))}
+		case vm.Status == vonageStatusThrottled:
+			return "", &SendError{Kind: Throttled, Err: vonageError(vm.Status, vm.ErrorText)}
+		case vm.Status == vonageStatusInternal:
+			return "", &SendError{Kind: Temporary, Err: vonageError(vm.Status, vm.ErrorText)}
+		default:
+			return "", &SendError{Kind: Permanent, Err: vonageError(vm.Status, vm.ErrorText)}
+		}
+	}
+
+	return strings.Join(ids, ","), nil
+}
+
+// NativeConcat returns true, Vonage splits long messages itself.
+func (p *VonageProvider) NativeConcat() bool {
+	return true
+}
+
+// ParseReport verifies sig parameter of delivery receipt and extracts report from query or form.
+func (p *VonageProvider) ParseReport(req *http.Request) ([]Report, error) {
+	params, err := p.verifyRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	id := params.Get("messageId")
+	if id == "" {
+		return nil, errReportFormat
+	}
+
+	r := Report{ProviderID: id, Reason: params.Get("err-code")}
+	switch params.Get("status") {
+	case "delivered":
+		r.State = StateDelivered
+	case "expired", "failed", "rejected":
+		r.State = StateFailed
+	default:
+		// Accepted and buffered messages are still on their way, unknown ones may be reported later.
+		r.State = StateSubmitted
+	}
+
+	return []Report{r}, nil
+}
+
+// ParseInbound verifies sig parameter of incoming message and extracts it from query or form.
+// Vonage passes parts of concatenated SMS one by one, concat parameters are turned into Header.
+func (p *VonageProvider) ParseInbound(req *http.Request) ([]InboundPart, error) {
+	params, err := p.verifyRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	part := InboundPart{
+		ProviderID: params.Get("messageId"),
+		Originator: params.Get("msisdn"),
+		Recipient:  params.Get("to"),
+		Body:       params.Get("text"),
+	}
+	if part.Originator == "" || part.Recipient == "" {
+		return nil, errInboundFormat
+	}
+
+	if params.Get("concat") == "true" {
+		ref, err := strconv.ParseUint(params.Get("concat-ref"), 10, 16)
+		if err != nil {
+			return nil, errInboundFormat
+		}
+		total, err := strconv.ParseUint(params.Get("concat-total"), 10, 8)
+		if err != nil {
+			return nil, errInboundFormat
+		}
+		current, err := strconv.ParseUint(params.Get("concat-part"), 10, 8)
+		if err != nil {
+			return nil, errInboundFormat
+		}
+
+		// Reference is the one handset put in UDH, it is 16-bit only if it does not fit in 8.
+		if ref > 0xFF {
+			part.Header, err = NewUDH16(uint16(ref), byte(total), byte(current))
+		} else {
+			part.Header, err = NewRefUDH(byte(ref), byte(total), byte(current))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return []InboundPart{part}, nil
+}
+
+// verifyRequest checks sig parameter of webhook request and returns its query and form parameters.
+// Signature is MD5 of parameters sorted by name as &name=value, followed by signature secret.
+func (p *VonageProvider) verifyRequest(req *http.Request) (url.Values, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	params := req.Form
+
+	if p.SignatureSecret == "" {
+		return nil, ErrSignature
+	}
+	if err := checkReportAge(params.Get("timestamp"), time.Now()); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(params.Get("sig"))), []byte(vonageSignature(params, p.SignatureSecret))) != 1 {
+		return nil, ErrSignature
+	}
+
+	return params, nil
+}
+
+// vonageSignature computes MD5 hash signature of parameters, & and = in values are replaced with _.
+func vonageSignature(params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k != "sig" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	replacer := strings.NewReplacer("&", "_", "=", "_")
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString("&" + k + "=" + replacer.Replace(params.Get(k)))
+	}
+	b.WriteString(secret)
+
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func vonageError(status, text string) error {
+	return fmt.Errorf("vonage status %s: %s", status, text)
+}
@@ -0,0 +1,201 @@
+package smsd
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVonageProviderSend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("api_key") != "key" || r.FormValue("api_secret") != "secret" {
+			t.Error("Credentials are not passed")
+		}
+		if typ := r.FormValue("type"); typ != "unicode" {
+			t.Errorf("Got type: %q, expected: %q", typ, "unicode")
+		}
+
+		w.Write([]byte(`{"message-count": "2", "messages": [
+			{"to": "380660000000", "message-id": "A1", "status": "0"},
+			{"to": "380660000000", "message-id": "A2", "status": "0"}
+		]}`))
+	}))
+	defer srv.Close()
+
+	p := NewVonageProvider("key", "secret")
+	p.BaseURL = srv.URL
+
+	id, err := p.Send(Msg{Originator: "Bank", Recipient: "380660000000", Body: "Привіт", Encoding: UCS2})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if id != "A1,A2" {
+		t.Errorf("Got ID: %q, expected: %q", id, "A1,A2")
+	}
+}
+
+func TestVonageProviderClassifiesStatuses(t *testing.T) {
+	cases := []struct {
+		status string
+		kind   ErrorKind
+	}{
+		{status: "1", kind: Throttled},
+		{status: "5", kind: Temporary},
+		{status: "4", kind: Permanent},
+		{status: "6", kind: Permanent},
+	}
+
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"message-count": "1", "messages": [{"status": "` + c.status + `", "error-text": "Nope"}]}`))
+		}))
+
+		p := NewVonageProvider("key", "secret")
+		p.BaseURL = srv.URL
+
+		_, err := p.Send(Msg{Recipient: "380660000000", Body: "Hola"})
+		if kind := errorKind(err); err == nil || kind != c.kind {
+			t.Errorf("Got error: %v, expected %s one for status: %s", err, c.kind, c.status)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestVonageProviderAcceptsUnreadableResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`not JSON`))
+	}))
+	defer srv.Close()
+
+	p := NewVonageProvider("key", "secret")
+	p.BaseURL = srv.URL
+
+	if id, err := p.Send(Msg{Recipient: "380660000000", Body: "Hola"}); err != nil || id != "" {
+		t.Errorf("Got ID: %q, error: %v, expected empty ID without error", id, err)
+	}
+}
+
+func TestVonageProviderFailsPartiallyAcceptedMessage(t *testing.T) {
+	for _, status := range []string{"1", "5", "4"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"message-count": "2", "messages": [{"status": "0", "message-id": "part-1"}, ` +
+				`{"status": "` + status + `", "error-text": "Nope"}]}`))
+		}))
+
+		p := NewVonageProvider("key", "secret")
+		p.BaseURL = srv.URL
+
+		// Accepted part must not be sent again.
+		_, err := p.Send(Msg{Recipient: "380660000000", Body: "Hola"})
+		if kind := errorKind(err); err == nil || kind != Permanent {
+			t.Errorf("Got error: %v, expected permanent one for status: %s", err, status)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestVonageProviderParseReport(t *testing.T) {
+	p := NewVonageProvider("key", "secret")
+	p.SignatureSecret = "sigsecret"
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	sign := func(timestamp string) string {
+		sum := md5.Sum([]byte("&err-code=0&messageId=A2&status=delivered&timestamp=" + timestamp + "sigsecret"))
+		return hex.EncodeToString(sum[:])
+	}
+
+	cases := []struct {
+		timestamp string
+		sig       string
+		err       error
+	}{
+		{timestamp: now, sig: sign(now)},
+		{timestamp: now, sig: sign(old), err: ErrSignature},
+		{timestamp: old, sig: sign(old), err: ErrSignature},
+	}
+
+	for _, c := range cases {
+		q := url.Values{}
+		q.Set("messageId", "A2")
+		q.Set("status", "delivered")
+		q.Set("err-code", "0")
+		q.Set("timestamp", c.timestamp)
+		q.Set("sig", c.sig)
+
+		reports, err := p.ParseReport(httptest.NewRequest("GET", "/reports/vonage?"+q.Encode(), nil))
+		if err != c.err {
+			t.Errorf("Got error: %v, expected: %v", err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		expected := Report{ProviderID: "A2", State: StateDelivered, Reason: "0"}
+		if len(reports) != 1 || reports[0] != expected {
+			t.Errorf("Got reports: %+v, expected: %+v", reports, expected)
+		}
+	}
+}
+
+func TestVonageProviderParseInbound(t *testing.T) {
+	p := NewVonageProvider("key", "secret")
+	p.SignatureSecret = "sigsecret"
+
+	cases := []struct {
+		params   map[string]string
+		expected Header
+		err      bool
+	}{
+		{params: map[string]string{}},
+		{
+			params:   map[string]string{"concat": "true", "concat-ref": "17", "concat-total": "3", "concat-part": "2"},
+			expected: mustHeader(NewRefUDH(17, 3, 2)),
+		},
+		{
+			params:   map[string]string{"concat": "true", "concat-ref": "4660", "concat-total": "3", "concat-part": "2"},
+			expected: mustHeader(NewUDH16(4660, 3, 2)),
+		},
+		{params: map[string]string{"concat": "true", "concat-ref": "17", "concat-total": "3", "concat-part": "4"}, err: true},
+		{params: map[string]string{"concat": "true", "concat-ref": "x", "concat-total": "3", "concat-part": "1"}, err: true},
+	}
+
+	for _, c := range cases {
+		q := url.Values{}
+		q.Set("msisdn", "380501234567")
+		q.Set("to", "4915112345678")
+		q.Set("messageId", "M1")
+		q.Set("text", "Hello")
+		q.Set("timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+		for k, v := range c.params {
+			q.Set(k, v)
+		}
+		q.Set("sig", vonageSignature(q, "sigsecret"))
+
+		parts, err := p.ParseInbound(httptest.NewRequest("GET", "/inbound/vonage?"+q.Encode(), nil))
+		if c.err {
+			if err == nil {
+				t.Errorf("Got no error for: %v", c.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error: %v for: %v", err, c.params)
+			continue
+		}
+
+		expected := InboundPart{ProviderID: "M1", Originator: "380501234567", Recipient: "4915112345678", Body: "Hello", Header: c.expected}
+		if len(parts) != 1 || parts[0] != expected {
+			t.Errorf("Got parts: %+v, expected: %+v", parts, expected)
+		}
+	}
+}